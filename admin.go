@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AdminSessionInfo struct {
+	ID           string    `json:"id"`
+	User         string    `json:"user"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Bucket       string    `json:"bucket"`
+	StartTime    time.Time `json:"start_time"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+	OpenFiles    int       `json:"open_files"`
+}
+
+type AdminUploadInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// AdminServer serves the HTTP API to inspect and manage the live sessions.
+//
+//	GET    /sessions              lists the sessions
+//	DELETE /sessions/{id}         disconnects the session
+//	DELETE /users/{user}/sessions disconnects all the sessions of the user
+//	GET    /uploads               lists the uploads in flight
+//	GET    /blocks                lists the users blocked
+//	PUT    /blocks/{user}         blocks the user and disconnects its sessions
+//	DELETE /blocks/{user}         unblocks the user
+type AdminServer struct {
+	Server *Server
+	// Token is changed with SetToken once the server is running.
+	Token string
+	Log   interface {
+		DebugLogger
+		InfoLogger
+		ErrorLogger
+	}
+	mtx sync.Mutex
+}
+
+// SetToken changes the token the requests must carry.
+func (as *AdminServer) SetToken(token string) {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+	as.Token = token
+}
+
+func (as *AdminServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		F(as.Log.Error, "failed to write admin API response: %s", err.Error())
+	}
+}
+
+func (as *AdminServer) writeError(w http.ResponseWriter, status int, msg string) {
+	as.writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (as *AdminServer) authorized(r *http.Request) bool {
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return false
+	}
+	as.mtx.Lock()
+	token := as.Token
+	as.mtx.Unlock()
+	return subtle.ConstantTimeCompare([]byte(authz[len("Bearer "):]), []byte(token)) == 1
+}
+
+func (as *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := as.Server.Sessions.List()
+	retval := make([]AdminSessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		retval = append(retval, AdminSessionInfo{
+			ID:           sess.ID,
+			User:         sess.User,
+			RemoteAddr:   sess.RemoteAddr.String(),
+			Bucket:       sess.Bucket,
+			StartTime:    sess.StartTime,
+			BytesRead:    sess.BytesRead(),
+			BytesWritten: sess.BytesWritten(),
+			OpenFiles:    sess.OpenFiles(),
+		})
+	}
+	as.writeJSON(w, http.StatusOK, retval)
+}
+
+func (as *AdminServer) listUploads(w http.ResponseWriter, r *http.Request) {
+	infos := as.Server.PhantomObjectMap.ListAll()
+	retval := make([]AdminUploadInfo, 0, len(infos))
+	for _, info := range infos {
+		_info := info.GetOne()
+		retval = append(retval, AdminUploadInfo{
+			Key:          _info.Key.String(),
+			Size:         _info.Size,
+			LastModified: _info.LastModified,
+		})
+	}
+	as.writeJSON(w, http.StatusOK, retval)
+}
+
+func (as *AdminServer) disconnectSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess := as.Server.Sessions.Get(id)
+	if sess == nil {
+		as.writeError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	F(as.Log.Info, "admin: disconnecting session %s of user %s", sess.ID, sess.User)
+	sess.Disconnect()
+	as.writeJSON(w, http.StatusOK, map[string]int{"disconnected": 1})
+}
+
+func (as *AdminServer) disconnectUser(w http.ResponseWriter, r *http.Request, user string) {
+	F(as.Log.Info, "admin: disconnecting sessions of user %s", user)
+	n := as.Server.Sessions.DisconnectUser(user)
+	as.writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+}
+
+func (as *AdminServer) blockUser(w http.ResponseWriter, r *http.Request, user string) {
+	F(as.Log.Info, "admin: blocking user %s", user)
+	as.Server.Sessions.Block(user)
+	n := as.Server.Sessions.DisconnectUser(user)
+	as.writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+}
+
+func (as *AdminServer) unblockUser(w http.ResponseWriter, r *http.Request, user string) {
+	if !as.Server.Sessions.Unblock(user) {
+		as.writeError(w, http.StatusNotFound, "user is not blocked")
+		return
+	}
+	F(as.Log.Info, "admin: unblocked user %s", user)
+	as.writeJSON(w, http.StatusOK, map[string]string{})
+}
+
+func (as *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	F(as.Log.Debug, "admin: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	if !as.authorized(r) {
+		as.writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	p := SplitIntoPath(r.URL.Path)
+	if len(p) > 0 && p[0] == "" {
+		p = p[1:]
+	}
+	switch {
+	case len(p) == 1 && p[0] == "sessions" && r.Method == http.MethodGet:
+		as.listSessions(w, r)
+	case len(p) == 2 && p[0] == "sessions" && r.Method == http.MethodDelete:
+		as.disconnectSession(w, r, p[1])
+	case len(p) == 3 && p[0] == "users" && p[2] == "sessions" && r.Method == http.MethodDelete:
+		as.disconnectUser(w, r, p[1])
+	case len(p) == 1 && p[0] == "uploads" && r.Method == http.MethodGet:
+		as.listUploads(w, r)
+	case len(p) == 1 && p[0] == "blocks" && r.Method == http.MethodGet:
+		as.writeJSON(w, http.StatusOK, as.Server.Sessions.BlockedUsers())
+	case len(p) == 2 && p[0] == "blocks" && r.Method == http.MethodPut:
+		as.blockUser(w, r, p[1])
+	case len(p) == 2 && p[0] == "blocks" && r.Method == http.MethodDelete:
+		as.unblockUser(w, r, p[1])
+	default:
+		as.writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Run serves the API on the listener until ctx is done.
+func (as *AdminServer) Run(ctx context.Context, lsnr net.Listener) error {
+	httpServer := &http.Server{Handler: as}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	err := httpServer.Serve(lsnr)
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdminServer() (*AdminServer, *Server) {
+	server := &Server{
+		PhantomObjectMap: NewPhantomObjectMap(),
+		Sessions:         NewSessionRegistry(),
+	}
+	return &AdminServer{Server: server, Token: "secret", Log: logrus.New()}, server
+}
+
+func doAdminRequest(as *AdminServer, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	as.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminServerUnauthorized(t *testing.T) {
+	as, _ := newTestAdminServer()
+	assert.Equal(t, http.StatusUnauthorized, doAdminRequest(as, "GET", "/sessions", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, doAdminRequest(as, "GET", "/sessions", "wrong").Code)
+	assert.Equal(t, http.StatusOK, doAdminRequest(as, "GET", "/sessions", "secret").Code)
+
+	as.SetToken("renewed")
+	assert.Equal(t, http.StatusUnauthorized, doAdminRequest(as, "GET", "/sessions", "secret").Code)
+	assert.Equal(t, http.StatusOK, doAdminRequest(as, "GET", "/sessions", "renewed").Code)
+}
+
+func TestAdminServerSessions(t *testing.T) {
+	as, server := newTestAdminServer()
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	sess1 := server.Sessions.Register("user01", addr, "test", time.Unix(1, 0), cancel1)
+	server.Sessions.Register("user02", addr, "test", time.Unix(2, 0), cancel2)
+	sess1.WrapWriterAt(NewBytesWriter()).WriteAt([]byte("abc"), 0)
+
+	w := doAdminRequest(as, "GET", "/sessions", "secret")
+	var sessions []AdminSessionInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	assert.Equal(t, 2, len(sessions))
+	assert.Equal(t, "user01", sessions[0].User)
+	assert.Equal(t, "192.0.2.1:12345", sessions[0].RemoteAddr)
+	assert.Equal(t, int64(3), sessions[0].BytesWritten)
+	assert.Equal(t, 1, sessions[0].OpenFiles)
+
+	assert.Equal(t, http.StatusNotFound, doAdminRequest(as, "DELETE", "/sessions/100", "secret").Code)
+	assert.Equal(t, http.StatusOK, doAdminRequest(as, "DELETE", "/sessions/"+sess1.ID, "secret").Code)
+	assert.Error(t, ctx1.Err())
+	assert.NoError(t, ctx2.Err())
+
+	assert.Equal(t, http.StatusOK, doAdminRequest(as, "PUT", "/blocks/user02", "secret").Code)
+	assert.Error(t, ctx2.Err())
+	assert.Equal(t, true, server.Sessions.IsBlocked("user02"))
+	assert.Equal(t, http.StatusOK, doAdminRequest(as, "DELETE", "/blocks/user02", "secret").Code)
+	assert.Equal(t, false, server.Sessions.IsBlocked("user02"))
+	assert.Equal(t, http.StatusNotFound, doAdminRequest(as, "DELETE", "/blocks/user02", "secret").Code)
+}
+
+func TestAdminServerDisconnectDuringUpload(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	as, server := newTestAdminServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := server.Sessions.Register("user01", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}, "test", time.Unix(1, 0), cancel)
+	info := &PhantomObjectInfo{Key: Path{"a"}}
+	w := sess.WrapWriterAt(&S3PutObjectWriter{
+		Ctx:              ctx,
+		Key:              info.Key,
+		Backend:          &LocalBackend{Root: root},
+		Log:              logrus.New(),
+		MaxObjectSize:    1024,
+		PhantomObjectMap: server.PhantomObjectMap,
+		Uploads:          NewUploadTracker(),
+		Info:             info,
+		writer:           NewBytesWriter(),
+	})
+	_, err = w.WriteAt([]byte("partial"), 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, doAdminRequest(as, "DELETE", "/sessions/"+sess.ID, "secret").Code)
+	assert.Error(t, ctx.Err())
+	// the file is closed as the connection is torn down
+	assert.NoError(t, closeIfCloser(w))
+	_, err = os.Stat(filepath.Join(root, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAdminServerUploads(t *testing.T) {
+	as, server := newTestAdminServer()
+	server.PhantomObjectMap.Add(&PhantomObjectInfo{Key: Path{"prefix", "a"}, Size: 10})
+	w := doAdminRequest(as, "GET", "/uploads", "secret")
+	var uploads []AdminUploadInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &uploads))
+	assert.Equal(t, []AdminUploadInfo{{Key: "prefix/a", Size: 10}}, uploads)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHAlgorithms are the algorithms of the SSH protocol, each in the order
+// of preference.  PublicKeyAlgorithms cover both the host keys and the keys
+// of the users.
+type SSHAlgorithms struct {
+	Ciphers             []string
+	KeyExchanges        []string
+	MACs                []string
+	PublicKeyAlgorithms []string
+}
+
+var sshAlgorithmPresets = map[string]SSHAlgorithms{
+	// modern passes the common security scans, and is supported by
+	// OpenSSH 6.5 and later.
+	"modern": {
+		Ciphers: []string{
+			ssh.CipherChaCha20Poly1305,
+			ssh.CipherAES256GCM,
+			ssh.CipherAES128GCM,
+			ssh.CipherAES256CTR,
+			ssh.CipherAES192CTR,
+			ssh.CipherAES128CTR,
+		},
+		KeyExchanges: []string{
+			ssh.KeyExchangeMLKEM768X25519,
+			ssh.KeyExchangeCurve25519,
+			ssh.KeyExchangeDH16SHA512,
+			ssh.KeyExchangeDHGEXSHA256,
+		},
+		MACs: []string{
+			ssh.HMACSHA256ETM,
+			ssh.HMACSHA512ETM,
+		},
+		PublicKeyAlgorithms: []string{
+			ssh.CertAlgoED25519v01,
+			ssh.CertAlgoECDSA256v01,
+			ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01,
+			ssh.CertAlgoRSASHA256v01,
+			ssh.KeyAlgoED25519,
+			ssh.KeyAlgoSKED25519,
+			ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoECDSA384,
+			ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoSKECDSA256,
+			ssh.KeyAlgoRSASHA512,
+			ssh.KeyAlgoRSASHA256,
+		},
+	},
+	// legacy-compat adds the algorithms with security issues still used by
+	// the old clients, such as SHA-1 and CBC mode.
+	"legacy-compat": {
+		Ciphers: concatStrings(
+			ssh.SupportedAlgorithms().Ciphers,
+			[]string{ssh.InsecureCipherAES128CBC, ssh.InsecureCipherTripleDESCBC},
+		),
+		KeyExchanges: concatStrings(
+			ssh.SupportedAlgorithms().KeyExchanges,
+			[]string{ssh.InsecureKeyExchangeDH14SHA1, ssh.InsecureKeyExchangeDHGEXSHA1, ssh.InsecureKeyExchangeDH1SHA1},
+		),
+		MACs: concatStrings(
+			ssh.SupportedAlgorithms().MACs,
+			[]string{ssh.InsecureHMACSHA196},
+		),
+		PublicKeyAlgorithms: concatStrings(
+			ssh.SupportedAlgorithms().HostKeys,
+			ssh.SupportedAlgorithms().PublicKeyAuths,
+			[]string{ssh.CertAlgoRSAv01, ssh.KeyAlgoRSA},
+		),
+	},
+}
+
+func concatStrings(lists ...[]string) []string {
+	var retval []string
+	for _, list := range lists {
+		for _, s := range list {
+			if !containsString(retval, s) {
+				retval = append(retval, s)
+			}
+		}
+	}
+	return retval
+}
+
+// knownSSHAlgorithms returns all the algorithms implemented, including those
+// with security issues.
+func knownSSHAlgorithms() SSHAlgorithms {
+	supported := ssh.SupportedAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+	return SSHAlgorithms{
+		Ciphers:             concatStrings(supported.Ciphers, insecure.Ciphers),
+		KeyExchanges:        concatStrings(supported.KeyExchanges, insecure.KeyExchanges),
+		MACs:                concatStrings(supported.MACs, insecure.MACs),
+		PublicKeyAlgorithms: concatStrings(supported.HostKeys, supported.PublicKeyAuths, insecure.HostKeys, insecure.PublicKeyAuths),
+	}
+}
+
+// Validate tells whether all the algorithms are implemented.
+func (a SSHAlgorithms) Validate() error {
+	known := knownSSHAlgorithms()
+	for _, c := range []struct {
+		key   string
+		names []string
+		known []string
+	}{
+		{"ciphers", a.Ciphers, known.Ciphers},
+		{"key_exchanges", a.KeyExchanges, known.KeyExchanges},
+		{"macs", a.MACs, known.MACs},
+		{"public_key_algorithms", a.PublicKeyAlgorithms, known.PublicKeyAlgorithms},
+	} {
+		if len(c.names) == 0 {
+			return fmt.Errorf("%s must not be empty", c.key)
+		}
+		for _, name := range c.names {
+			if !containsString(c.known, name) {
+				return fmt.Errorf("%s: unsupported algorithm: %s", c.key, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply sets the algorithms to the server config.  The host keys are set
+// apart with HostKeys.AddTo.
+func (a SSHAlgorithms) Apply(c *ssh.ServerConfig) {
+	c.Ciphers = a.Ciphers
+	c.KeyExchanges = a.KeyExchanges
+	c.MACs = a.MACs
+	// the certificates of the users are told by the underlying algorithms
+	userKeyAlgorithms := concatStrings(ssh.SupportedAlgorithms().PublicKeyAuths, ssh.InsecureAlgorithms().PublicKeyAuths)
+	c.PublicKeyAuthAlgorithms = nil
+	for _, name := range a.PublicKeyAlgorithms {
+		if containsString(userKeyAlgorithms, name) {
+			c.PublicKeyAuthAlgorithms = append(c.PublicKeyAuthAlgorithms, name)
+		}
+	}
+}
+
+// rsaSignatureAlgorithms are the signature algorithms of the RSA keys,
+// which are told apart from each other unlike those of the other keys, and
+// rsaCertAlgorithms are those of the certificates in the same order.
+var (
+	rsaSignatureAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	rsaCertAlgorithms      = []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+)
+
+// rsaSignatureAlgorithmOf returns the signature algorithm of the RSA key or
+// certificate algorithm, and false if it is of another key type.
+func rsaSignatureAlgorithmOf(algorithm string) (string, bool) {
+	for i, name := range rsaSignatureAlgorithms {
+		if algorithm == name || algorithm == rsaCertAlgorithms[i] {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// restrictHostKey returns the host key that signs only with the algorithms
+// allowed, or nil if none of those of the key are.
+func restrictHostKey(sgn ssh.Signer, algorithms []string) (ssh.Signer, error) {
+	var names []string
+	switch sgn.PublicKey().Type() {
+	case ssh.KeyAlgoRSA:
+		names = rsaSignatureAlgorithms
+	case ssh.CertAlgoRSAv01:
+		names = rsaCertAlgorithms
+	default:
+		if !containsString(algorithms, sgn.PublicKey().Type()) {
+			return nil, nil
+		}
+		return sgn, nil
+	}
+	var allowed []string
+	for i, name := range names {
+		if containsString(algorithms, name) {
+			allowed = append(allowed, rsaSignatureAlgorithms[i])
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	algSgn, ok := sgn.(ssh.AlgorithmSigner)
+	if !ok {
+		return sgn, nil
+	}
+	return ssh.NewSignerWithAlgorithms(algSgn, allowed)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHAlgorithmPresets(t *testing.T) {
+	for name, preset := range sshAlgorithmPresets {
+		assert.NoError(t, preset.Validate(), name)
+	}
+	modern := sshAlgorithmPresets["modern"]
+	insecure := ssh.InsecureAlgorithms()
+	for _, name := range concatStrings(modern.Ciphers, modern.KeyExchanges, modern.MACs, modern.PublicKeyAlgorithms) {
+		assert.False(t, containsString(concatStrings(insecure.Ciphers, insecure.KeyExchanges, insecure.MACs, insecure.HostKeys, insecure.PublicKeyAuths), name), name)
+	}
+	assert.NotContains(t, modern.MACs, ssh.HMACSHA1)
+
+	algs := modern
+	algs.Ciphers = []string{"aes128-cbc", "blowfish-cbc"}
+	assert.Error(t, algs.Validate())
+	algs = modern
+	algs.MACs = []string{}
+	assert.Error(t, algs.Validate())
+}
+
+func TestRestrictHostKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSgn, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Sgn, err := ssh.NewSignerFromKey(ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sgn, err := restrictHostKey(rsaSgn, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA256})
+	if assert.NoError(t, err) && assert.NotNil(t, sgn) {
+		assert.Equal(t, []string{ssh.KeyAlgoRSASHA256}, sgn.(ssh.MultiAlgorithmSigner).Algorithms())
+	}
+	sgn, err = restrictHostKey(rsaSgn, []string{ssh.KeyAlgoED25519, ssh.CertAlgoRSASHA256v01})
+	assert.NoError(t, err)
+	assert.Nil(t, sgn)
+
+	sgn, err = restrictHostKey(ed25519Sgn, []string{ssh.KeyAlgoED25519})
+	assert.NoError(t, err)
+	assert.Equal(t, ed25519Sgn, sgn)
+	sgn, err = restrictHostKey(ed25519Sgn, []string{ssh.KeyAlgoRSASHA256})
+	assert.NoError(t, err)
+	assert.Nil(t, sgn)
+}
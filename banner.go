@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BannerQuota is the usage of the user against the quotas.  The limits and
+// what remains are the smaller of those of the bucket config and those of
+// the user, and are negative if unlimited.
+type BannerQuota struct {
+	UsedBytes      int64
+	UsedFiles      int64
+	LimitBytes     int64
+	LimitFiles     int64
+	RemainingBytes int64
+	RemainingFiles int64
+}
+
+// BannerData is given to the templates of the banners and the login
+// messages.
+type BannerData struct {
+	User          string
+	ClientVersion string
+	RemoteAddr    string
+	Time          time.Time
+	Listener      string
+	// Bucket, Perms and Quota are only told in the login messages.  Quota
+	// is nil unless quotas are configured and the usage is known.
+	Bucket string
+	Perms  Perms
+	Quota  *BannerQuota
+}
+
+func newBannerData(c ssh.ConnMetadata, listener string, now time.Time) *BannerData {
+	return &BannerData{
+		User:          c.User(),
+		ClientVersion: string(c.ClientVersion()),
+		RemoteAddr:    c.RemoteAddr().String(),
+		Time:          now,
+		Listener:      listener,
+	}
+}
+
+// newLoginMessageData returns the data of the login message for the user
+// of the bucket config.
+func newLoginMessageData(c ssh.ConnMetadata, listener string, now time.Time, bucket *S3Bucket) *BannerData {
+	data := newBannerData(c, listener, now)
+	data.Bucket = bucket.Name
+	data.Perms = bucket.Perms
+	remaining, limits, ok := bucket.Quota.Remaining(c.User())
+	if ok {
+		bucketUsage, userUsage := bucket.Quota.Usage(c.User())
+		used := bucketUsage
+		if bucket.Quota.PerUser() {
+			used = userUsage
+		}
+		data.Quota = &BannerQuota{
+			UsedBytes:      used.Bytes,
+			UsedFiles:      used.Objects,
+			LimitBytes:     limits.Bytes,
+			LimitFiles:     limits.Objects,
+			RemainingBytes: remaining.Bytes,
+			RemainingFiles: remaining.Objects,
+		}
+	}
+	return data
+}
+
+// formatBytes formats the size in the binary prefixes, such as "1.5 MiB".
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB", "PiB"} {
+		v /= 1024
+		if v < 1024 || unit == "PiB" {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+	}
+	return ""
+}
+
+var bannerFuncs = template.FuncMap{
+	"bytes": formatBytes,
+}
+
+// BannerTemplate is the template of a banner or a login message in the
+// syntax of text/template.
+type BannerTemplate struct {
+	t *template.Template
+}
+
+// ParseBannerTemplate parses the template, and tries it with the data with
+// and without the quota so that the errors show up in advance.
+func ParseBannerTemplate(text string) (*BannerTemplate, error) {
+	t, err := template.New("banner").Funcs(bannerFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	bt := &BannerTemplate{t: t}
+	for _, data := range []*BannerData{{}, {Quota: &BannerQuota{}}} {
+		_, err = bt.execute(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bt, nil
+}
+
+func (bt *BannerTemplate) execute(data *BannerData) (string, error) {
+	buf := &bytes.Buffer{}
+	err := bt.t.Execute(buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Render returns the text for the data, which is empty if the template
+// fails.
+func (bt *BannerTemplate) Render(data *BannerData) string {
+	if bt == nil {
+		return ""
+	}
+	s, err := bt.execute(data)
+	if err != nil {
+		return ""
+	}
+	return s
+}
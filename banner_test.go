@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBannerTemplate(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		ok   bool
+	}{
+		{"", true},
+		{"Welcome, {{.User}}\n", true},
+		{"{{.ClientVersion}} from {{.RemoteAddr}} at {{.Time.Format \"2006-01-02\"}}", true},
+		{"{{with .Quota}}{{bytes .RemainingBytes}} left{{end}}", true},
+		// the quota is not always known
+		{"{{bytes .Quota.RemainingBytes}} left", false},
+		{"{{.Unknown}}", false},
+		{"{{.User", false},
+		{"{{unknown .User}}", false},
+	} {
+		_, err := ParseBannerTemplate(c.text)
+		if c.ok {
+			assert.NoError(t, err, c.text)
+		} else {
+			assert.Error(t, err, c.text)
+		}
+	}
+}
+
+func TestBannerTemplateRender(t *testing.T) {
+	bt, err := ParseBannerTemplate("{{.User}} on {{.Listener}}: {{.Bucket}}{{if .Perms.Writable}} (writable){{end}}{{with .Quota}}, {{bytes .UsedBytes}} of {{bytes .LimitBytes}} used{{end}}")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := &BannerData{
+		User:     "user",
+		Time:     time.Now(),
+		Listener: "default",
+		Bucket:   "test",
+		Perms:    Perms{Readable: true, Writable: true},
+	}
+	assert.Equal(t, "user on default: test (writable)", bt.Render(data))
+	data.Quota = &BannerQuota{UsedBytes: 1536, LimitBytes: 1048576}
+	assert.Equal(t, "user on default: test (writable), 1.5 KiB of 1.0 MiB used", bt.Render(data))
+
+	var nilTemplate *BannerTemplate
+	assert.Equal(t, "", nilTemplate.Render(data))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", formatBytes(0))
+	assert.Equal(t, "1023 B", formatBytes(1023))
+	assert.Equal(t, "1.0 KiB", formatBytes(1024))
+	assert.Equal(t, "2.5 GiB", formatBytes(5<<29))
+	assert.Equal(t, "2048.0 PiB", formatBytes(1<<61))
+}
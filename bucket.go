@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"strings"
 
 	aws "github.com/aws/aws-sdk-go/aws"
 	aws_creds "github.com/aws/aws-sdk-go/aws/credentials"
-	aws_ec2_role_creds "github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
-	aws_ec2_meta "github.com/aws/aws-sdk-go/aws/ec2metadata"
-	aws_session "github.com/aws/aws-sdk-go/aws/session"
-	s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
 )
 
@@ -19,15 +21,23 @@ type ServerSideEncryptionType int
 
 const (
 	ServerSideEncryptionTypeNone = iota
+	// ServerSideEncryptionTypeAES256 is SSE-S3, where S3 manages the keys.
 	ServerSideEncryptionTypeAES256
+	// ServerSideEncryptionTypeKMS is SSE-KMS.
 	ServerSideEncryptionTypeKMS
+	// ServerSideEncryptionTypeCustomerKey is SSE-C, where the key is given
+	// along with every request.
+	ServerSideEncryptionTypeCustomerKey
 )
 
 var sseNameToEnumMap = map[string]ServerSideEncryptionType{
-	"":       ServerSideEncryptionTypeNone,
-	"none":   ServerSideEncryptionTypeNone,
-	"aes256": ServerSideEncryptionTypeAES256,
-	"kms":    ServerSideEncryptionTypeKMS,
+	"":        ServerSideEncryptionTypeNone,
+	"none":    ServerSideEncryptionTypeNone,
+	"aes256":  ServerSideEncryptionTypeAES256,
+	"sse-s3":  ServerSideEncryptionTypeAES256,
+	"kms":     ServerSideEncryptionTypeKMS,
+	"sse-kms": ServerSideEncryptionTypeKMS,
+	"sse-c":   ServerSideEncryptionTypeCustomerKey,
 }
 
 func (v *ServerSideEncryptionType) UnmarshalText(text []byte) error {
@@ -47,7 +57,7 @@ type ServerSideEncryptionConfig struct {
 }
 
 func (cfg *ServerSideEncryptionConfig) CustomerAlgorithm() string {
-	if cfg.Type == ServerSideEncryptionTypeAES256 {
+	if cfg.Type == ServerSideEncryptionTypeCustomerKey {
 		return "AES256"
 	} else {
 		return ""
@@ -64,12 +74,81 @@ type S3Bucket struct {
 	Name                           string
 	AWSConfig                      *aws.Config
 	Bucket                         string
+	Backend                        StorageBackend
 	KeyPrefix                      Path
 	MaxObjectSize                  int64
 	Users                          UserStore
 	Perms                          Perms
 	ServerSideEncryption           ServerSideEncryptionConfig
 	KeyboardInteractiveAuthEnabled bool
+	Scanner                        Scanner
+	InfectedAction                 InfectedAction
+	QuarantinePrefix               Path
+	// SessionRole is the role assumed for every login session with the
+	// policy that limits the access to the objects of the bucket config, if
+	// enabled.  It is assumed with the credentials in SessionRoleAWSConfig.
+	SessionRole          *AssumeRoleConfig
+	SessionRoleAWSConfig *aws.Config
+	// ClientSideEncryptionKey is the master key the objects are encrypted
+	// with before they are stored, if any.
+	ClientSideEncryptionKey []byte
+	// Quota tracks the usage against the quotas, and is nil if no quotas
+	// are configured.
+	Quota *QuotaTracker
+	// Bandwidth is shared by all the sessions of the bucket config, and
+	// UserBandwidth by those of each user.
+	Bandwidth     BandwidthLimit
+	UserBandwidth BandwidthLimit
+	// Banner overrides the banner of the listener for the users, and
+	// LoginMessage the login message, if not nil.
+	Banner       *BannerTemplate
+	LoginMessage *BannerTemplate
+}
+
+// wrapBackend wraps the backend with the client-side encryption if
+// enabled.
+func (s3b *S3Bucket) wrapBackend(backend StorageBackend) StorageBackend {
+	if s3b.ClientSideEncryptionKey != nil {
+		return &EncryptedBackend{
+			Backend:   backend,
+			MasterKey: s3b.ClientSideEncryptionKey,
+		}
+	}
+	return backend
+}
+
+// SessionBackend returns the backend through which the session of the user
+// accesses the bucket.  The S3 requests of the session are made with the
+// credentials limited by the session policy if enabled.
+func (s3b *S3Bucket) SessionBackend(user string) (StorageBackend, error) {
+	backend := s3b.Backend
+	if sb, ok := backend.(*S3Backend); ok && s3b.SessionRole != nil {
+		policy, err := s3SessionPolicy(
+			s3b.Bucket,
+			s3b.KeyPrefix,
+			s3b.QuarantinePrefix,
+			s3b.ServerSideEncryption.Type == ServerSideEncryptionTypeKMS,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rCfg := *s3b.SessionRole
+		rCfg.RoleSessionName = sessionRoleSessionName(rCfg.RoleSessionName, user)
+		rCfg.Policy = policy
+		creds, err := NewAssumeRoleCredentials(s3b.SessionRoleAWSConfig, &rCfg)
+		if err != nil {
+			return nil, err
+		}
+		// fail early rather than on every request
+		_, err = creds.Get()
+		if err != nil {
+			return nil, err
+		}
+		_sb := *sb
+		_sb.AWSConfig = sb.AWSConfig.Copy().WithCredentials(creds)
+		backend = &_sb
+	}
+	return s3b.wrapBackend(backend), nil
 }
 
 type S3Buckets struct {
@@ -82,23 +161,79 @@ func (s3bs *S3Buckets) Get(name string) *S3Bucket {
 	return b
 }
 
-func (s3b *S3Bucket) S3(sess *aws_session.Session) *s3.S3 {
-	awsCfg := s3b.AWSConfig
-	if awsCfg.Credentials == nil {
-		awsCfg = s3b.AWSConfig.WithCredentials(aws_creds.NewChainCredentials(
-			[]aws_creds.Provider{
-				&aws_ec2_role_creds.EC2RoleProvider{
-					Client:       aws_ec2_meta.New(sess),
-					ExpiryWindow: 0,
-				},
-				&aws_creds.EnvProvider{},
-			},
-		))
+// sameStorage tells whether the bucket config stores the objects at the same
+// place as the other.
+func (s3b *S3Bucket) sameStorage(other *S3Bucket) bool {
+	if s3b.Bucket != other.Bucket || s3b.KeyPrefix.String() != other.KeyPrefix.String() {
+		return false
+	}
+	switch backend := s3b.Backend.(type) {
+	case *S3Backend:
+		_, ok := other.Backend.(*S3Backend)
+		return ok
+	case *LocalBackend:
+		_backend, ok := other.Backend.(*LocalBackend)
+		return ok && backend.Root == _backend.Root
+	}
+	return false
+}
+
+// CarryQuotaTrackers takes over the quota trackers of the bucket configs of
+// the same names in old that store the objects at the same place, with the
+// limits changed to the new ones.  The usage and the space reserved by the
+// sessions of the old config are thus kept, and the quotas stay enforced
+// without waiting for another scan.
+func (s3bs *S3Buckets) CarryQuotaTrackers(old *S3Buckets) {
+	for name, bucket := range s3bs.Buckets {
+		_bucket := old.Get(name)
+		if bucket.Quota == nil || _bucket == nil || _bucket.Quota == nil || !bucket.sameStorage(_bucket) {
+			continue
+		}
+		_bucket.Quota.SetLimits(bucket.Quota.Bucket, bucket.Quota.User, bucket.Quota.ScanInterval)
+		bucket.Quota = _bucket.Quota
 	}
-	return s3.New(sess, awsCfg)
 }
 
-func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bucket, error) {
+// RunQuotaScanners starts scanning the usage of the buckets with quotas in
+// the background until ctx is done.
+func (s3bs *S3Buckets) RunQuotaScanners(ctx context.Context, log interface {
+	InfoLogger
+	ErrorLogger
+}) {
+	for _, bucket := range s3bs.Buckets {
+		if bucket.Quota != nil {
+			go bucket.Quota.RunScanner(ctx, bucket.wrapBackend(bucket.Backend), bucket.KeyPrefix, log)
+		}
+	}
+}
+
+// newHTTPClientWithCABundle returns the client that trusts the certificates
+// in the PEM file in addition to the system ones.
+func newHTTPClientWithCABundle(caBundle string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caBundle)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+func quotaLimit(v *int64) int64 {
+	if v == nil {
+		return -1
+	}
+	return *v
+}
+
+func buildS3Bucket(uStores UserStores, scanners map[string]Scanner, name string, bCfg *S3BucketConfig) (*S3Bucket, error) {
 	awsCfg := aws.NewConfig()
 	if bCfg.Credentials != nil {
 		awsCfg = awsCfg.WithCredentials(
@@ -120,6 +255,43 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 	}
 	if bCfg.Region != "" {
 		awsCfg = awsCfg.WithRegion(bCfg.Region)
+	} else if bCfg.Endpoint != "" {
+		// S3-compatible stores hardly care about the region, but the SDK
+		// refuses to sign the requests without one
+		awsCfg = awsCfg.WithRegion("us-east-1")
+	}
+	if bCfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(bCfg.Endpoint)
+	}
+	if bCfg.ForcePathStyle {
+		awsCfg = awsCfg.WithS3ForcePathStyle(true)
+	}
+	if bCfg.DisableSSL {
+		awsCfg = awsCfg.WithDisableSSL(true)
+	}
+	if bCfg.CABundle != "" {
+		client, err := newHTTPClientWithCABundle(bCfg.CABundle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ca_bundle")
+		}
+		awsCfg = awsCfg.WithHTTPClient(client)
+	}
+	var roleCfg *AssumeRoleConfig
+	var roleAWSCfg *aws.Config
+	if bCfg.RoleARN != "" {
+		roleCfg = &AssumeRoleConfig{
+			RoleARN:              bCfg.RoleARN,
+			ExternalID:           bCfg.ExternalID,
+			RoleSessionName:      bCfg.RoleSessionName,
+			WebIdentityTokenFile: bCfg.WebIdentityTokenFile,
+			STSEndpoint:          bCfg.STSEndpoint,
+		}
+		roleAWSCfg = awsCfg.Copy()
+		creds, err := NewAssumeRoleCredentials(roleAWSCfg, roleCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "role_arn")
+		}
+		awsCfg = awsCfg.WithCredentials(creds)
 	}
 	users, ok := uStores[bCfg.Auth]
 	if !ok {
@@ -129,6 +301,17 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 	if len(keyPrefix) > 0 && keyPrefix[0] == "" {
 		keyPrefix = keyPrefix[1:]
 	}
+	var scanner Scanner
+	if bCfg.Scanner != "" {
+		scanner, ok = scanners[bCfg.Scanner]
+		if !ok {
+			return nil, fmt.Errorf("no such scanner config: %s", bCfg.Scanner)
+		}
+	}
+	quarantinePrefix := SplitIntoPath(bCfg.QuarantinePrefix)
+	if len(quarantinePrefix) > 0 && quarantinePrefix[0] == "" {
+		quarantinePrefix = quarantinePrefix[1:]
+	}
 	maxObjectSize := int64(-1)
 	if bCfg.MaxObjectSize != nil {
 		maxObjectSize = *bCfg.MaxObjectSize
@@ -148,7 +331,7 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 	} else {
 		customerKey = []byte{}
 	}
-	return &S3Bucket{
+	bucket := &S3Bucket{
 		Name:          name,
 		AWSConfig:     awsCfg,
 		Bucket:        bCfg.Bucket,
@@ -167,14 +350,82 @@ func buildS3Bucket(uStores UserStores, name string, bCfg *S3BucketConfig) (*S3Bu
 			KMSKeyId:       bCfg.SSEKMSKeyId,
 		},
 		KeyboardInteractiveAuthEnabled: bCfg.KeyboardInteractiveAuthEnabled,
-	}, nil
+		Scanner:                        scanner,
+		InfectedAction:                 bCfg.InfectedAction,
+		QuarantinePrefix:               quarantinePrefix,
+		Bandwidth: BandwidthLimit{
+			Download: bCfg.DownloadRateLimit,
+			Upload:   bCfg.UploadRateLimit,
+		},
+		UserBandwidth: BandwidthLimit{
+			Download: bCfg.UserDownloadRateLimit,
+			Upload:   bCfg.UserUploadRateLimit,
+		},
+	}
+	if bCfg.ClientSideEncryptionKeyFile != "" {
+		key, err := ReadClientSideEncryptionKey(bCfg.ClientSideEncryptionKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "client_side_encryption_key_file")
+		}
+		bucket.ClientSideEncryptionKey = key
+	}
+	if bCfg.Banner != "" {
+		banner, err := ParseBannerTemplate(bCfg.Banner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "banner")
+		}
+		bucket.Banner = banner
+	}
+	if bCfg.LoginMessage != "" {
+		loginMessage, err := ParseBannerTemplate(bCfg.LoginMessage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "login_message")
+		}
+		bucket.LoginMessage = loginMessage
+	}
+	if bCfg.QuotaBytes != nil || bCfg.QuotaObjects != nil || bCfg.UserQuotaBytes != nil || bCfg.UserQuotaObjects != nil {
+		bucket.Quota = NewQuotaTracker(
+			QuotaLimits{Bytes: quotaLimit(bCfg.QuotaBytes), Objects: quotaLimit(bCfg.QuotaObjects)},
+			QuotaLimits{Bytes: quotaLimit(bCfg.UserQuotaBytes), Objects: quotaLimit(bCfg.UserQuotaObjects)},
+			bCfg.QuotaScanInterval.Duration,
+		)
+	}
+	if bCfg.SessionPolicy {
+		bucket.SessionRole = roleCfg
+		bucket.SessionRoleAWSConfig = roleAWSCfg
+	}
+	switch bCfg.Backend {
+	case "s3":
+		bucket.Backend = &S3Backend{
+			Bucket:               bucket.Bucket,
+			AWSConfig:            bucket.AWSConfig,
+			ServerSideEncryption: &bucket.ServerSideEncryption,
+			SignatureVersion:     bCfg.SignatureVersion,
+		}
+	case "local":
+		fi, err := os.Stat(bCfg.LocalRoot)
+		if err != nil {
+			return nil, errors.Wrapf(err, "local_root")
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("local_root %s is not a directory", bCfg.LocalRoot)
+		}
+		bucket.Backend = &LocalBackend{
+			Root: bCfg.LocalRoot,
+		}
+	}
+	return bucket, nil
 }
 
 func NewS3BucketFromConfig(uStores UserStores, cfg *S3SFTPProxyConfig) (*S3Buckets, error) {
+	scanners, err := NewScannersFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 	buckets := map[string]*S3Bucket{}
 	userToBucketMap := map[string]*S3Bucket{}
 	for name, bCfg := range cfg.Buckets {
-		bucket, err := buildS3Bucket(uStores, name, bCfg)
+		bucket, err := buildS3Bucket(uStores, scanners, name, bCfg)
 		if err != nil {
 			return nil, errors.Wrapf(err, "bucket config %s", name)
 		}
@@ -6,19 +6,12 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"sync"
 	"time"
 
-	aws "github.com/aws/aws-sdk-go/aws"
-	aws_session "github.com/aws/aws-sdk-go/aws/session"
-	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/sftp"
-	// s3crypto "github.com/aws/aws-sdk-go/service/s3/s3crypto"
 )
 
-var aclPrivate = "private"
-
 type ReadDeadlineSettable interface {
 	SetReadDeadline(t time.Time) error
 }
@@ -27,21 +20,26 @@ type WriteDeadlineSettable interface {
 	SetWriteDeadline(t time.Time) error
 }
 
-var sseTypes = map[ServerSideEncryptionType]*string{
-	ServerSideEncryptionTypeKMS: aws.String("aws:kms"),
+type Abortable interface {
+	Abort()
 }
 
-func nilIfEmpty(s string) *string {
-	if s == "" {
-		return nil
-	} else {
-		return &s
+// abortWriter discards what has been written to w and releases it.
+func abortWriter(w io.WriterAt) {
+	if a, ok := w.(Abortable); ok {
+		a.Abort()
 	}
+	closeIfCloser(w)
 }
 
-type S3GetObjectOutputReader struct {
+// S3ObjectReader reads the object sequentially, keeping the recent part in
+// the spool so that the reads slightly out of order are served from it.
+// Reading before the spool opens the object again at the position.
+type S3ObjectReader struct {
 	Ctx          context.Context
-	Goo          *aws_s3.GetObjectOutput
+	Backend      StorageBackend
+	Key          Path
+	Obj          *StorageObject
 	Log          DebugLogger
 	Lookback     int
 	MinChunkSize int
@@ -51,15 +49,31 @@ type S3GetObjectOutputReader struct {
 	noMore       bool
 }
 
-func (oor *S3GetObjectOutputReader) Close() error {
-	if oor.Goo.Body != nil {
-		oor.Goo.Body.Close()
-		oor.Goo.Body = nil
+func (oor *S3ObjectReader) Close() error {
+	if oor.Obj != nil {
+		oor.Obj.Body.Close()
+		oor.Obj = nil
 	}
 	return nil
 }
 
-func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
+// reopen reads the object again from off.
+func (oor *S3ObjectReader) reopen(off int) error {
+	oor.Close()
+	F(oor.Log.Debug, "GetObject(Key=%s, Offset=%d)", oor.Key, off)
+	obj, err := oor.Backend.GetObject(oor.Ctx, oor.Key, int64(off))
+	if err != nil {
+		oor.Log.Debug("=> ", err)
+		return err
+	}
+	oor.Obj = obj
+	oor.spooled = oor.spooled[:0]
+	oor.spoolOffset = off
+	oor.noMore = false
+	return nil
+}
+
+func (oor *S3ObjectReader) ReadAt(buf []byte, off int64) (int, error) {
 	oor.mtx.Lock()
 	defer oor.mtx.Unlock()
 
@@ -68,8 +82,11 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	if _o < oor.spoolOffset {
-		return 0, fmt.Errorf("supplied position is out of range")
+	if _o < oor.spoolOffset || oor.Obj == nil {
+		err := oor.reopen(_o)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	s := _o - oor.spoolOffset
@@ -123,14 +140,19 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 		err error
 	}
 
+	body := oor.Obj.Body
 	resultChan := make(chan readResult)
 	go func() {
-		n, err := io.ReadFull(oor.Goo.Body, oor.spooled[len(oor.spooled):e])
+		n, err := io.ReadFull(body, oor.spooled[len(oor.spooled):e])
 		resultChan <- readResult{n, err}
 	}()
 	select {
 	case <-oor.Ctx.Done():
-		oor.Goo.Body.(ReadDeadlineSettable).SetReadDeadline(time.Unix(1, 0))
+		if rds, ok := body.(ReadDeadlineSettable); ok {
+			rds.SetReadDeadline(time.Unix(1, 0))
+		} else {
+			oor.Close()
+		}
 		oor.Log.Debug("canceled")
 		return 0, fmt.Errorf("read operation canceled")
 	case res := <-resultChan:
@@ -145,7 +167,9 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 				be = s + r
 			}
 			copy(buf[i:], oor.spooled[s:be])
-			return be - s, nil
+			return i + be - s, nil
+		} else if i > 0 {
+			return i, nil
 		} else {
 			return 0, io.EOF
 		}
@@ -153,61 +177,171 @@ func (oor *S3GetObjectOutputReader) ReadAt(buf []byte, off int64) (int, error) {
 }
 
 type S3PutObjectWriter struct {
-	Ctx                  context.Context
-	Bucket               string
-	Key                  Path
-	S3                   *aws_s3.S3
-	ServerSideEncryption *ServerSideEncryptionConfig
-	Log                  interface {
+	Ctx     context.Context
+	Key     Path
+	Backend StorageBackend
+	Log     interface {
 		DebugLogger
 		ErrorLogger
 	}
 	MaxObjectSize    int64
 	Info             *PhantomObjectInfo
 	PhantomObjectMap *PhantomObjectMap
-	mtx              sync.Mutex
-	writer           *BytesWriter
+	Uploads          *UploadTracker
+	Scanner          Scanner
+	InfectedAction   InfectedAction
+	QuarantinePrefix Path
+	// Quota is charged for the upload on behalf of User, if any.  Replaced
+	// is the usage of the object the upload replaces, and ReplacedOwner is
+	// its owner.
+	Quota         *QuotaTracker
+	User          string
+	Replaced      QuotaUsage
+	ReplacedOwner string
+	mtx           sync.Mutex
+	writer        *BytesWriter
+	aborted       bool
+	// quotaErr is the error the upload was rejected with for exceeding the
+	// quotas, after which the content is discarded.
+	quotaErr       error
+	bucketReserved QuotaUsage
+	userReserved   QuotaUsage
+}
+
+// quotaCharge returns the changes in the usage of the bucket and that of
+// the user made by putting the object of the size.
+func (oow *S3PutObjectWriter) quotaCharge(size int64) (QuotaUsage, QuotaUsage) {
+	usage := QuotaUsage{Bytes: size, Objects: 1}
+	userUsage := usage
+	if oow.ReplacedOwner == oow.User {
+		userUsage = userUsage.sub(oow.Replaced)
+	}
+	return usage.sub(oow.Replaced), userUsage
+}
+
+// reserveQuota holds the space for the object of the size.
+func (oow *S3PutObjectWriter) reserveQuota(size int64) error {
+	if oow.Quota == nil {
+		return nil
+	}
+	bucketCharge, userCharge := oow.quotaCharge(size)
+	err := oow.Quota.Reserve(oow.User, bucketCharge.sub(oow.bucketReserved), userCharge.sub(oow.userReserved))
+	if err != nil {
+		return err
+	}
+	oow.bucketReserved = bucketCharge
+	oow.userReserved = userCharge
+	return nil
+}
+
+// settleQuota gives back the space held, and records the object put if
+// committed.
+func (oow *S3PutObjectWriter) settleQuota(committed bool) {
+	if oow.Quota == nil {
+		return
+	}
+	oow.Quota.Release(oow.User, oow.bucketReserved, oow.userReserved)
+	oow.bucketReserved = QuotaUsage{}
+	oow.userReserved = QuotaUsage{}
+	if committed {
+		oow.Quota.Add(oow.ReplacedOwner, QuotaUsage{}.sub(oow.Replaced))
+		oow.Quota.Add(oow.User, QuotaUsage{Bytes: oow.writer.Size(), Objects: 1})
+	}
 }
 
 func (oow *S3PutObjectWriter) Close() error {
 	F(oow.Log.Debug, "S3PutObjectWriter.Close")
 	oow.mtx.Lock()
 	defer oow.mtx.Unlock()
+	if oow.aborted {
+		return nil
+	}
+	defer oow.Uploads.Finish(oow.Info)
+	committed := false
+	defer func() { oow.settleQuota(committed) }()
 	phInfo := oow.Info.GetOne()
 	oow.PhantomObjectMap.RemoveByInfoPtr(oow.Info)
-	key := phInfo.Key.String()
-	sse := oow.ServerSideEncryption
-	F(oow.Log.Debug, "PutObject(Bucket=%s, Key=%s, Sse=%v)", oow.Bucket, key, sse)
-	_, err := oow.S3.PutObject(
-		&aws_s3.PutObjectInput{
-			ACL:                  &aclPrivate,
-			Body:                 bytes.NewReader(oow.writer.Bytes()),
-			Bucket:               &oow.Bucket,
-			Key:                  &key,
-			ServerSideEncryption: sseTypes[sse.Type],
-			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
-			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
-			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
-			SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyId),
-		},
-	)
+	key := phInfo.Key
+	if oow.quotaErr != nil {
+		F(oow.Log.Error, "discarding object %s: %s", key, oow.quotaErr.Error())
+		return oow.quotaErr
+	}
+	if oow.Uploads.Abandoned() {
+		F(oow.Log.Error, "discarding object %s as the server is shutting down", key)
+		return fmt.Errorf("upload aborted: server is shutting down")
+	}
+	var metadata map[string]string
+	var rejection error
+	if oow.Scanner != nil {
+		F(oow.Log.Debug, "Scan(Key=%s)", key)
+		result, err := oow.Scanner.Scan(oow.Ctx, bytes.NewReader(oow.writer.Bytes()))
+		if err != nil {
+			F(oow.Log.Error, "failed to scan object %s: %s", key, err.Error())
+			return fmt.Errorf("upload rejected: failed to scan the content")
+		}
+		F(oow.Log.Debug, "=> %v", result)
+		if result.Infected {
+			F(oow.Log.Error, "malware detected in object %s: %s", key, result.Signature)
+			rejection = fmt.Errorf("upload rejected: malware detected (%s)", result.Signature)
+			if oow.InfectedAction != InfectedActionQuarantine {
+				return rejection
+			}
+			key = append(Path{}, oow.QuarantinePrefix...).Join(phInfo.Key)
+		}
+		metadata = result.Metadata()
+	}
+	if oow.Quota != nil {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[ownerMetadataKey] = oow.User
+	}
+	F(oow.Log.Debug, "PutObject(Key=%s)", key)
+	// the upload goes on even if the client has gone
+	err := oow.Backend.PutObject(context.Background(), key, bytes.NewReader(oow.writer.Bytes()), metadata)
 	if err != nil {
 		oow.Log.Debug("=> ", err)
 		F(oow.Log.Error, "failed to put object: %s", err.Error())
-	} else {
-		oow.Log.Debug("=> OK")
+		return err
 	}
-	return nil
+	oow.Log.Debug("=> OK")
+	committed = rejection == nil
+	return rejection
+}
+
+// Abort discards the content written so far without putting it to S3.
+// Close does nothing afterwards.
+func (oow *S3PutObjectWriter) Abort() {
+	F(oow.Log.Debug, "S3PutObjectWriter.Abort")
+	oow.mtx.Lock()
+	defer oow.mtx.Unlock()
+	if oow.aborted {
+		return
+	}
+	oow.aborted = true
+	oow.PhantomObjectMap.RemoveByInfoPtr(oow.Info)
+	oow.Uploads.Finish(oow.Info)
+	oow.settleQuota(false)
 }
 
 func (oow *S3PutObjectWriter) WriteAt(buf []byte, off int64) (int, error) {
 	oow.mtx.Lock()
 	defer oow.mtx.Unlock()
+	if oow.quotaErr != nil {
+		return 0, oow.quotaErr
+	}
 	if oow.MaxObjectSize >= 0 {
 		if int64(len(buf))+off > oow.MaxObjectSize {
 			return 0, fmt.Errorf("file too large: maximum allowed size is %d bytes", oow.MaxObjectSize)
 		}
 	}
+	if size := int64(len(buf)) + off; size > oow.writer.Size() {
+		err := oow.reserveQuota(size)
+		if err != nil {
+			oow.quotaErr = err
+			return 0, err
+		}
+	}
 	F(oow.Log.Debug, "len(buf)=%d, off=%d", len(buf), off)
 	n, err := oow.writer.WriteAt(buf, off)
 	oow.Info.SetSize(oow.writer.Size())
@@ -248,55 +382,25 @@ func (ofi *ObjectFileInfo) Sys() interface{} {
 type S3ObjectLister struct {
 	DebugLogger
 	Ctx              context.Context
-	Bucket           string
 	Prefix           Path
-	S3               *aws_s3.S3
+	Backend          StorageBackend
 	Lookback         int
 	PhantomObjectMap *PhantomObjectMap
 	spoolOffset      int
 	spooled          []os.FileInfo
-	continuation     *string
+	listed           bool
+	continuation     string
 	noMore           bool
 }
 
-func aclToMode(owner *aws_s3.Owner, grants []*aws_s3.Grant) os.FileMode {
-	var v os.FileMode
-	for _, g := range grants {
-		if g.Grantee != nil {
-			if g.Grantee.ID != nil && *g.Grantee.ID == *owner.ID {
-				switch *g.Permission {
-				case "READ":
-					v |= 0400
-				case "WRITE":
-					v |= 0200
-				case "FULL_CONTROL":
-					v |= 0600
-				}
-			} else if g.Grantee.URI != nil {
-				switch *g.Grantee.URI {
-				case "http://acs.amazonaws.com/groups/global/AuthenticatedUsers":
-					switch *g.Permission {
-					case "READ":
-						v |= 0440
-					case "WRITE":
-						v |= 0220
-					case "FULL_CONTROL":
-						v |= 0660
-					}
-				case "http://acs.amazonaws.com/groups/global/AllUsers":
-					switch *g.Permission {
-					case "READ":
-						v |= 0444
-					case "WRITE":
-						v |= 0222
-					case "FULL_CONTROL":
-						v |= 0666
-					}
-				}
-			}
-		}
+func (sol *S3ObjectLister) symlinkTarget(key Path) (string, bool) {
+	F(sol.Debug, "HeadObject(Key=%s)", key)
+	info, err := sol.Backend.HeadObject(sol.Ctx, key)
+	if err != nil {
+		sol.Debug("=> ", err)
+		return "", false
 	}
-	return v
+	return symlinkTarget(info.Metadata)
 }
 
 func (sol *S3ObjectLister) ListAt(result []os.FileInfo, o int64) (int, error) {
@@ -339,7 +443,7 @@ func (sol *S3ObjectLister) ListAt(result []os.FileInfo, o int64) (int, error) {
 		s = sol.Lookback
 	}
 
-	if sol.continuation == nil {
+	if !sol.listed {
 		sol.spooled = append(sol.spooled, &ObjectFileInfo{
 			_Name:         ".",
 			_LastModified: time.Unix(1, 0),
@@ -365,50 +469,43 @@ func (sol *S3ObjectLister) ListAt(result []os.FileInfo, o int64) (int, error) {
 		}
 	}
 
-	prefix := sol.Prefix.String()
-	if prefix != "" {
-		prefix += "/"
-	}
-	F(sol.Debug, "ListObjectsV2WithContext(Bucket=%s, Prefix=%s, Continuation=%v)", sol.Bucket, prefix, sol.continuation)
-	out, err := sol.S3.ListObjectsV2WithContext(
-		sol.Ctx,
-		&aws_s3.ListObjectsV2Input{
-			Bucket:            &sol.Bucket,
-			Prefix:            &prefix,
-			MaxKeys:           aws.Int64(10000),
-			Delimiter:         aws.String("/"),
-			ContinuationToken: sol.continuation,
-		},
-	)
+	F(sol.Debug, "ListObjects(Prefix=%s, Continuation=%s)", sol.Prefix, sol.continuation)
+	out, err := sol.Backend.ListObjects(sol.Ctx, sol.Prefix, sol.continuation)
 	if err != nil {
 		sol.Debug("=> ", err)
 		return i, err
 	}
-	F(sol.Debug, "=> { CommonPrefixes=len(%d), Contents=len(%d) }", len(out.CommonPrefixes), len(out.Contents))
+	F(sol.Debug, "=> { Prefixes=len(%d), Objects=len(%d) }", len(out.Prefixes), len(out.Objects))
 
-	if sol.continuation == nil {
-		for _, cPfx := range out.CommonPrefixes {
+	if !sol.listed {
+		for _, pfx := range out.Prefixes {
 			sol.spooled = append(sol.spooled, &ObjectFileInfo{
-				_Name:         path.Base(*cPfx.Prefix),
+				_Name:         pfx.Base(),
 				_LastModified: time.Unix(1, 0),
 				_Size:         0,
 				_Mode:         0755 | os.ModeDir,
 			})
 		}
 	}
-	for _, obj := range out.Contents {
-		// if *obj.Key == sol.Prefix {
-		// 	continue
-		// }
-		sol.spooled = append(sol.spooled, &ObjectFileInfo{
-			_Name:         path.Base(*obj.Key),
-			_LastModified: *obj.LastModified,
-			_Size:         *obj.Size,
+	for _, obj := range out.Objects {
+		objInfo := &ObjectFileInfo{
+			_Name:         obj.Key.Base(),
+			_LastModified: obj.LastModified,
+			_Size:         obj.Size,
 			_Mode:         0644,
-		})
+		}
+		if obj.Size == 0 {
+			// only the empty objects can be symbolic links
+			if target, ok := sol.symlinkTarget(obj.Key); ok {
+				objInfo._Size = int64(len(target))
+				objInfo._Mode = os.ModeSymlink | 0777
+			}
+		}
+		sol.spooled = append(sol.spooled, objInfo)
 	}
-	sol.continuation = out.NextContinuationToken
-	if out.NextContinuationToken == nil {
+	sol.listed = true
+	sol.continuation = out.Continuation
+	if out.Continuation == "" {
 		sol.noMore = true
 	}
 
@@ -429,10 +526,73 @@ func (sol *S3ObjectLister) ListAt(result []os.FileInfo, o int64) (int, error) {
 type S3ObjectStat struct {
 	DebugLogger
 	Ctx              context.Context
-	Bucket           string
 	Key              Path
-	S3               *aws_s3.S3
+	KeyPrefix        Path
+	Backend          StorageBackend
 	PhantomObjectMap *PhantomObjectMap
+	FollowSymlinks   bool
+}
+
+// stat returns the file info for the key, and the target if the object is a
+// symbolic link.
+func (sos *S3ObjectStat) stat(key Path) (os.FileInfo, string, error) {
+	if key.IsRoot() {
+		return &ObjectFileInfo{
+			_Name:         "/",
+			_LastModified: time.Time{},
+			_Size:         0,
+			_Mode:         0755 | os.ModeDir,
+		}, "", nil
+	}
+	phInfo := sos.PhantomObjectMap.Get(key)
+	if phInfo != nil {
+		_phInfo := phInfo.GetOne()
+		return &ObjectFileInfo{
+			_Name:         _phInfo.Key.Base(),
+			_LastModified: _phInfo.LastModified,
+			_Size:         _phInfo.Size,
+			_Mode:         0600, // TODO
+		}, "", nil
+	}
+	F(sos.Debug, "ObjectMode(Key=%s)", key)
+	mode, err := sos.Backend.ObjectMode(sos.Ctx, key)
+	if err == nil {
+		F(sos.Debug, "=> %v", mode)
+		F(sos.Debug, "HeadObject(Key=%s)", key)
+		info, err := sos.Backend.HeadObject(sos.Ctx, key)
+		objInfo := &ObjectFileInfo{
+			_Name: key.Base(),
+			_Mode: mode,
+		}
+		if err != nil {
+			sos.Debug("=> ", err)
+			return objInfo, "", nil
+		}
+		F(sos.Debug, "=> { Size=%d, LastModified=%v }", info.Size, info.LastModified)
+		objInfo._Size = info.Size
+		objInfo._LastModified = info.LastModified
+		target, ok := symlinkTarget(info.Metadata)
+		if ok {
+			objInfo._Size = int64(len(target))
+			objInfo._Mode = os.ModeSymlink | 0777
+		}
+		return objInfo, target, nil
+	}
+	sos.Debug("=> ", err)
+	// a directory exists as long as something is under it
+	F(sos.Debug, "ListObjects(Prefix=%s)", key)
+	out, err := sos.Backend.ListObjects(sos.Ctx, key, "")
+	if err != nil || (len(out.Prefixes) == 0 && len(out.Objects) == 0) {
+		sos.Debug("=> ", err)
+		return nil, "", os.ErrNotExist
+	}
+	F(sos.Debug, "=> { Prefixes=len(%d), Objects=len(%d) }", len(out.Prefixes), len(out.Objects))
+	return &ObjectFileInfo{
+		_Name:         key.Base(),
+		_LastModified: time.Time{},
+		_Size:         0,
+		_Mode:         0755 | os.ModeDir,
+	}, "", nil
 }
 
 func (sos *S3ObjectStat) ListAt(result []os.FileInfo, o int64) (int, error) {
@@ -450,93 +610,43 @@ func (sos *S3ObjectStat) ListAt(result []os.FileInfo, o int64) (int, error) {
 		return 0, fmt.Errorf("supplied position is out of range")
 	}
 
-	if sos.Key.IsRoot() {
-		result[0] = &ObjectFileInfo{
-			_Name:         "/",
-			_LastModified: time.Time{},
-			_Size:         0,
-			_Mode:         0755 | os.ModeDir,
+	key := sos.Key
+	for hops := 0; ; hops++ {
+		fi, target, err := sos.stat(key)
+		if err != nil {
+			return 0, err
 		}
-	} else {
-		phInfo := sos.PhantomObjectMap.Get(sos.Key)
-		if phInfo != nil {
-			_phInfo := phInfo.GetOne()
-			result[0] = &ObjectFileInfo{
-				_Name:         _phInfo.Key.Base(),
-				_LastModified: _phInfo.LastModified,
-				_Size:         _phInfo.Size,
-				_Mode:         0600, // TODO
-			}
-		} else {
-			key := sos.Key.String()
-			F(sos.Debug, "GetObjectAclWithContext(Bucket=%s, Key=%s)", sos.Bucket, key)
-			out, err := sos.S3.GetObjectAclWithContext(
-				sos.Ctx,
-				&aws_s3.GetObjectAclInput{
-					Bucket: &sos.Bucket,
-					Key:    &key,
-				},
-			)
-			if err == nil {
-				F(sos.Debug, "=> %v", out)
-				F(sos.Debug, "HeadObjectWithContext(Bucket=%s, Key=%s)", sos.Bucket, key)
-				headOut, err := sos.S3.HeadObjectWithContext(
-					sos.Ctx,
-					&aws_s3.HeadObjectInput{
-						Bucket: &sos.Bucket,
-						Key:    &key,
-					},
-				)
-				objInfo := ObjectFileInfo{
-					_Name: sos.Key.Base(),
-					_Mode: aclToMode(out.Owner, out.Grants),
-				}
-				if err == nil {
-					F(sos.Debug, "=> { ContentLength=%d, LastModified=%v }", *headOut.ContentLength, *headOut.LastModified)
-					objInfo._Size = *headOut.ContentLength
-					objInfo._LastModified = *headOut.LastModified
-				} else {
-					sos.Debug("=> ", err)
-				}
-				result[0] = &objInfo
-			} else {
-				sos.Debug("=> ", err)
-				F(sos.Debug, "ListObjectsV2WithContext(Bucket=%s, Prefix=%s)", sos.Bucket, key)
-				out, err := sos.S3.ListObjectsV2WithContext(
-					sos.Ctx,
-					&aws_s3.ListObjectsV2Input{
-						Bucket:    &sos.Bucket,
-						Prefix:    &key,
-						MaxKeys:   aws.Int64(10000),
-						Delimiter: aws.String("/"),
-					},
-				)
-				if err != nil || len(out.CommonPrefixes) == 0 {
-					sos.Debug("=> ", err)
-					return 0, os.ErrNotExist
-				}
-				F(sos.Debug, "=> { CommonPrefixes=len(%d), Contents=len(%d) }", len(out.CommonPrefixes), len(out.Contents))
-				result[0] = &ObjectFileInfo{
+		if target == "" || !sos.FollowSymlinks {
+			if hops > 0 {
+				// the name is the one of the link
+				fi = &ObjectFileInfo{
 					_Name:         sos.Key.Base(),
-					_LastModified: time.Time{},
-					_Size:         0,
-					_Mode:         0755 | os.ModeDir,
+					_LastModified: fi.ModTime(),
+					_Size:         fi.Size(),
+					_Mode:         fi.Mode(),
 				}
 			}
+			result[0] = fi
+			return 1, nil
 		}
+		if hops >= maxSymlinkHops {
+			return 0, errTooManySymlinks
+		}
+		key = resolveSymlinkKey(sos.KeyPrefix, key, target)
 	}
-	return 1, nil
 }
 
 type S3BucketIO struct {
 	Ctx                      context.Context
 	Bucket                   *S3Bucket
+	Backend                  StorageBackend
 	ReaderLookbackBufferSize int
 	ReaderMinChunkSize       int
 	ListerLookbackBufferSize int
 	PhantomObjectMap         *PhantomObjectMap
+	Uploads                  *UploadTracker
+	Session                  *Session
 	Perms                    Perms
-	ServerSideEncryption     *ServerSideEncryptionConfig
 	Now                      func() time.Time
 	Log                      interface {
 		ErrorLogger
@@ -544,6 +654,14 @@ type S3BucketIO struct {
 	}
 }
 
+// user returns the name of the user the session belongs to.
+func (s3io *S3BucketIO) user() string {
+	if s3io.Session == nil {
+		return ""
+	}
+	return s3io.Session.User
+}
+
 func buildKey(s3b *S3Bucket, path string) Path {
 	return s3b.KeyPrefix.Join(SplitIntoPath(path))
 }
@@ -560,57 +678,62 @@ func (s3io *S3BucketIO) Fileread(req *sftp.Request) (io.ReaderAt, error) {
 	if !s3io.Perms.Readable {
 		return nil, fmt.Errorf("read operation not allowed as per configuration")
 	}
-	sess, err := aws_session.NewSession()
-	if err != nil {
-		return nil, err
-	}
-	s3 := s3io.Bucket.S3(sess)
 	key := buildKey(s3io.Bucket, req.Filepath)
 
 	phInfo := s3io.PhantomObjectMap.Get(key)
 	if phInfo != nil {
-		return bytes.NewReader(phInfo.Opaque.(*S3PutObjectWriter).writer.Bytes()), nil
+		return s3io.Session.WrapReaderAt(bytes.NewReader(phInfo.Opaque.(*S3PutObjectWriter).writer.Bytes())), nil
 	}
 
-	keyStr := key.String()
 	ctx := combineContext(s3io.Ctx, req.Context())
-	F(s3io.Log.Debug, "GetObject(Bucket=%s, Key=%s)", s3io.Bucket.Bucket, keyStr)
-	sse := s3io.ServerSideEncryption
-	goo, err := s3.GetObjectWithContext(
-		ctx,
-		&aws_s3.GetObjectInput{
-			Bucket:               &s3io.Bucket.Bucket,
-			Key:                  &keyStr,
-			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
-			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
-			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
-		},
-	)
-	if err != nil {
-		return nil, err
+	var obj *StorageObject
+	for hops := 0; ; hops++ {
+		F(s3io.Log.Debug, "GetObject(Key=%s)", key)
+		var err error
+		obj, err = s3io.Backend.GetObject(ctx, key, 0)
+		if err != nil {
+			s3io.Log.Debug("=> ", err)
+			return nil, err
+		}
+		target, ok := symlinkTarget(obj.Metadata)
+		if !ok {
+			break
+		}
+		obj.Body.Close()
+		if hops >= maxSymlinkHops {
+			return nil, errTooManySymlinks
+		}
+		key = resolveSymlinkKey(s3io.Bucket.KeyPrefix, key, target)
+		phInfo := s3io.PhantomObjectMap.Get(key)
+		if phInfo != nil {
+			return s3io.Session.WrapReaderAt(bytes.NewReader(phInfo.Opaque.(*S3PutObjectWriter).writer.Bytes())), nil
+		}
 	}
-	return &S3GetObjectOutputReader{
+	return s3io.Session.WrapReaderAt(&S3ObjectReader{
 		Ctx:          ctx,
-		Goo:          goo,
+		Backend:      s3io.Backend,
+		Key:          key,
+		Obj:          obj,
 		Log:          s3io.Log,
 		Lookback:     s3io.ReaderLookbackBufferSize,
 		MinChunkSize: s3io.ReaderMinChunkSize,
-	}, nil
+	}), nil
 }
 
 func (s3io *S3BucketIO) Filewrite(req *sftp.Request) (io.WriterAt, error) {
 	if !s3io.Perms.Writable {
 		return nil, fmt.Errorf("write operation not allowed as per configuration")
 	}
-	sess, err := aws_session.NewSession()
-	if err != nil {
-		return nil, err
-	}
 	maxObjectSize := s3io.Bucket.MaxObjectSize
 	if maxObjectSize < 0 {
 		maxObjectSize = int64(^uint(0) >> 1)
 	}
 	key := buildKey(s3io.Bucket, req.Filepath)
+	ctx := combineContext(s3io.Ctx, req.Context())
+	replaced, replacedOwner, err := s3io.objectUsage(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	info := &PhantomObjectInfo{
 		Key:          key,
 		Size:         0,
@@ -618,120 +741,243 @@ func (s3io *S3BucketIO) Filewrite(req *sftp.Request) (io.WriterAt, error) {
 	}
 	F(s3io.Log.Debug, "S3PutObjectWriter.New(key=%s)", key)
 	oow := &S3PutObjectWriter{
-		Ctx:                  combineContext(s3io.Ctx, req.Context()),
-		Bucket:               s3io.Bucket.Bucket,
-		Key:                  key,
-		S3:                   s3io.Bucket.S3(sess),
-		ServerSideEncryption: s3io.ServerSideEncryption,
-		Log:                  s3io.Log,
-		MaxObjectSize:        maxObjectSize,
-		PhantomObjectMap:     s3io.PhantomObjectMap,
-		Info:                 info,
-		writer:               NewBytesWriter(),
+		Ctx:              ctx,
+		Key:              key,
+		Backend:          s3io.Backend,
+		Log:              s3io.Log,
+		MaxObjectSize:    maxObjectSize,
+		PhantomObjectMap: s3io.PhantomObjectMap,
+		Uploads:          s3io.Uploads,
+		Scanner:          s3io.Bucket.Scanner,
+		InfectedAction:   s3io.Bucket.InfectedAction,
+		QuarantinePrefix: s3io.Bucket.QuarantinePrefix,
+		Quota:            s3io.Bucket.Quota,
+		User:             s3io.user(),
+		Replaced:         replaced,
+		ReplacedOwner:    replacedOwner,
+		Info:             info,
+		writer:           NewBytesWriter(),
+	}
+	// an empty file takes up one object even if nothing is written
+	err = oow.reserveQuota(0)
+	if err != nil {
+		return nil, err
 	}
 	info.Opaque = oow
+	if !s3io.Uploads.Begin(info) {
+		oow.settleQuota(false)
+		return nil, fmt.Errorf("write operation not allowed as the server is shutting down")
+	}
 	s3io.PhantomObjectMap.Add(info)
-	return oow, nil
+	return s3io.Session.WrapWriterAt(oow), nil
+}
+
+// objectUsage returns the usage of the object and its owner, which are
+// zero if the object does not exist or no quotas are configured.
+func (s3io *S3BucketIO) objectUsage(ctx context.Context, key Path) (QuotaUsage, string, error) {
+	if s3io.Bucket.Quota == nil {
+		return QuotaUsage{}, "", nil
+	}
+	info, err := s3io.headObject(ctx, key)
+	if err == os.ErrNotExist {
+		return QuotaUsage{}, "", nil
+	} else if err != nil {
+		return QuotaUsage{}, "", err
+	}
+	owner, _ := lookupMetadata(info.Metadata, ownerMetadataKey)
+	return QuotaUsage{Bytes: info.Size, Objects: 1}, owner, nil
+}
+
+// copyObjectWithinQuota copies the object unless the copy exceeds the
+// quotas.  The copy is owned by and charged to the user who makes it,
+// whoever owns the source.
+func (s3io *S3BucketIO) copyObjectWithinQuota(ctx context.Context, src, dest Path) error {
+	quota := s3io.Bucket.Quota
+	if quota == nil {
+		return s3io.copyObject(ctx, src, dest, nil)
+	}
+	user := s3io.user()
+	srcUsage, _, err := s3io.objectUsage(ctx, src)
+	if err != nil {
+		return err
+	}
+	destUsage, destOwner, err := s3io.objectUsage(ctx, dest)
+	if err != nil {
+		return err
+	}
+	userCharge := srcUsage
+	if destOwner == user {
+		userCharge = userCharge.sub(destUsage)
+	}
+	bucketCharge := srcUsage.sub(destUsage)
+	err = quota.Reserve(user, bucketCharge, userCharge)
+	if err != nil {
+		return err
+	}
+	defer quota.Release(user, bucketCharge, userCharge)
+	err = s3io.copyObject(ctx, src, dest, map[string]string{ownerMetadataKey: user})
+	if err != nil {
+		return err
+	}
+	quota.Add(destOwner, QuotaUsage{}.sub(destUsage))
+	quota.Add(user, srcUsage)
+	return nil
+}
+
+// copyObject copies the object in the storage.
+func (s3io *S3BucketIO) copyObject(ctx context.Context, src, dest Path, metadata map[string]string) error {
+	F(s3io.Log.Debug, "CopyObject(Key=%s, Source=%s)", dest, src)
+	err := s3io.Backend.CopyObject(ctx, src, dest, metadata)
+	if err != nil {
+		s3io.Log.Debug("=> ", err)
+		return err
+	}
+	return nil
+}
+
+func (s3io *S3BucketIO) deleteObject(ctx context.Context, key Path) error {
+	F(s3io.Log.Debug, "DeleteObject(Key=%s)", key)
+	err := s3io.Backend.DeleteObject(ctx, key)
+	if err != nil {
+		s3io.Log.Debug("=> ", err)
+		return err
+	}
+	return nil
+}
+
+// rename moves the object by copying and then deleting it, which replaces the
+// object at the target if any.
+func (s3io *S3BucketIO) rename(req *sftp.Request) error {
+	if !s3io.Perms.Writable {
+		return fmt.Errorf("write operation not allowed as per configuration")
+	}
+	src := buildKey(s3io.Bucket, req.Filepath)
+	dest := buildKey(s3io.Bucket, req.Target)
+	if s3io.PhantomObjectMap.Rename(src, dest) {
+		return nil
+	}
+	ctx := combineContext(s3io.Ctx, req.Context())
+	// the object moves along with its owner, while the one at the target
+	// goes away
+	replaced, replacedOwner, err := s3io.objectUsage(ctx, dest)
+	if err != nil {
+		return err
+	}
+	err = s3io.copyObject(ctx, src, dest, nil)
+	if err != nil {
+		return err
+	}
+	s3io.Bucket.Quota.Add(replacedOwner, QuotaUsage{}.sub(replaced))
+	return s3io.deleteObject(ctx, src)
+}
+
+// PosixRename serves "posix-rename@openssh.com".  The object at the target
+// is replaced at once as a PUT is atomic on S3.
+func (s3io *S3BucketIO) PosixRename(req *sftp.Request) error {
+	return s3io.rename(req)
 }
 
 func (s3io *S3BucketIO) Filecmd(req *sftp.Request) error {
 	switch req.Method {
 	case "Rename":
+		return s3io.rename(req)
+	case "Symlink":
+		return s3io.symlink(req)
+	case "Remove":
 		if !s3io.Perms.Writable {
 			return fmt.Errorf("write operation not allowed as per configuration")
 		}
-		src := buildKey(s3io.Bucket, req.Filepath)
-		dest := buildKey(s3io.Bucket, req.Target)
-		if s3io.PhantomObjectMap.Rename(src, dest) {
+		key := buildKey(s3io.Bucket, req.Filepath)
+		if s3io.PhantomObjectMap.Remove(key) != nil {
 			return nil
 		}
-		sess, err := aws_session.NewSession()
+		ctx := combineContext(s3io.Ctx, req.Context())
+		usage, owner, err := s3io.objectUsage(ctx, key)
 		if err != nil {
 			return err
 		}
-		srcStr := src.String()
-		destStr := dest.String()
-		copySource := s3io.Bucket.Bucket + "/" + srcStr
-		sse := s3io.ServerSideEncryption
-		F(s3io.Log.Debug, "CopyObject(Bucket=%s, Key=%s, CopySource=%s, Sse=%v)", s3io.Bucket.Bucket, destStr, copySource, sse.Type)
-		_, err = s3io.Bucket.S3(sess).CopyObjectWithContext(
-			combineContext(s3io.Ctx, req.Context()),
-			&aws_s3.CopyObjectInput{
-				ACL:                  &aclPrivate,
-				Bucket:               &s3io.Bucket.Bucket,
-				CopySource:           &copySource,
-				Key:                  &destStr,
-				ServerSideEncryption: sseTypes[sse.Type],
-				SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
-				SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
-				SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
-				SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyId),
-			},
-		)
+		err = s3io.deleteObject(ctx, key)
 		if err != nil {
-			s3io.Log.Debug("=> ", err)
 			return err
 		}
-		F(s3io.Log.Debug, "DeleteObject(Bucket=%s, Key=%s)", s3io.Bucket.Bucket, srcStr)
-		_, err = s3io.Bucket.S3(sess).DeleteObjectWithContext(
-			combineContext(s3io.Ctx, req.Context()),
-			&aws_s3.DeleteObjectInput{
-				Bucket: &s3io.Bucket.Bucket,
-				Key:    &srcStr,
-			},
-		)
-		if err != nil {
-			s3io.Log.Debug("=> ", err)
-			return err
-		}
-	case "Remove":
+		s3io.Bucket.Quota.Add(owner, QuotaUsage{}.sub(usage))
+		return nil
+	case "Mkdir", "Rmdir":
+		// the directories exist only as the prefixes of the objects
 		if !s3io.Perms.Writable {
 			return fmt.Errorf("write operation not allowed as per configuration")
 		}
-		key := buildKey(s3io.Bucket, req.Filepath)
-		if s3io.PhantomObjectMap.Remove(key) != nil {
-			return nil
-		}
-		sess, err := aws_session.NewSession()
-		if err != nil {
-			return err
+	}
+	return nil
+}
+
+const (
+	statVFSBlockSize = 4096
+	// statVFSCapacity is reported as the size of the file system as S3 has
+	// virtually no limit, unless the quotas are configured.
+	statVFSCapacity = 1 << 50
+	statVFSReadOnly = 0x1
+	statVFSNoSUID   = 0x2
+	statVFSNameMax  = 1024
+)
+
+// StatVFS serves "statvfs@openssh.com".
+func (s3io *S3BucketIO) StatVFS(req *sftp.Request) (*sftp.StatVFS, error) {
+	if !s3io.Perms.Readable && !s3io.Perms.Listable {
+		return nil, fmt.Errorf("stat operation not allowed as per configuration")
+	}
+	flag := uint64(statVFSNoSUID)
+	if !s3io.Perms.Writable {
+		flag |= statVFSReadOnly
+	}
+	blocks := uint64(statVFSCapacity / statVFSBlockSize)
+	free := blocks
+	files := blocks
+	freeFiles := blocks
+	remaining, limits, ok := s3io.Bucket.Quota.Remaining(s3io.user())
+	if ok {
+		if limits.Bytes >= 0 {
+			blocks = uint64(limits.Bytes / statVFSBlockSize)
+			free = uint64(remaining.Bytes / statVFSBlockSize)
 		}
-		keyStr := key.String()
-		F(s3io.Log.Debug, "DeleteObject(Bucket=%s, Key=%s)", s3io.Bucket.Bucket, key)
-		_, err = s3io.Bucket.S3(sess).DeleteObjectWithContext(
-			combineContext(s3io.Ctx, req.Context()),
-			&aws_s3.DeleteObjectInput{
-				Bucket: &s3io.Bucket.Bucket,
-				Key:    &keyStr,
-			},
-		)
-		if err != nil {
-			s3io.Log.Debug("=> ", err)
-			return err
+		if limits.Objects >= 0 {
+			files = uint64(limits.Objects)
+			freeFiles = uint64(remaining.Objects)
 		}
 	}
-	return nil
+	return &sftp.StatVFS{
+		Bsize:   statVFSBlockSize,
+		Frsize:  statVFSBlockSize,
+		Blocks:  blocks,
+		Bfree:   free,
+		Bavail:  free,
+		Files:   files,
+		Ffree:   freeFiles,
+		Favail:  freeFiles,
+		Flag:    flag,
+		Namemax: statVFSNameMax,
+	}, nil
+}
+
+func (s3io *S3BucketIO) stat(req *sftp.Request, followSymlinks bool) (sftp.ListerAt, error) {
+	if !s3io.Perms.Readable && !s3io.Perms.Listable {
+		return nil, fmt.Errorf("stat operation not allowed as per configuration")
+	}
+	return &S3ObjectStat{
+		DebugLogger:      s3io.Log,
+		Ctx:              combineContext(s3io.Ctx, req.Context()),
+		Key:              buildKey(s3io.Bucket, req.Filepath),
+		KeyPrefix:        s3io.Bucket.KeyPrefix,
+		Backend:          s3io.Backend,
+		PhantomObjectMap: s3io.PhantomObjectMap,
+		FollowSymlinks:   followSymlinks,
+	}, nil
 }
 
 func (s3io *S3BucketIO) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
-	sess, err := aws_session.NewSession()
-	if err != nil {
-		return nil, err
-	}
 	switch req.Method {
-	case "Stat", "ReadLink":
-		if !s3io.Perms.Readable && !s3io.Perms.Listable {
-			return nil, fmt.Errorf("stat operation not allowed as per configuration")
-		}
-		key := buildKey(s3io.Bucket, req.Filepath)
-		return &S3ObjectStat{
-			DebugLogger:      s3io.Log,
-			Ctx:              combineContext(s3io.Ctx, req.Context()),
-			Bucket:           s3io.Bucket.Bucket,
-			Key:              key,
-			S3:               s3io.Bucket.S3(sess),
-			PhantomObjectMap: s3io.PhantomObjectMap,
-		}, nil
+	case "Stat":
+		return s3io.stat(req, true)
 	case "List":
 		if !s3io.Perms.Listable {
 			return nil, fmt.Errorf("listing operation not allowed as per configuration")
@@ -739,9 +985,8 @@ func (s3io *S3BucketIO) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 		return &S3ObjectLister{
 			DebugLogger:      s3io.Log,
 			Ctx:              combineContext(s3io.Ctx, req.Context()),
-			Bucket:           s3io.Bucket.Bucket,
 			Prefix:           buildKey(s3io.Bucket, req.Filepath),
-			S3:               s3io.Bucket.S3(sess),
+			Backend:          s3io.Backend,
 			Lookback:         s3io.ListerLookbackBufferSize,
 			PhantomObjectMap: s3io.PhantomObjectMap,
 		}, nil
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// checkS3Timeout is how long the S3 buckets are waited for each.
+const checkS3Timeout = 30 * time.Second
+
+// checkConfig reads the configuration and builds everything derived from it
+// as on startup without listening, and reports the problems to w.  The keys
+// that correspond to no setting are also problems.  With checkS3, every S3
+// bucket is tried with a HeadBucket request.
+func checkConfig(ctx context.Context, w io.Writer, configFile string, checkS3 bool) error {
+	cfg, buckets, _, err := loadConfig(configFile, NewSessionRegistry())
+	if err != nil {
+		return err
+	}
+	problems := 0
+	for _, key := range cfg.UndecodedKeys() {
+		fmt.Fprintf(w, "unknown key: %s\n", key)
+		problems++
+	}
+	if checkS3 {
+		names := make([]string, 0, len(buckets.Buckets))
+		for name := range buckets.Buckets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sb, ok := buckets.Buckets[name].Backend.(*S3Backend)
+			if !ok {
+				continue
+			}
+			_ctx, cancel := context.WithTimeout(ctx, checkS3Timeout)
+			err := sb.HeadBucket(_ctx)
+			cancel()
+			if err != nil {
+				fmt.Fprintf(w, "bucket config %s: bucket %s is not reachable: %s\n", name, sb.Bucket, err.Error())
+				problems++
+				continue
+			}
+			fmt.Fprintf(w, "bucket config %s: bucket %s is reachable\n", name, sb.Bucket)
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%s has %d problem(s)", configFile, problems)
+	}
+	fmt.Fprintf(w, "%s is OK\n", configFile)
+	return nil
+}
+
+// runCheckConfig runs the check-config subcommand with its arguments.
+func runCheckConfig(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	checkS3 := fs.Bool("s3", false, "test whether the S3 buckets are reachable")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+	return checkConfig(context.Background(), w, configFile, *checkS3)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy-check-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2eWritePEM(t, filepath.Join(dir, "host_key"), hostKey)
+	fs3 := NewFakeS3(e2eBucket)
+	defer fs3.Close()
+	caBundle := e2eWriteCABundle(t, fs3)
+	defer os.Remove(caBundle)
+
+	check := func(bucket, extra string, checkS3 bool) (string, error) {
+		cfgFile := filepath.Join(dir, "config.toml")
+		err := ioutil.WriteFile(cfgFile, []byte(`
+host_key_file = "`+filepath.Join(dir, "host_key")+`"
+
+[buckets.test]
+bucket_url = "`+fs3.Server.URL+`/`+bucket+`"
+ca_bundle = "`+caBundle+`"
+auth = "test"
+`+extra+`
+
+[buckets.test.credentials]
+aws_access_key_id = "AKID"
+aws_secret_access_key = "SECRET"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user]
+password = "secret"
+`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		err = checkConfig(context.Background(), buf, cfgFile, checkS3)
+		return buf.String(), err
+	}
+
+	out, err := check(e2eBucket, `readable = true`, true)
+	assert.NoError(t, err)
+	assert.Contains(t, out, "bucket config test: bucket bucket is reachable")
+
+	out, err = check(e2eBucket, `writeable = false`, false)
+	assert.Error(t, err)
+	assert.Contains(t, out, "unknown key: buckets.test.writeable")
+
+	// the bucket is only reached if asked to
+	_, err = check("missing", "", false)
+	assert.NoError(t, err)
+	out, err = check("missing", "", true)
+	assert.Error(t, err)
+	assert.Contains(t, out, "bucket config test: bucket missing is not reachable")
+
+	_, err = check(e2eBucket, `auth = "unknown"`, false)
+	assert.Error(t, err)
+}
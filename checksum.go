@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumAlgorithm describes where the checksum of an object may be found
+// without reading it.
+type checksumAlgorithm struct {
+	Name string
+	New  func() hash.Hash
+	// Key is the name in StorageObjectInfo.Checksums.
+	Key string
+	// HexMetadataKeys and Base64MetadataKeys are the user metadata keys
+	// that hold the checksum, as stored by tools like rclone.
+	HexMetadataKeys    []string
+	Base64MetadataKeys []string
+}
+
+var md5Checksum = &checksumAlgorithm{
+	Name:               "md5sum",
+	New:                md5.New,
+	Key:                "md5",
+	HexMetadataKeys:    []string{"md5"},
+	Base64MetadataKeys: []string{"md5chksum"},
+}
+
+var sha1Checksum = &checksumAlgorithm{
+	Name:            "sha1sum",
+	New:             sha1.New,
+	Key:             "sha1",
+	HexMetadataKeys: []string{"sha1"},
+}
+
+var sha256Checksum = &checksumAlgorithm{
+	Name:            "sha256sum",
+	New:             sha256.New,
+	Key:             "sha256",
+	HexMetadataKeys: []string{"sha256"},
+}
+
+// decodeChecksum returns the checksum in hex if v is a valid one.
+func (ca *checksumAlgorithm) decodeChecksum(v string, base64Encoded bool) (string, bool) {
+	var b []byte
+	var err error
+	if base64Encoded {
+		b, err = base64.StdEncoding.DecodeString(v)
+	} else {
+		b, err = hex.DecodeString(v)
+	}
+	if err != nil || len(b) != ca.New().Size() {
+		return "", false
+	}
+	return hex.EncodeToString(b), true
+}
+
+// lookupMetadata looks for the metadata whose name matches key regardless
+// of its case, as the SDK canonicalizes the names as HTTP headers.
+func lookupMetadata(metadata map[string]string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// FromObjectInfo returns the checksum in hex if it can be told from the
+// object's metadata.
+func (ca *checksumAlgorithm) FromObjectInfo(info *StorageObjectInfo) (string, bool) {
+	if v, ok := info.Checksums[ca.Key]; ok {
+		if sum, ok := ca.decodeChecksum(v, false); ok {
+			return sum, true
+		}
+	}
+	for _, key := range ca.HexMetadataKeys {
+		if v, ok := lookupMetadata(info.Metadata, key); ok {
+			if sum, ok := ca.decodeChecksum(v, false); ok {
+				return sum, true
+			}
+		}
+	}
+	for _, key := range ca.Base64MetadataKeys {
+		if v, ok := lookupMetadata(info.Metadata, key); ok {
+			if sum, ok := ca.decodeChecksum(v, true); ok {
+				return sum, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (ca *checksumAlgorithm) FromReader(r io.Reader) (string, error) {
+	h := ca.New()
+	_, err := io.CopyBuffer(h, r, make([]byte, scpBufferSize))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// headObject retrieves the metadata of the object at p following symbolic
+// links.  It returns nil without an error if the object is being uploaded.
+func (ec *ExecContext) headObject(p string) (*StorageObjectInfo, error) {
+	s3io := ec.BucketIO
+	if !s3io.Perms.Readable {
+		return nil, fmt.Errorf("read operation not allowed as per configuration")
+	}
+	key := buildKey(s3io.Bucket, ec.request("Stat", p).Filepath)
+	for hops := 0; ; hops++ {
+		if s3io.PhantomObjectMap.Get(key) != nil {
+			return nil, nil
+		}
+		info, err := s3io.headObject(ec.Ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		target, ok := symlinkTarget(info.Metadata)
+		if !ok {
+			return info, nil
+		}
+		if hops >= maxSymlinkHops {
+			return nil, errTooManySymlinks
+		}
+		key = resolveSymlinkKey(s3io.Bucket.KeyPrefix, key, target)
+	}
+}
+
+// Checksum returns the checksum of the file at p, computing it by reading
+// the object only when it is not known beforehand.
+func (ec *ExecContext) Checksum(ca *checksumAlgorithm, p string) (string, error) {
+	fi, err := ec.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("Is a directory")
+	}
+	info, err := ec.headObject(p)
+	if err != nil {
+		return "", err
+	}
+	if info != nil {
+		if sum, ok := ca.FromObjectInfo(info); ok {
+			return sum, nil
+		}
+	}
+	F(ec.BucketIO.Log.Debug, "computing %s of %s by reading the object", ca.Name, p)
+	r, err := ec.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer closeIfCloser(r)
+	return ca.FromReader(io.NewSectionReader(r, 0, 1<<63-1))
+}
+
+func (ca *checksumAlgorithm) run(ec *ExecContext) int {
+	paths := []string{}
+	noMoreOptions := false
+	for _, arg := range ec.Args[1:] {
+		if !noMoreOptions && len(arg) > 1 && arg[0] == '-' {
+			switch arg {
+			case "--":
+				noMoreOptions = true
+			case "-b", "-t", "--binary", "--text":
+				// no difference on this system
+			default:
+				fmt.Fprintf(ec.Stderr, "%s: unsupported option: %s\n", ca.Name, arg)
+				return 1
+			}
+			continue
+		}
+		paths = append(paths, arg)
+	}
+
+	if len(paths) == 0 {
+		sum, err := ca.FromReader(ec.Stdin)
+		if err != nil {
+			fmt.Fprintf(ec.Stderr, "%s: -: %s\n", ca.Name, err.Error())
+			return 1
+		}
+		fmt.Fprintf(ec.Stdout, "%s  -\n", sum)
+		return 0
+	}
+
+	status := 0
+	for _, p := range paths {
+		sum, err := ec.Checksum(ca, p)
+		if err != nil {
+			if err == os.ErrNotExist {
+				err = fmt.Errorf("No such file or directory")
+			}
+			fmt.Fprintf(ec.Stderr, "%s: %s: %s\n", ca.Name, p, err.Error())
+			status = 1
+			continue
+		}
+		fmt.Fprintf(ec.Stdout, "%s  %s\n", sum, p)
+	}
+	return status
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumFromObjectInfo(t *testing.T) {
+	sum, ok := md5Checksum.FromObjectInfo(&StorageObjectInfo{
+		Checksums: map[string]string{"md5": "d41d8cd98f00b204e9800998ecf8427e"},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", sum)
+
+	_, ok = md5Checksum.FromObjectInfo(&StorageObjectInfo{
+		Checksums: map[string]string{"md5": "d41d8cd98f00b204"},
+	})
+	assert.False(t, ok)
+
+	sum, ok = md5Checksum.FromObjectInfo(&StorageObjectInfo{
+		Metadata: map[string]string{"Md5chksum": "1B2M2Y8AsgTpgAmY7PhCfg=="},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", sum)
+
+	_, ok = sha1Checksum.FromObjectInfo(&StorageObjectInfo{
+		Checksums: map[string]string{"md5": "d41d8cd98f00b204e9800998ecf8427e"},
+	})
+	assert.False(t, ok)
+}
+
+func TestS3Checksums(t *testing.T) {
+	assert.Equal(t,
+		map[string]string{"md5": "d41d8cd98f00b204e9800998ecf8427e"},
+		s3Checksums(aws.String(`"d41d8cd98f00b204e9800998ecf8427e"`), nil, nil, nil, nil),
+	)
+	assert.Equal(t,
+		map[string]string{},
+		s3Checksums(aws.String(`"d41d8cd98f00b204e9800998ecf8427e-2"`), nil, nil, nil, nil),
+	)
+	assert.Equal(t,
+		map[string]string{},
+		s3Checksums(aws.String(`"0123456789abcdef0123456789abcdef"`), nil, aws.String("aws:kms"), nil, nil),
+	)
+	assert.Equal(t,
+		map[string]string{
+			"md5":    "d41d8cd98f00b204e9800998ecf8427e",
+			"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		s3Checksums(aws.String(`"d41d8cd98f00b204e9800998ecf8427e"`), nil, nil, nil, aws.String("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")),
+	)
+}
+
+func TestChecksumFromReader(t *testing.T) {
+	sum, err := sha1Checksum.FromReader(strings.NewReader("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a9993e364706816aba3e25717850c26c9cd0d89d", sum)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
@@ -14,6 +18,15 @@ var (
 	minReaderLookbackBufferSize = 1048576
 	minReaderMinChunkSize       = 262144
 	minListerLookbackBufferSize = 100
+	defaultShutdownGracePeriod  = Duration{30 * time.Second}
+	defaultQuotaScanInterval    = Duration{time.Hour}
+	defaultKeepaliveCountMax    = 3
+	defaultLoginGraceTime       = Duration{2 * time.Minute}
+	defaultBind                 = ":10022"
+	defaultListenerName         = "default"
+	defaultAlgorithmPreset      = "modern"
+	defaultMaxAuthTries         = 6
+	authMethods                 = []string{"password", "publickey", "keyboard-interactive"}
 	vTrue                       = true
 )
 
@@ -26,27 +39,71 @@ func (u *URL) UnmarshalText(text []byte) (err error) {
 	return
 }
 
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
 type AWSCredentialsConfig struct {
 	AWSAccessKeyID     string `toml:"aws_access_key_id"`
 	AWSSecretAccessKey string `toml:"aws_secret_access_key"`
 }
 
 type S3BucketConfig struct {
+	Backend                        string                   `toml:"backend"`
+	LocalRoot                      string                   `toml:"local_root"`
 	Profile                        string                   `toml:"profile"`
 	Credentials                    *AWSCredentialsConfig    `toml:"credentials"`
+	RoleARN                        string                   `toml:"role_arn"`
+	ExternalID                     string                   `toml:"external_id"`
+	RoleSessionName                string                   `toml:"role_session_name"`
+	WebIdentityTokenFile           string                   `toml:"web_identity_token_file"`
+	STSEndpoint                    string                   `toml:"sts_endpoint"`
+	SessionPolicy                  bool                     `toml:"session_policy"`
 	Region                         string                   `toml:"region"`
+	Endpoint                       string                   `toml:"endpoint"`
+	ForcePathStyle                 bool                     `toml:"force_path_style"`
+	DisableSSL                     bool                     `toml:"disable_ssl"`
+	CABundle                       string                   `toml:"ca_bundle"`
+	SignatureVersion               string                   `toml:"signature_version"`
 	Bucket                         string                   `toml:"bucket"`
 	KeyPrefix                      string                   `toml:"key_prefix"`
 	BucketUrl                      *URL                     `toml:"bucket_url"`
 	Auth                           string                   `toml:"auth"`
 	MaxObjectSize                  *int64                   `toml:"max_object_size"`
-	Readable                       *bool                    `toml:"readble"`
+	QuotaBytes                     *int64                   `toml:"quota_bytes"`
+	QuotaObjects                   *int64                   `toml:"quota_objects"`
+	UserQuotaBytes                 *int64                   `toml:"user_quota_bytes"`
+	UserQuotaObjects               *int64                   `toml:"user_quota_objects"`
+	QuotaScanInterval              *Duration                `toml:"quota_scan_interval"`
+	DownloadRateLimit              int64                    `toml:"download_rate_limit"`
+	UploadRateLimit                int64                    `toml:"upload_rate_limit"`
+	UserDownloadRateLimit          int64                    `toml:"user_download_rate_limit"`
+	UserUploadRateLimit            int64                    `toml:"user_upload_rate_limit"`
+	Readable                       *bool                    `toml:"readable"`
+	ReadableMisspelled             *bool                    `toml:"readble"`
 	Writable                       *bool                    `toml:"writable"`
 	Listable                       *bool                    `toml:"listable"`
 	ServerSideEncryption           ServerSideEncryptionType `toml:"server_side_encryption"`
 	SSECustomerKey                 string                   `toml:"sse_customer_key"`
 	SSEKMSKeyId                    string                   `toml:"sse_kms_key_id"`
+	ClientSideEncryptionKeyFile    string                   `toml:"client_side_encryption_key_file"`
 	KeyboardInteractiveAuthEnabled bool                     `toml:"keyboard_interactive_auth"`
+	Scanner                        string                   `toml:"scanner"`
+	InfectedAction                 InfectedAction           `toml:"infected_action"`
+	QuarantinePrefix               string                   `toml:"quarantine_prefix"`
+	Banner                         string                   `toml:"banner"`
+	LoginMessage                   string                   `toml:"login_message"`
+}
+
+type ScannerConfig struct {
+	Type    string    `toml:"type"`
+	URL     *URL      `toml:"url"`
+	Timeout *Duration `toml:"timeout"`
 }
 
 type AuthUser struct {
@@ -61,23 +118,162 @@ type AuthConfig struct {
 	Users      map[string]AuthUser `toml:"users"`
 }
 
+type AdminAPIConfig struct {
+	Bind  string `toml:"bind"`
+	Token string `toml:"token"`
+}
+
+type ListenerConfig struct {
+	Bind                 string   `toml:"bind"`
+	SystemdSocket        string   `toml:"systemd_socket"`
+	HostKeyFile          string   `toml:"host_key_file"`
+	HostKeyFiles         []string `toml:"host_key_files"`
+	HostCertificateFiles []string `toml:"host_certificate_files"`
+	Banner               *string  `toml:"banner"`
+	AuthMethods          []string `toml:"auth_methods"`
+	Buckets              []string `toml:"buckets"`
+	ProxyProtocolTrusted []string `toml:"proxy_protocol_trusted_cidrs"`
+}
+
+// AllowsBucket tells whether the users of the bucket config may log in on
+// the listener.
+func (lCfg *ListenerConfig) AllowsBucket(name string) bool {
+	return lCfg.Buckets == nil || containsString(lCfg.Buckets, name)
+}
+
+// AllowsAuthMethod tells whether the authentication method is enabled on
+// the listener.
+func (lCfg *ListenerConfig) AllowsAuthMethod(method string) bool {
+	return containsString(lCfg.AuthMethods, method)
+}
+
 type S3SFTPProxyConfig struct {
 	Bind                     string                     `toml:"bind"`
 	HostKeyFile              string                     `toml:"host_key_file"`
+	HostKeyFiles             []string                   `toml:"host_key_files"`
+	HostCertificateFiles     []string                   `toml:"host_certificate_files"`
 	Banner                   string                     `toml:"banner"`
+	LoginMessage             string                     `toml:"login_message"`
 	ReaderLookbackBufferSize *int                       `toml:"reader_lookback_buffer_size"`
 	ReaderMinChunkSize       *int                       `toml:"reader_min_chunk_size"`
 	ListerLookbackBufferSize *int                       `toml:"lister_lookback_buffer_size"`
+	ShutdownGracePeriod      *Duration                  `toml:"shutdown_grace_period"`
+	DownloadRateLimit        int64                      `toml:"download_rate_limit"`
+	UploadRateLimit          int64                      `toml:"upload_rate_limit"`
+	MaxConnections           int                        `toml:"max_connections"`
+	MaxConnectionsPerIP      int                        `toml:"max_connections_per_ip"`
+	MaxSessionsPerUser       int                        `toml:"max_sessions_per_user"`
+	MaxChannelsPerConnection int                        `toml:"max_channels_per_connection"`
+	LoginGraceTime           *Duration                  `toml:"login_grace_time"`
+	IdleTimeout              Duration                   `toml:"idle_timeout"`
+	MaxSessionDuration       Duration                   `toml:"max_session_duration"`
+	KeepaliveInterval        Duration                   `toml:"keepalive_interval"`
+	KeepaliveCountMax        *int                       `toml:"keepalive_count_max"`
+	ProxyProtocolTrusted     []string                   `toml:"proxy_protocol_trusted_cidrs"`
+	AlgorithmPreset          string                     `toml:"algorithm_preset"`
+	Ciphers                  []string                   `toml:"ciphers"`
+	KeyExchanges             []string                   `toml:"key_exchanges"`
+	MACs                     []string                   `toml:"macs"`
+	PublicKeyAlgorithms      []string                   `toml:"public_key_algorithms"`
+	MaxAuthTries             *int                       `toml:"max_auth_tries"`
+	Listeners                map[string]*ListenerConfig `toml:"listeners"`
 	Buckets                  map[string]*S3BucketConfig `toml:"buckets"`
 	AuthConfigs              map[string]*AuthConfig     `toml:"auth"`
+	Scanners                 map[string]*ScannerConfig  `toml:"scanners"`
+	AdminAPI                 *AdminAPIConfig            `toml:"admin_api"`
+	// undecodedKeys are the keys in the file that correspond to no setting
+	undecodedKeys []string
 }
 
-func validateAndFixupBucketConfig(bCfg *S3BucketConfig) error {
+// UndecodedKeys returns the keys in the configuration that correspond to no
+// setting, which are most likely typos.
+func (cfg *S3SFTPProxyConfig) UndecodedKeys() []string {
+	return cfg.undecodedKeys
+}
+
+func validateAndFixupLocalBucketConfig(bCfg *S3BucketConfig) error {
+	if bCfg.Bucket != "" {
+		return fmt.Errorf(`bucket may not be specified if backend is "local"`)
+	}
+	if bCfg.BucketUrl != nil {
+		if bCfg.LocalRoot != "" {
+			return fmt.Errorf("local_root may not be specified if bucket_url is given")
+		}
+		if bCfg.BucketUrl.Scheme != "file" {
+			return fmt.Errorf("bucket URL scheme must be \"file\" for the local backend")
+		}
+		if bCfg.BucketUrl.Host != "" && bCfg.BucketUrl.Host != "localhost" {
+			return fmt.Errorf("bucket URL must not have a host other than localhost")
+		}
+		bCfg.LocalRoot = bCfg.BucketUrl.Path
+	}
+	if bCfg.LocalRoot == "" {
+		return fmt.Errorf("local_root is not specified")
+	}
+	bCfg.LocalRoot = filepath.Clean(bCfg.LocalRoot)
+	if bCfg.ServerSideEncryption != ServerSideEncryptionTypeNone || bCfg.SSECustomerKey != "" || bCfg.SSEKMSKeyId != "" {
+		return fmt.Errorf(`server-side encryption is not available if backend is "local"`)
+	}
+	if bCfg.Endpoint != "" || bCfg.ForcePathStyle || bCfg.DisableSSL || bCfg.CABundle != "" || bCfg.SignatureVersion != "" {
+		return fmt.Errorf(`endpoint settings are not available if backend is "local"`)
+	}
+	return nil
+}
+
+func validateAndFixupServerSideEncryptionConfig(bCfg *S3BucketConfig) error {
+	// "aes256" used to mean SSE-C when a customer key was given
+	if bCfg.ServerSideEncryption == ServerSideEncryptionTypeAES256 && bCfg.SSECustomerKey != "" {
+		bCfg.ServerSideEncryption = ServerSideEncryptionTypeCustomerKey
+	}
+	if bCfg.ServerSideEncryption == ServerSideEncryptionTypeCustomerKey {
+		if bCfg.SSECustomerKey == "" {
+			return fmt.Errorf(`sse_customer_key is not specified`)
+		}
+		key, err := base64.StdEncoding.DecodeString(bCfg.SSECustomerKey)
+		if err != nil {
+			return fmt.Errorf(`invalid base64-encoded string specified for "sse_customer_key"`)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf(`sse_customer_key must be 256 bits long, but is %d bits long`, len(key)*8)
+		}
+	} else if bCfg.SSECustomerKey != "" {
+		return fmt.Errorf(`sse_customer_key may not be specified unless server_side_encryption is "sse-c"`)
+	}
+	if bCfg.ServerSideEncryption == ServerSideEncryptionTypeKMS {
+		if bCfg.SSEKMSKeyId == "" {
+			return fmt.Errorf(`sse_kms_key_id is not specified`)
+		}
+	} else if bCfg.SSEKMSKeyId != "" {
+		return fmt.Errorf(`sse_kms_key_id may not be specified unless server_side_encryption is "kms"`)
+	}
+	return nil
+}
+
+func validateAndFixupS3BucketConfig(bCfg *S3BucketConfig) error {
+	if bCfg.LocalRoot != "" {
+		return fmt.Errorf(`local_root may not be specified unless backend is "local"`)
+	}
 	if bCfg.Profile != "" {
 		if bCfg.Credentials != nil {
 			return fmt.Errorf("no credentials may be specified if profile is given")
 		}
 	}
+	if bCfg.RoleARN != "" {
+		if bCfg.WebIdentityTokenFile != "" && (bCfg.Profile != "" || bCfg.Credentials != nil) {
+			return fmt.Errorf("no credentials may be specified if web_identity_token_file is given")
+		}
+		if bCfg.WebIdentityTokenFile != "" && bCfg.ExternalID != "" {
+			return fmt.Errorf("external_id may not be specified if web_identity_token_file is given")
+		}
+		if bCfg.WebIdentityTokenFile != "" && bCfg.SessionPolicy {
+			return fmt.Errorf("session_policy may not be specified if web_identity_token_file is given")
+		}
+		if bCfg.RoleSessionName == "" {
+			bCfg.RoleSessionName = "s3-sftp-proxy"
+		}
+	} else if bCfg.ExternalID != "" || bCfg.RoleSessionName != "" || bCfg.WebIdentityTokenFile != "" || bCfg.STSEndpoint != "" || bCfg.SessionPolicy {
+		return fmt.Errorf("role_arn is not specified")
+	}
 	if bCfg.BucketUrl != nil {
 		if bCfg.Bucket != "" {
 			return fmt.Errorf("bucket may not be specified if bucket_url is given")
@@ -85,22 +281,122 @@ func validateAndFixupBucketConfig(bCfg *S3BucketConfig) error {
 		if bCfg.KeyPrefix != "" {
 			return fmt.Errorf("root path may not be specified if bucket_url is given")
 		}
-		if bCfg.BucketUrl.Host == "" {
-			return fmt.Errorf("bucket name is empty")
+		switch bCfg.BucketUrl.Scheme {
+		case "s3":
+			if bCfg.BucketUrl.Host == "" {
+				return fmt.Errorf("bucket name is empty")
+			}
+			bCfg.Bucket = bCfg.BucketUrl.Host
+			bCfg.KeyPrefix = bCfg.BucketUrl.Path
+		case "http", "https":
+			// https://host/bucket/prefix for the S3-compatible stores
+			if bCfg.Endpoint != "" {
+				return fmt.Errorf("endpoint may not be specified if bucket_url is an HTTP(S) URL")
+			}
+			if bCfg.BucketUrl.Host == "" {
+				return fmt.Errorf("bucket URL has no host")
+			}
+			elems := strings.SplitN(strings.TrimPrefix(bCfg.BucketUrl.Path, "/"), "/", 2)
+			if elems[0] == "" {
+				return fmt.Errorf("bucket name is empty")
+			}
+			bCfg.Endpoint = bCfg.BucketUrl.Scheme + "://" + bCfg.BucketUrl.Host
+			bCfg.ForcePathStyle = true
+			bCfg.Bucket = elems[0]
+			if len(elems) > 1 {
+				bCfg.KeyPrefix = elems[1]
+			}
+		default:
+			return fmt.Errorf("bucket URL scheme must be \"s3\", \"http\" or \"https\"")
 		}
-		if bCfg.BucketUrl.Scheme != "s3" {
-			return fmt.Errorf("bucket URL scheme must be \"s3\"")
-		}
-		bCfg.Bucket = bCfg.BucketUrl.Host
-		bCfg.KeyPrefix = bCfg.BucketUrl.Path
 	} else {
 		if bCfg.Bucket == "" {
 			return fmt.Errorf("bucket name is empty")
 		}
 	}
+	err := validateAndFixupServerSideEncryptionConfig(bCfg)
+	if err != nil {
+		return err
+	}
+	switch bCfg.SignatureVersion {
+	case "":
+		bCfg.SignatureVersion = "v4"
+	case "v2", "v4":
+	default:
+		return fmt.Errorf("signature_version must be either \"v2\" or \"v4\"")
+	}
+	return nil
+}
+
+func validateAndFixupBucketConfig(bCfg *S3BucketConfig) error {
+	if bCfg.Backend == "" {
+		bCfg.Backend = "s3"
+		if bCfg.BucketUrl != nil && bCfg.BucketUrl.Scheme == "file" {
+			bCfg.Backend = "local"
+		}
+	}
+	var err error
+	switch bCfg.Backend {
+	case "s3":
+		err = validateAndFixupS3BucketConfig(bCfg)
+	case "local":
+		err = validateAndFixupLocalBucketConfig(bCfg)
+	default:
+		err = fmt.Errorf("unknown backend: %s", bCfg.Backend)
+	}
+	if err != nil {
+		return err
+	}
 	if bCfg.Auth == "" {
 		return fmt.Errorf("auth is not specified")
 	}
+	if bCfg.InfectedAction == InfectedActionQuarantine {
+		if bCfg.Scanner == "" {
+			return fmt.Errorf("quarantine may not be specified if no scanner is given")
+		}
+		if bCfg.QuarantinePrefix == "" {
+			return fmt.Errorf("quarantine_prefix is not specified")
+		}
+	}
+	for _, q := range []struct {
+		name string
+		v    *int64
+	}{
+		{"quota_bytes", bCfg.QuotaBytes},
+		{"quota_objects", bCfg.QuotaObjects},
+		{"user_quota_bytes", bCfg.UserQuotaBytes},
+		{"user_quota_objects", bCfg.UserQuotaObjects},
+	} {
+		if q.v != nil && *q.v < 0 {
+			return fmt.Errorf("%s must not be negative", q.name)
+		}
+	}
+	if bCfg.DownloadRateLimit < 0 || bCfg.UploadRateLimit < 0 || bCfg.UserDownloadRateLimit < 0 || bCfg.UserUploadRateLimit < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if bCfg.QuotaScanInterval == nil {
+		bCfg.QuotaScanInterval = &defaultQuotaScanInterval
+	} else if bCfg.QuotaScanInterval.Duration <= 0 {
+		return fmt.Errorf("quota_scan_interval must be positive")
+	}
+	bCfg.Banner = terminateLine(bCfg.Banner)
+	_, err = ParseBannerTemplate(bCfg.Banner)
+	if err != nil {
+		return errors.Wrapf(err, "banner")
+	}
+	bCfg.LoginMessage = terminateLine(bCfg.LoginMessage)
+	_, err = ParseBannerTemplate(bCfg.LoginMessage)
+	if err != nil {
+		return errors.Wrapf(err, "login_message")
+	}
+	// "readble" used to be read in place of "readable", and is still
+	// accepted for the existing configurations
+	if bCfg.ReadableMisspelled != nil {
+		if bCfg.Readable != nil {
+			return fmt.Errorf("readble may not be specified if readable is given")
+		}
+		bCfg.Readable = bCfg.ReadableMisspelled
+	}
 	if bCfg.Readable == nil {
 		bCfg.Readable = &vTrue
 	}
@@ -133,16 +429,137 @@ func validateAndFixupAuthConfig(aCfg *AuthConfig) error {
 	}
 }
 
+func validateAndFixupScannerConfig(sCfg *ScannerConfig) error {
+	switch sCfg.Type {
+	case "clamd", "icap":
+	default:
+		return fmt.Errorf("unknown scanner type: %s", sCfg.Type)
+	}
+	if sCfg.URL == nil {
+		return fmt.Errorf("url is not specified")
+	}
+	return nil
+}
+
+// terminateLine appends the newline to the message unless it ends with one.
+func terminateLine(s string) string {
+	if len(s) > 0 && s[len(s)-1] != '\n' {
+		return s + "\n"
+	}
+	return s
+}
+
+// SSHAlgorithms returns the algorithms of the SSH protocol.
+func (cfg *S3SFTPProxyConfig) SSHAlgorithms() SSHAlgorithms {
+	return SSHAlgorithms{
+		Ciphers:             cfg.Ciphers,
+		KeyExchanges:        cfg.KeyExchanges,
+		MACs:                cfg.MACs,
+		PublicKeyAlgorithms: cfg.PublicKeyAlgorithms,
+	}
+}
+
+// validateAndFixupSSHAlgorithms fills the algorithms not given with those of
+// the preset.
+func validateAndFixupSSHAlgorithms(cfg *S3SFTPProxyConfig) error {
+	if cfg.AlgorithmPreset == "" {
+		cfg.AlgorithmPreset = defaultAlgorithmPreset
+	}
+	preset, ok := sshAlgorithmPresets[cfg.AlgorithmPreset]
+	if !ok {
+		return fmt.Errorf("unknown algorithm_preset: %s", cfg.AlgorithmPreset)
+	}
+	if cfg.Ciphers == nil {
+		cfg.Ciphers = preset.Ciphers
+	}
+	if cfg.KeyExchanges == nil {
+		cfg.KeyExchanges = preset.KeyExchanges
+	}
+	if cfg.MACs == nil {
+		cfg.MACs = preset.MACs
+	}
+	if cfg.PublicKeyAlgorithms == nil {
+		cfg.PublicKeyAlgorithms = preset.PublicKeyAlgorithms
+	}
+	err := cfg.SSHAlgorithms().Validate()
+	if err != nil {
+		return err
+	}
+	if cfg.MaxAuthTries == nil {
+		cfg.MaxAuthTries = &defaultMaxAuthTries
+	} else if *cfg.MaxAuthTries < 1 {
+		return fmt.Errorf("max_auth_tries must be positive")
+	}
+	return nil
+}
+
+// validateAndFixupListenerConfig validates the listener config, in which
+// the settings not given are taken from the top level.
+func validateAndFixupListenerConfig(lCfg *ListenerConfig, cfg *S3SFTPProxyConfig) error {
+	if (lCfg.Bind == "") == (lCfg.SystemdSocket == "") {
+		return fmt.Errorf("either bind or systemd_socket must be specified")
+	}
+	if lCfg.HostKeyFile == "" && lCfg.HostKeyFiles == nil {
+		lCfg.HostKeyFile = cfg.HostKeyFile
+		lCfg.HostKeyFiles = cfg.HostKeyFiles
+	}
+	if lCfg.HostKeyFile != "" {
+		lCfg.HostKeyFiles = append([]string{lCfg.HostKeyFile}, lCfg.HostKeyFiles...)
+		lCfg.HostKeyFile = ""
+	}
+	if len(lCfg.HostKeyFiles) == 0 {
+		return fmt.Errorf("no host key file is specified")
+	}
+	if lCfg.HostCertificateFiles == nil {
+		lCfg.HostCertificateFiles = cfg.HostCertificateFiles
+	}
+	if lCfg.Banner == nil {
+		lCfg.Banner = &cfg.Banner
+	} else {
+		banner := terminateLine(*lCfg.Banner)
+		lCfg.Banner = &banner
+		_, err := ParseBannerTemplate(banner)
+		if err != nil {
+			return errors.Wrapf(err, "banner")
+		}
+	}
+	if lCfg.AuthMethods == nil {
+		lCfg.AuthMethods = authMethods
+	}
+	for _, m := range lCfg.AuthMethods {
+		if !containsString(authMethods, m) {
+			return fmt.Errorf("unknown auth method: %s", m)
+		}
+	}
+	for _, b := range lCfg.Buckets {
+		if _, ok := cfg.Buckets[b]; !ok {
+			return fmt.Errorf("unknown bucket config: %s", b)
+		}
+	}
+	if lCfg.ProxyProtocolTrusted == nil {
+		lCfg.ProxyProtocolTrusted = cfg.ProxyProtocolTrusted
+	}
+	_, err := ParseCIDRs(lCfg.ProxyProtocolTrusted)
+	if err != nil {
+		return errors.Wrapf(err, "proxy_protocol_trusted_cidrs")
+	}
+	return nil
+}
+
 func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 	cfg := &S3SFTPProxyConfig{
 		Buckets:     map[string]*S3BucketConfig{},
 		AuthConfigs: map[string]*AuthConfig{},
+		Scanners:    map[string]*ScannerConfig{},
 	}
 
-	_, err := toml.Decode(tomlStr, cfg)
+	md, err := toml.Decode(tomlStr, cfg)
 	if err != nil {
 		return nil, err
 	}
+	for _, key := range md.Undecoded() {
+		cfg.undecodedKeys = append(cfg.undecodedKeys, key.String())
+	}
 
 	if len(cfg.Buckets) == 0 {
 		return nil, fmt.Errorf("no bucket configs are present")
@@ -152,12 +569,16 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		return nil, fmt.Errorf("no auth configs are present")
 	}
 
-	if cfg.HostKeyFile == "" {
-		return nil, fmt.Errorf("no host key file is specified")
+	cfg.Banner = terminateLine(cfg.Banner)
+	_, err = ParseBannerTemplate(cfg.Banner)
+	if err != nil {
+		return nil, errors.Wrapf(err, "banner")
 	}
 
-	if len(cfg.Banner) > 0 && cfg.Banner[len(cfg.Banner)-1] != '\n' {
-		cfg.Banner += "\n"
+	cfg.LoginMessage = terminateLine(cfg.LoginMessage)
+	_, err = ParseBannerTemplate(cfg.LoginMessage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "login_message")
 	}
 
 	if cfg.ReaderLookbackBufferSize == nil {
@@ -178,6 +599,55 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		return nil, fmt.Errorf("lister_lookback_buffer_size must be equal to or greater than %d", minListerLookbackBufferSize)
 	}
 
+	if cfg.AdminAPI != nil {
+		if cfg.AdminAPI.Bind == "" {
+			return nil, fmt.Errorf("admin_api: bind is not specified")
+		}
+		if cfg.AdminAPI.Token == "" {
+			return nil, fmt.Errorf("admin_api: token is not specified")
+		}
+	}
+
+	if cfg.ShutdownGracePeriod == nil {
+		cfg.ShutdownGracePeriod = &defaultShutdownGracePeriod
+	} else if cfg.ShutdownGracePeriod.Duration < 0 {
+		return nil, fmt.Errorf("shutdown_grace_period must not be negative")
+	}
+
+	if cfg.DownloadRateLimit < 0 || cfg.UploadRateLimit < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerIP < 0 || cfg.MaxSessionsPerUser < 0 || cfg.MaxChannelsPerConnection < 0 {
+		return nil, fmt.Errorf("connection limits must not be negative")
+	}
+
+	if cfg.LoginGraceTime == nil {
+		cfg.LoginGraceTime = &defaultLoginGraceTime
+	} else if cfg.LoginGraceTime.Duration < 0 {
+		return nil, fmt.Errorf("login_grace_time must not be negative")
+	}
+
+	if cfg.IdleTimeout.Duration < 0 || cfg.MaxSessionDuration.Duration < 0 || cfg.KeepaliveInterval.Duration < 0 {
+		return nil, fmt.Errorf("idle_timeout, max_session_duration and keepalive_interval must not be negative")
+	}
+
+	if cfg.KeepaliveCountMax == nil {
+		cfg.KeepaliveCountMax = &defaultKeepaliveCountMax
+	} else if *cfg.KeepaliveCountMax < 1 {
+		return nil, fmt.Errorf("keepalive_count_max must be positive")
+	}
+
+	_, err = ParseCIDRs(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, errors.Wrapf(err, "proxy_protocol_trusted_cidrs")
+	}
+
+	err = validateAndFixupSSHAlgorithms(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	for name, bCfg := range cfg.Buckets {
 		err := validateAndFixupBucketConfig(bCfg)
 		if err != nil {
@@ -185,6 +655,25 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		}
 	}
 
+	if len(cfg.Listeners) == 0 {
+		bind := cfg.Bind
+		if bind == "" {
+			bind = defaultBind
+		}
+		cfg.Listeners = map[string]*ListenerConfig{
+			defaultListenerName: {Bind: bind},
+		}
+	} else if cfg.Bind != "" {
+		return nil, fmt.Errorf("bind may not be specified if listeners are given")
+	}
+
+	for name, lCfg := range cfg.Listeners {
+		err := validateAndFixupListenerConfig(lCfg, cfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, `listener config "%s"`, name)
+		}
+	}
+
 	for name, aCfg := range cfg.AuthConfigs {
 		err := validateAndFixupAuthConfig(aCfg)
 		if err != nil {
@@ -192,6 +681,13 @@ func ReadConfig(tomlStr string) (*S3SFTPProxyConfig, error) {
 		}
 	}
 
+	for name, sCfg := range cfg.Scanners {
+		err := validateAndFixupScannerConfig(sCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, `scanner config "%s"`, name)
+		}
+	}
+
 	return cfg, err
 }
 
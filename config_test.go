@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAndFixupServerSideEncryptionConfig(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	cases := []struct {
+		Config   S3BucketConfig
+		Expected ServerSideEncryptionType
+		Error    bool
+	}{
+		{S3BucketConfig{}, ServerSideEncryptionTypeNone, false},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeAES256}, ServerSideEncryptionTypeAES256, false},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeAES256, SSECustomerKey: key}, ServerSideEncryptionTypeCustomerKey, false},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeCustomerKey, SSECustomerKey: key}, ServerSideEncryptionTypeCustomerKey, false},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeCustomerKey}, 0, true},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeCustomerKey, SSECustomerKey: "!"}, 0, true},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeCustomerKey, SSECustomerKey: base64.StdEncoding.EncodeToString(make([]byte, 16))}, 0, true},
+		{S3BucketConfig{SSECustomerKey: key}, 0, true},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeKMS, SSEKMSKeyId: "key-id"}, ServerSideEncryptionTypeKMS, false},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeKMS}, 0, true},
+		{S3BucketConfig{ServerSideEncryption: ServerSideEncryptionTypeAES256, SSEKMSKeyId: "key-id"}, 0, true},
+	}
+	for i, c := range cases {
+		err := validateAndFixupServerSideEncryptionConfig(&c.Config)
+		if c.Error {
+			assert.Error(t, err, "case %d", i)
+		} else if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.Expected, c.Config.ServerSideEncryption, "case %d", i)
+		}
+	}
+}
+
+func TestReadConfigListeners(t *testing.T) {
+	base := `
+host_key_file = "host_key"
+banner = "welcome"
+proxy_protocol_trusted_cidrs = ["10.0.0.0/8"]
+
+[buckets.test]
+bucket = "bucket"
+auth = "test"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user]
+password = "secret"
+`
+	cfg, err := ReadConfig(base)
+	if assert.NoError(t, err) {
+		lCfg := cfg.Listeners[defaultListenerName]
+		if assert.NotNil(t, lCfg) {
+			assert.Equal(t, defaultBind, lCfg.Bind)
+			assert.Equal(t, []string{"host_key"}, lCfg.HostKeyFiles)
+			assert.Equal(t, "welcome\n", *lCfg.Banner)
+			assert.Equal(t, []string{"10.0.0.0/8"}, lCfg.ProxyProtocolTrusted)
+			assert.True(t, lCfg.AllowsAuthMethod("keyboard-interactive"))
+			assert.True(t, lCfg.AllowsBucket("test"))
+		}
+	}
+
+	cfg, err = ReadConfig(base + `
+[listeners.public]
+systemd_socket = "public"
+host_key_file = "public_host_key"
+banner = ""
+auth_methods = ["publickey"]
+buckets = []
+proxy_protocol_trusted_cidrs = []
+`)
+	if assert.NoError(t, err) {
+		lCfg := cfg.Listeners["public"]
+		if assert.NotNil(t, lCfg) {
+			assert.Equal(t, []string{"public_host_key"}, lCfg.HostKeyFiles)
+			assert.Equal(t, "", *lCfg.Banner)
+			assert.Empty(t, lCfg.ProxyProtocolTrusted)
+			assert.True(t, lCfg.AllowsAuthMethod("publickey"))
+			assert.False(t, lCfg.AllowsAuthMethod("password"))
+			assert.False(t, lCfg.AllowsBucket("test"))
+		}
+		assert.Len(t, cfg.Listeners, 1)
+	}
+
+	for _, listener := range []string{
+		`bind = ":22"
+systemd_socket = "public"`,
+		`host_key_file = ""`,
+		`bind = ":22"
+auth_methods = ["hostbased"]`,
+		`bind = ":22"
+buckets = ["unknown"]`,
+	} {
+		_, err = ReadConfig(base + "\n[listeners.public]\n" + listener)
+		assert.Error(t, err, listener)
+	}
+	_, err = ReadConfig("bind = \":22\"\n" + base + "\n[listeners.public]\nbind = \":22\"\n")
+	assert.Error(t, err)
+}
+
+func TestReadConfigSSHAlgorithms(t *testing.T) {
+	base := `
+host_key_file = "host_key"
+
+[buckets.test]
+bucket = "bucket"
+auth = "test"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user]
+password = "secret"
+`
+	cfg, err := ReadConfig(base)
+	if assert.NoError(t, err) {
+		assert.Equal(t, sshAlgorithmPresets["modern"], cfg.SSHAlgorithms())
+		assert.Equal(t, 6, *cfg.MaxAuthTries)
+	}
+
+	cfg, err = ReadConfig(`
+algorithm_preset = "legacy-compat"
+ciphers = ["aes256-ctr"]
+max_auth_tries = 3
+` + base)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"aes256-ctr"}, cfg.Ciphers)
+		assert.Equal(t, sshAlgorithmPresets["legacy-compat"].MACs, cfg.MACs)
+		assert.Equal(t, 3, *cfg.MaxAuthTries)
+	}
+
+	for _, c := range []string{
+		`algorithm_preset = "paranoid"`,
+		`ciphers = ["aes256-cbc"]`,
+		`key_exchanges = ["curve25519-sha256", "sntrup761x25519-sha512@openssh.com"]`,
+		`macs = []`,
+		`public_key_algorithms = ["ssh-ed448"]`,
+		`max_auth_tries = 0`,
+	} {
+		_, err = ReadConfig(c + "\n" + base)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestReadConfigBanners(t *testing.T) {
+	base := `
+host_key_file = "host_key"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user]
+password = "secret"
+
+[buckets.test]
+bucket = "bucket"
+auth = "test"
+`
+	cfg, err := ReadConfig(`
+banner = "Hello, {{.User}}"
+login_message = "{{with .Quota}}{{bytes .RemainingBytes}} left{{end}}"
+` + base + `login_message = "{{.Bucket}}"`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Hello, {{.User}}\n", *cfg.Listeners[defaultListenerName].Banner)
+		assert.Equal(t, "{{with .Quota}}{{bytes .RemainingBytes}} left{{end}}\n", cfg.LoginMessage)
+		assert.Equal(t, "{{.Bucket}}\n", cfg.Buckets["test"].LoginMessage)
+	}
+
+	for _, c := range []string{
+		`banner = "{{.User"`,
+		`login_message = "{{.Quota.RemainingBytes}}"`,
+	} {
+		_, err = ReadConfig(c + "\n" + base)
+		assert.Error(t, err, c)
+		_, err = ReadConfig(base + c)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestReadConfigReadable(t *testing.T) {
+	base := `
+host_key_file = "host_key"
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user]
+password = "secret"
+
+[buckets.test]
+bucket = "bucket"
+auth = "test"
+`
+	for _, c := range []struct {
+		extra    string
+		readable bool
+	}{
+		{"", true},
+		{"readable = false", false},
+		// the misspelled key once read in place of readable
+		{"readble = false", false},
+	} {
+		cfg, err := ReadConfig(base + c.extra)
+		if assert.NoError(t, err, c.extra) {
+			assert.Equal(t, c.readable, *cfg.Buckets["test"].Readable, c.extra)
+			assert.Empty(t, cfg.UndecodedKeys(), c.extra)
+		}
+	}
+
+	_, err := ReadConfig(base + "readable = true\nreadble = false")
+	assert.Error(t, err)
+
+	cfg, err := ReadConfig("bnner = \"\"\n" + base + "writeable = false")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"bnner", "buckets.test.writeable"}, cfg.UndecodedKeys())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionLimits are the limits on what the clients can take up, so that
+// a misbehaving client cannot exhaust the file descriptors or the memory.
+// Zero means unlimited.
+type ConnectionLimits struct {
+	MaxConnections           int
+	MaxConnectionsPerIP      int
+	MaxSessionsPerUser       int
+	MaxChannelsPerConnection int
+	// LoginGraceTime is how long a connection may take to finish the
+	// handshake and the authentication.
+	LoginGraceTime time.Duration
+	// IdleTimeout is how long a session may go without any traffic on its
+	// channels, and MaxSessionDuration is how long it may last at all.
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+	// KeepaliveInterval is the interval of the keepalive probes, and the
+	// session is closed after KeepaliveCountMax probes unanswered.
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+}
+
+func NewConnectionLimitsFromConfig(cfg *S3SFTPProxyConfig) ConnectionLimits {
+	return ConnectionLimits{
+		MaxConnections:           cfg.MaxConnections,
+		MaxConnectionsPerIP:      cfg.MaxConnectionsPerIP,
+		MaxSessionsPerUser:       cfg.MaxSessionsPerUser,
+		MaxChannelsPerConnection: cfg.MaxChannelsPerConnection,
+		LoginGraceTime:           cfg.LoginGraceTime.Duration,
+		IdleTimeout:              cfg.IdleTimeout.Duration,
+		MaxSessionDuration:       cfg.MaxSessionDuration.Duration,
+		KeepaliveInterval:        cfg.KeepaliveInterval.Duration,
+		KeepaliveCountMax:        *cfg.KeepaliveCountMax,
+	}
+}
+
+// connectionCounter counts the connections in total and for each source
+// address.
+type connectionCounter struct {
+	mtx   sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire counts the connection from the address in unless it exceeds the
+// limits.
+func (cc *connectionCounter) acquire(ip string, limits ConnectionLimits) error {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	if cc.perIP == nil {
+		cc.perIP = map[string]int{}
+	}
+	if limits.MaxConnections > 0 && cc.total >= limits.MaxConnections {
+		return fmt.Errorf("too many connections (%d)", cc.total)
+	}
+	if limits.MaxConnectionsPerIP > 0 && cc.perIP[ip] >= limits.MaxConnectionsPerIP {
+		return fmt.Errorf("too many connections from %s (%d)", ip, cc.perIP[ip])
+	}
+	cc.total++
+	cc.perIP[ip]++
+	return nil
+}
+
+func (cc *connectionCounter) release(ip string) {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	cc.total--
+	cc.perIP[ip]--
+	if cc.perIP[ip] <= 0 {
+		delete(cc.perIP, ip)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionCounter(t *testing.T) {
+	limits := ConnectionLimits{MaxConnections: 3, MaxConnectionsPerIP: 2}
+	cc := &connectionCounter{}
+	assert.NoError(t, cc.acquire("192.0.2.1", limits))
+	assert.NoError(t, cc.acquire("192.0.2.1", limits))
+	assert.Error(t, cc.acquire("192.0.2.1", limits))
+	assert.NoError(t, cc.acquire("192.0.2.2", limits))
+	assert.Error(t, cc.acquire("192.0.2.3", limits))
+	cc.release("192.0.2.1")
+	assert.NoError(t, cc.acquire("192.0.2.3", limits))
+	assert.NoError(t, cc.acquire("192.0.2.4", ConnectionLimits{}))
+
+	assert.Equal(t, "192.0.2.1", remoteIP(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}))
+	assert.Equal(t, "2001:db8::1", remoteIP(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22}))
+}
@@ -0,0 +1,1382 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// e2eEnv runs the proxy in front of a FakeS3, or of the local backend, and
+// connects to it over SFTP with pkg/sftp as the client.  The bucket config
+// is given in TOML so that the tests go through the same code path as the
+// real configuration; the S3 backends are pointed to the fake afterwards.
+type e2eEnv struct {
+	T       *testing.T
+	S3      *FakeS3
+	Dir     string
+	Server  *Server
+	Client  *sftp.Client
+	sshConn *ssh.Client
+	addr    string
+	addrs   map[string]string
+	sshCfg  *ssh.ClientConfig
+	cancel  context.CancelFunc
+	errChan chan error
+}
+
+const e2eBucket = "bucket"
+
+func e2eWritePEM(t *testing.T, p string, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newE2EEnv starts the proxy with the bucket config, which is placed under
+// "[buckets.test]", and logs in as "user".
+func newE2EEnv(t *testing.T, bucketCfg string) *e2eEnv {
+	return newE2EEnvWithS3(t, NewFakeS3(e2eBucket), bucketCfg)
+}
+
+// newE2EEnvWithS3 is newE2EEnv with the FakeS3 created in advance.  The S3
+// backends with an endpoint in the config are left as they are.
+func newE2EEnvWithS3(t *testing.T, fs3 *FakeS3, bucketCfg string) *e2eEnv {
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &e2eEnv{T: t, S3: fs3, Dir: dir}
+
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2eWritePEM(t, filepath.Join(dir, "host_key"), hostKey)
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgFile := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(cfgFile, []byte(`
+host_key_file = "`+filepath.Join(dir, "host_key")+`"
+
+[buckets.test]
+auth = "test"
+`+bucketCfg+`
+
+[auth.test]
+type = "inplace"
+
+[auth.test.users.user]
+public_keys = "`+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(clientSigner.PublicKey())))+`"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := NewSessionRegistry()
+	cfg, buckets, listeners, err := loadConfig(cfgFile, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.useFakeS3(buckets)
+
+	logger := logrus.New()
+	if !testing.Verbose() {
+		logger.Out = ioutil.Discard
+	} else {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	env.Server = &Server{
+		S3Buckets:                buckets,
+		Listeners:                listeners,
+		Log:                      logger,
+		ReaderLookbackBufferSize: *cfg.ReaderLookbackBufferSize,
+		ReaderMinChunkSize:       *cfg.ReaderMinChunkSize,
+		ListerLookbackBufferSize: *cfg.ListerLookbackBufferSize,
+		PhantomObjectMap:         NewPhantomObjectMap(),
+		Uploads:                  NewUploadTracker(),
+		Sessions:                 sessions,
+		Now:                      time.Now,
+	}
+	var ctx context.Context
+	ctx, env.cancel = context.WithCancel(context.Background())
+	// every listener listens on a port of its own, and the first one in
+	// the order of the names is connected to
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env.addrs = map[string]string{}
+	env.errChan = make(chan error, len(names))
+	for _, name := range names {
+		lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(name string) {
+			env.errChan <- env.Server.RunListenerEventLoop(ctx, name, lsnr.(*net.TCPListener))
+		}(name)
+		env.addrs[name] = lsnr.Addr().String()
+	}
+
+	env.addr = env.addrs[names[0]]
+	env.sshCfg = &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	env.sshConn, err = env.Dial()
+	if err != nil {
+		env.Close()
+		t.Fatal(err)
+	}
+	env.Client, err = sftp.NewClient(env.sshConn)
+	if err != nil {
+		env.Close()
+		t.Fatal(err)
+	}
+	return env
+}
+
+// useFakeS3 points the S3 backends without an endpoint in the config to the
+// FakeS3.
+func (env *e2eEnv) useFakeS3(buckets *S3Buckets) {
+	for _, bucket := range buckets.Buckets {
+		if sb, ok := bucket.Backend.(*S3Backend); ok && sb.AWSConfig.Endpoint == nil {
+			sb.AWSConfig = env.S3.AWSConfig()
+		}
+	}
+}
+
+// Dial makes another connection to the proxy as "user".
+func (env *e2eEnv) Dial() (*ssh.Client, error) {
+	return ssh.Dial("tcp", env.addr, env.sshCfg)
+}
+
+func (env *e2eEnv) Close() {
+	if env.Client != nil {
+		env.Client.Close()
+	}
+	if env.sshConn != nil {
+		env.sshConn.Close()
+	}
+	env.cancel()
+	for range env.addrs {
+		<-env.errChan
+	}
+	env.S3.Close()
+	os.RemoveAll(env.Dir)
+}
+
+func (env *e2eEnv) WriteFile(p string, data []byte) error {
+	f, err := env.Client.Create(p)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (env *e2eEnv) ReadFile(p string) ([]byte, error) {
+	f, err := env.Client.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// ReadDir returns the names in the directory except for "." and "..".
+func (env *e2eEnv) ReadDir(p string) ([]string, error) {
+	fis, err := env.Client.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, fi := range fis {
+		if fi.Name() != "." && fi.Name() != ".." {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// e2eRawSFTP speaks SFTP over a channel of its own with the packets built
+// by hand, for the extensions pkg/sftp does not send.
+type e2eRawSFTP struct {
+	sess *ssh.Session
+	w    io.Writer
+	r    io.Reader
+	id   uint32
+}
+
+// rawSFTP opens another SFTP channel on the connection of env.Client.
+func (env *e2eEnv) rawSFTP() (*e2eRawSFTP, error) {
+	sess, err := env.sshConn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	rs := &e2eRawSFTP{sess: sess}
+	rs.w, err = sess.StdinPipe()
+	if err == nil {
+		rs.r, err = sess.StdoutPipe()
+	}
+	if err == nil {
+		err = sess.RequestSubsystem("sftp")
+	}
+	if err == nil {
+		// SSH_FXP_INIT
+		_, err = rs.w.Write(sftpPacket([]byte{1, 0, 0, 0, 3}))
+	}
+	if err == nil {
+		_, err = rs.readPacket()
+	}
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *e2eRawSFTP) Close() error {
+	return rs.sess.Close()
+}
+
+func (rs *e2eRawSFTP) readPacket() (*sftpPacketDecoder, error) {
+	var hdr [4]byte
+	_, err := io.ReadFull(rs.r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	_, err = io.ReadFull(rs.r, body)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpPacketDecoder{b: body}, nil
+}
+
+// request sends the request of the type with the body that follows the ID,
+// and returns the type of the response and the decoder positioned after
+// its ID.
+func (rs *e2eRawSFTP) request(typ byte, body []byte) (byte, *sftpPacketDecoder, error) {
+	rs.id++
+	_, err := rs.w.Write(sftpPacket(append(appendUint32([]byte{typ}, rs.id), body...)))
+	if err != nil {
+		return 0, nil, err
+	}
+	d, err := rs.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	respTyp := d.byte()
+	if id := d.uint32(); d.err == nil && id != rs.id {
+		return 0, nil, fmt.Errorf("unexpected response ID %d", id)
+	}
+	return respTyp, d, d.err
+}
+
+// status sends the request to which the server replies with a status, and
+// returns the error if it is not SSH_FX_OK.
+func (rs *e2eRawSFTP) status(typ byte, body []byte) error {
+	respTyp, d, err := rs.request(typ, body)
+	if err != nil {
+		return err
+	}
+	if respTyp != sshFxpStatus {
+		return fmt.Errorf("unexpected packet type %d", respTyp)
+	}
+	code := d.uint32()
+	msg := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if code != sshFxOk {
+		return fmt.Errorf("request failed: %s", msg)
+	}
+	return nil
+}
+
+// Open opens the file with the SSH_FXF_* flags and returns the handle.
+func (rs *e2eRawSFTP) Open(p string, pflags uint32) (string, error) {
+	body := appendSSHString(nil, p)
+	body = appendUint32(body, pflags)
+	body = appendUint32(body, 0)
+	typ, d, err := rs.request(sshFxpOpen, body)
+	if err != nil {
+		return "", err
+	}
+	if typ == sshFxpStatus {
+		d.uint32()
+		return "", fmt.Errorf("open failed: %s", d.string())
+	}
+	if typ != sshFxpHandle {
+		return "", fmt.Errorf("unexpected packet type %d", typ)
+	}
+	handle := d.string()
+	return handle, d.err
+}
+
+func (rs *e2eRawSFTP) CloseHandle(handle string) error {
+	return rs.status(sshFxpClose, appendSSHString(nil, handle))
+}
+
+// CopyFile sends the copy-file extended request.
+func (rs *e2eRawSFTP) CopyFile(src, dest string, overwrite bool) error {
+	body := appendSSHString(nil, "copy-file")
+	body = appendSSHString(body, src)
+	body = appendSSHString(body, dest)
+	if overwrite {
+		body = append(body, 1)
+	} else {
+		body = append(body, 0)
+	}
+	return rs.status(sshFxpExtended, body)
+}
+
+// CopyData sends the copy-data extended request.
+func (rs *e2eRawSFTP) CopyData(readHandle string, readOffset, length uint64, writeHandle string, writeOffset uint64) error {
+	body := appendSSHString(nil, "copy-data")
+	body = appendSSHString(body, readHandle)
+	body = appendUint64(body, readOffset)
+	body = appendUint64(body, length)
+	body = appendSSHString(body, writeHandle)
+	body = appendUint64(body, writeOffset)
+	return rs.status(sshFxpExtended, body)
+}
+
+// CopyFile copies the file with the copy-file extension, which pkg/sftp
+// does not support.
+func (env *e2eEnv) CopyFile(src, dest string, overwrite bool) error {
+	rs, err := env.rawSFTP()
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	return rs.CopyFile(src, dest, overwrite)
+}
+
+// headers returns the header of the requests S3 has received for the key
+// with the method.
+func (env *e2eEnv) headers(method, key string) []string {
+	retval := []string{}
+	for _, req := range env.S3.Requests() {
+		if req.Method == method && req.URL.Path == "/"+e2eBucket+"/"+key && req.URL.RawQuery == "" {
+			retval = append(retval, req.Header.Get("X-Amz-Server-Side-Encryption"))
+			retval = append(retval, req.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+		}
+	}
+	return retval
+}
+
+func TestE2EUploadAndRead(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+key_prefix = "prefix"`)
+	defer env.Close()
+
+	data := make([]byte, 3*1048576+17)
+	rand.Read(data)
+	assert.NoError(t, env.WriteFile("/dir/file.bin", data))
+	obj := env.S3.GetObject(e2eBucket, "prefix/dir/file.bin")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, data, obj.Data)
+	}
+
+	fi, err := env.Client.Stat("/dir/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size())
+
+	read, err := env.ReadFile("/dir/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	_, err = env.Client.Stat("/missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestE2EListing(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+key_prefix = "prefix"`)
+	defer env.Close()
+	env.S3.PutObject(e2eBucket, "prefix/a.txt", []byte("a"), nil)
+	env.S3.PutObject(e2eBucket, "prefix/sub/b.txt", []byte("b"), nil)
+	env.S3.PutObject(e2eBucket, "other/c.txt", []byte("c"), nil)
+
+	names, err := env.ReadDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "sub"}, names)
+
+	fi, err := env.Client.Stat("/sub")
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+
+	names, err = env.ReadDir("/sub")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.txt"}, names)
+}
+
+func TestE2ERenameAndRemove(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+key_prefix = "prefix"`)
+	defer env.Close()
+	env.S3.PutObject(e2eBucket, "prefix/a.txt", []byte("a"), nil)
+
+	assert.NoError(t, env.Client.Rename("/a.txt", "/sub/b.txt"))
+	assert.Equal(t, []string{"prefix/sub/b.txt"}, env.S3.Keys(e2eBucket))
+
+	assert.NoError(t, env.CopyFile("/sub/b.txt", "/c.txt", false))
+	assert.Equal(t, []string{"prefix/c.txt", "prefix/sub/b.txt"}, env.S3.Keys(e2eBucket))
+	assert.Error(t, env.CopyFile("/sub/b.txt", "/c.txt", false))
+
+	assert.NoError(t, env.Client.Remove("/sub/b.txt"))
+	assert.NoError(t, env.Client.Remove("/c.txt"))
+	assert.Equal(t, []string{}, env.S3.Keys(e2eBucket))
+}
+
+func TestE2EPermissions(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+writable = false
+listable = false`)
+	defer env.Close()
+	env.S3.PutObject(e2eBucket, "a.txt", []byte("a"), nil)
+
+	read, err := env.ReadFile("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), read)
+
+	assert.Error(t, env.WriteFile("/b.txt", []byte("b")))
+	assert.Error(t, env.Client.Rename("/a.txt", "/b.txt"))
+	assert.Error(t, env.CopyFile("/a.txt", "/b.txt", true))
+	assert.Error(t, env.Client.Remove("/a.txt"))
+	_, err = env.Client.ReadDir("/")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a.txt"}, env.S3.Keys(e2eBucket))
+}
+
+func TestE2EServerSideEncryptionKMS(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+server_side_encryption = "kms"
+sse_kms_key_id = "key-id"`)
+	defer env.Close()
+
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	assert.NoError(t, env.Client.Rename("/a.txt", "/b.txt"))
+	obj := env.S3.GetObject(e2eBucket, "b.txt")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, "aws:kms", obj.Headers.Get("X-Amz-Server-Side-Encryption"))
+		assert.Equal(t, "key-id", obj.Headers.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	}
+}
+
+func TestE2EServerSideEncryptionS3(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+server_side_encryption = "sse-s3"`)
+	defer env.Close()
+
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	read, err := env.ReadFile("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), read)
+	assert.Equal(t, []string{"AES256", "", "", ""}, append(env.headers("PUT", "a.txt"), env.headers("GET", "a.txt")...))
+	obj := env.S3.GetObject(e2eBucket, "a.txt")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, "AES256", obj.Headers.Get("X-Amz-Server-Side-Encryption"))
+	}
+}
+
+func TestE2EServerSideEncryptionCustomerKey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	for _, typ := range []string{"sse-c", "aes256"} {
+		env := newE2EEnv(t, `bucket = "bucket"
+server_side_encryption = "`+typ+`"
+sse_customer_key = "`+key+`"`)
+
+		assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+		read, err := env.ReadFile("/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("a"), read)
+		assert.Equal(t, []string{"", "AES256", "", "AES256"}, append(env.headers("PUT", "a.txt"), env.headers("GET", "a.txt")...))
+		_, err = env.Client.Stat("/a.txt")
+		assert.NoError(t, err)
+		assert.Contains(t, env.headers("HEAD", "a.txt"), "AES256")
+
+		assert.NoError(t, env.Client.Rename("/a.txt", "/b.txt"))
+		for _, req := range env.S3.Requests() {
+			if req.Method == "PUT" && req.URL.Path == "/"+e2eBucket+"/b.txt" {
+				assert.Equal(t, "AES256", req.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+				assert.Equal(t, "AES256", req.Header.Get("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Algorithm"))
+				assert.NotEmpty(t, req.Header.Get("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key"))
+			}
+		}
+		env.Close()
+	}
+}
+
+// e2eWriteCABundle writes the certificate of the FakeS3 to a file, which is
+// to be removed by the caller.
+func e2eWriteCABundle(t *testing.T, fs3 *FakeS3) string {
+	f, err := ioutil.TempFile("", "s3-sftp-proxy-e2e-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fs3.Server.Certificate().Raw}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestE2ECustomEndpoint(t *testing.T) {
+	fs3 := NewFakeS3(e2eBucket)
+	caBundle := e2eWriteCABundle(t, fs3)
+	defer os.Remove(caBundle)
+
+	env := newE2EEnvWithS3(t, fs3, `bucket_url = "`+fs3.Server.URL+`/bucket/prefix"
+ca_bundle = "`+caBundle+`"
+signature_version = "v2"
+
+[buckets.test.credentials]
+aws_access_key_id = "AKID"
+aws_secret_access_key = "SECRET"`)
+	defer env.Close()
+
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	read, err := env.ReadFile("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), read)
+	assert.Equal(t, []string{"prefix/a.txt"}, env.S3.Keys(e2eBucket))
+	for _, req := range env.S3.Requests() {
+		assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "AWS AKID:"))
+	}
+}
+
+// assertAssumedCredentials checks that the S3 requests are signed with the
+// credentials given by STS.
+func (env *e2eEnv) assertAssumedCredentials() {
+	for _, req := range env.S3.Requests() {
+		if req.URL.Path == "/" {
+			continue
+		}
+		assert.Contains(env.T, req.Header.Get("Authorization"), "Credential="+FakeSTSCredentials.AccessKeyID+"/")
+		assert.Equal(env.T, FakeSTSCredentials.SessionToken, req.Header.Get("X-Amz-Security-Token"))
+	}
+}
+
+func TestE2EAssumeRole(t *testing.T) {
+	fs3 := NewFakeS3(e2eBucket)
+	caBundle := e2eWriteCABundle(t, fs3)
+	defer os.Remove(caBundle)
+
+	env := newE2EEnvWithS3(t, fs3, `bucket_url = "`+fs3.Server.URL+`/bucket"
+ca_bundle = "`+caBundle+`"
+role_arn = "arn:aws:iam::123456789012:role/sftp"
+external_id = "customer"
+sts_endpoint = "`+fs3.Server.URL+`"
+
+[buckets.test.credentials]
+aws_access_key_id = "AKID"
+aws_secret_access_key = "SECRET"`)
+	defer env.Close()
+
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	stsReqs := env.S3.STSRequests()
+	if assert.Len(t, stsReqs, 1) {
+		assert.Equal(t, "AssumeRole", stsReqs[0].Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/sftp", stsReqs[0].Get("RoleArn"))
+		assert.Equal(t, "customer", stsReqs[0].Get("ExternalId"))
+		assert.Equal(t, "s3-sftp-proxy", stsReqs[0].Get("RoleSessionName"))
+	}
+	env.assertAssumedCredentials()
+}
+
+func TestE2EWebIdentity(t *testing.T) {
+	fs3 := NewFakeS3(e2eBucket)
+	caBundle := e2eWriteCABundle(t, fs3)
+	defer os.Remove(caBundle)
+	tokenFile := caBundle + ".token"
+	if err := ioutil.WriteFile(tokenFile, []byte("oidc-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile)
+
+	env := newE2EEnvWithS3(t, fs3, `bucket_url = "`+fs3.Server.URL+`/bucket"
+ca_bundle = "`+caBundle+`"
+role_arn = "arn:aws:iam::123456789012:role/sftp"
+role_session_name = "session"
+web_identity_token_file = "`+tokenFile+`"
+sts_endpoint = "`+fs3.Server.URL+`"`)
+	defer env.Close()
+
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	stsReqs := env.S3.STSRequests()
+	if assert.Len(t, stsReqs, 1) {
+		assert.Equal(t, "AssumeRoleWithWebIdentity", stsReqs[0].Get("Action"))
+		assert.Equal(t, "oidc-token", stsReqs[0].Get("WebIdentityToken"))
+		assert.Equal(t, "session", stsReqs[0].Get("RoleSessionName"))
+	}
+	env.assertAssumedCredentials()
+}
+
+func TestE2ESessionPolicy(t *testing.T) {
+	fs3 := NewFakeS3(e2eBucket)
+	caBundle := e2eWriteCABundle(t, fs3)
+	defer os.Remove(caBundle)
+
+	env := newE2EEnvWithS3(t, fs3, `bucket_url = "`+fs3.Server.URL+`/bucket/tenants/user"
+ca_bundle = "`+caBundle+`"
+role_arn = "arn:aws:iam::123456789012:role/sftp"
+sts_endpoint = "`+fs3.Server.URL+`"
+session_policy = true
+
+[buckets.test.credentials]
+aws_access_key_id = "AKID"
+aws_secret_access_key = "SECRET"`)
+	defer env.Close()
+
+	stsReqs := env.S3.STSRequests()
+	if assert.Len(t, stsReqs, 1) {
+		assert.Equal(t, "AssumeRole", stsReqs[0].Get("Action"))
+		assert.Equal(t, "s3-sftp-proxy@user", stsReqs[0].Get("RoleSessionName"))
+		assert.Contains(t, stsReqs[0].Get("Policy"), `"arn:aws:s3:::bucket/tenants/user/*"`)
+	}
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	assert.Len(t, env.S3.STSRequests(), 1)
+	env.assertAssumedCredentials()
+}
+
+func TestE2EClientSideEncryption(t *testing.T) {
+	keyFile, err := ioutil.TempFile("", "s3-sftp-proxy-e2e-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	keyFile.Close()
+	env := newE2EEnv(t, `bucket = "bucket"
+client_side_encryption_key_file = "`+keyFile.Name()+`"`)
+	defer env.Close()
+
+	data := make([]byte, 200000)
+	rand.Read(data)
+	assert.NoError(t, env.WriteFile("/a.bin", data))
+	obj := env.S3.GetObject(e2eBucket, "a.bin")
+	if assert.NotNil(t, obj) {
+		assert.NotEqual(t, data, obj.Data[:len(data)])
+		assert.Contains(t, obj.Metadata, cseKeyMetadataKey)
+	}
+
+	fi, err := env.Client.Stat("/a.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size())
+	fis, err := env.Client.ReadDir("/")
+	assert.NoError(t, err)
+	for _, fi := range fis {
+		if fi.Name() == "a.bin" {
+			assert.Equal(t, int64(len(data)), fi.Size())
+		}
+	}
+
+	read, err := env.ReadFile("/a.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	f, err := env.Client.Open("/a.bin")
+	if assert.NoError(t, err) {
+		buf := make([]byte, 100)
+		_, err = f.ReadAt(buf, 150000)
+		assert.NoError(t, err)
+		assert.Equal(t, data[150000:150100], buf)
+		f.Close()
+	}
+
+	assert.NoError(t, env.Client.Symlink("/a.bin", "/link"))
+	target, err := env.Client.ReadLink("/link")
+	assert.NoError(t, err)
+	assert.Equal(t, "/a.bin", target)
+}
+
+func TestE2EQuota(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+key_prefix = "prefix"
+quota_bytes = 1048576
+user_quota_objects = 2`)
+	defer env.Close()
+	env.S3.PutObject(e2eBucket, "prefix/a.bin", make([]byte, 409600), nil)
+	bucket := env.Server.S3Buckets.Get("test")
+	assert.NoError(t, bucket.Quota.Scan(context.Background(), bucket.Backend, bucket.KeyPrefix))
+
+	st, err := env.Client.StatVFS("/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(256), st.Blocks)
+		assert.Equal(t, uint64(156), st.Bavail)
+		assert.Equal(t, uint64(2), st.Files)
+		assert.Equal(t, uint64(2), st.Favail)
+	}
+
+	err = env.WriteFile("/b.bin", make([]byte, 700000))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "quota exceeded")
+	}
+	assert.Nil(t, env.S3.GetObject(e2eBucket, "prefix/b.bin"))
+
+	assert.NoError(t, env.WriteFile("/c.txt", []byte("c")))
+	obj := env.S3.GetObject(e2eBucket, "prefix/c.txt")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, "user", obj.Metadata[ownerMetadataKey])
+	}
+	assert.NoError(t, env.WriteFile("/d.txt", []byte("d")))
+	// overwriting does not take up another object
+	assert.NoError(t, env.WriteFile("/d.txt", []byte("dd")))
+	assert.Error(t, env.WriteFile("/e.txt", []byte("e")))
+
+	st, err = env.Client.StatVFS("/")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(0), st.Favail)
+	}
+	assert.NoError(t, env.Client.Remove("/c.txt"))
+	assert.NoError(t, env.WriteFile("/e.txt", []byte("e")))
+}
+
+func TestE2EConnectionLimits(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"`)
+	defer env.Close()
+
+	env.Server.SetLimits(ConnectionLimits{MaxChannelsPerConnection: 1})
+	conn, err := env.Dial()
+	if assert.NoError(t, err) {
+		client, err := sftp.NewClient(conn)
+		assert.NoError(t, err)
+		_, err = sftp.NewClient(conn)
+		assert.Error(t, err)
+		client.Close()
+		conn.Close()
+	}
+
+	env.Server.SetLimits(ConnectionLimits{MaxSessionsPerUser: 1})
+	conn, err = env.Dial()
+	if err == nil {
+		_, err = sftp.NewClient(conn)
+		conn.Close()
+	}
+	assert.Error(t, err)
+
+	env.Server.SetLimits(ConnectionLimits{MaxConnectionsPerIP: 1})
+	_, err = env.Dial()
+	assert.Error(t, err)
+
+	// the connection established before is not affected
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+}
+
+func TestE2ELoginGraceTime(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"`)
+	defer env.Close()
+	// the connection of env.Client takes one of the slots
+	env.Server.SetLimits(ConnectionLimits{MaxConnectionsPerIP: 2, LoginGraceTime: 200 * time.Millisecond})
+
+	// the client that never starts the handshake is disconnected
+	idle, err := net.Dial("tcp", env.addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(idle)
+	assert.NoError(t, err)
+
+	// and the slot is given back
+	var conn *ssh.Client
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		conn, err = env.Dial()
+		if err == nil {
+			break
+		}
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// the connection logged in is not affected
+	time.Sleep(300 * time.Millisecond)
+	client, err := sftp.NewClient(conn)
+	if assert.NoError(t, err) {
+		_, err = client.ReadDir("/")
+		assert.NoError(t, err)
+		client.Close()
+	}
+}
+
+func TestE2ESessionTimeouts(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"`)
+	defer env.Close()
+	defer func(d time.Duration) { sessionCheckInterval = d }(sessionCheckInterval)
+	sessionCheckInterval = 10 * time.Millisecond
+
+	for _, limits := range []ConnectionLimits{
+		{IdleTimeout: 200 * time.Millisecond, KeepaliveInterval: 50 * time.Millisecond, KeepaliveCountMax: 1},
+		{MaxSessionDuration: 200 * time.Millisecond},
+	} {
+		env.Server.SetLimits(limits)
+		conn, err := env.Dial()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		client, err := sftp.NewClient(conn)
+		if assert.NoError(t, err) {
+			f, err := client.Create("/partial.bin")
+			if assert.NoError(t, err) {
+				_, err = f.Write([]byte("partial"))
+				assert.NoError(t, err)
+			}
+			// the keepalive probes do not keep the session from idling;
+			// the server closes the connection in the end
+			conn.Wait()
+			client.Close()
+		}
+		conn.Close()
+		assert.Nil(t, env.S3.GetObject(e2eBucket, "partial.bin"))
+		assert.Equal(t, 0, env.Server.PhantomObjectMap.Size())
+	}
+
+	// the session in use is not affected
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+}
+
+func TestE2ELocalBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy-e2e-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	env := newE2EEnv(t, `backend = "local"
+local_root = "`+root+`"
+key_prefix = "prefix"`)
+	defer env.Close()
+
+	assert.NoError(t, env.WriteFile("/dir/a.txt", []byte("a")))
+	b, err := ioutil.ReadFile(filepath.Join(root, "prefix", "dir", "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), b)
+
+	assert.NoError(t, env.Client.Rename("/dir/a.txt", "/b.txt"))
+	names, err := env.ReadDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.txt"}, names)
+
+	read, err := env.ReadFile("/b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), read)
+	assert.Empty(t, env.S3.Requests())
+}
+
+func TestE2EListeners(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+
+[buckets.other]
+backend = "local"
+local_root = "`+os.TempDir()+`"
+auth = "other"
+
+[auth.other]
+type = "inplace"
+
+[auth.other.users.someone]
+password = "secret"
+
+[listeners.a-internal]
+bind = "127.0.0.1:0"
+banner = "internal"
+
+[listeners.b-public]
+bind = "127.0.0.1:0"
+auth_methods = ["publickey"]
+buckets = ["other"]
+
+[listeners.c-password]
+bind = "127.0.0.1:0"
+auth_methods = ["password"]
+`)
+	defer env.Close()
+
+	banner := ""
+	sshCfg := *env.sshCfg
+	sshCfg.BannerCallback = func(message string) error {
+		banner = message
+		return nil
+	}
+	conn, err := ssh.Dial("tcp", env.addrs["a-internal"], &sshCfg)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, "internal\n", banner)
+
+	// the bucket of the user is not served on the listener
+	_, err = ssh.Dial("tcp", env.addrs["b-public"], env.sshCfg)
+	assert.Error(t, err)
+
+	// public keys are not accepted on the listener
+	_, err = ssh.Dial("tcp", env.addrs["c-password"], env.sshCfg)
+	assert.Error(t, err)
+	passwordCfg := &ssh.ClientConfig{
+		User:            "someone",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	conn, err = ssh.Dial("tcp", env.addrs["c-password"], passwordCfg)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	_, err = ssh.Dial("tcp", env.addrs["b-public"], passwordCfg)
+	assert.Error(t, err)
+}
+
+func TestE2EHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths, certPath, ca := writeTestHostKeys(t, dir)
+	env := newE2EEnv(t, `bucket = "bucket"
+
+[listeners.test]
+bind = "127.0.0.1:0"
+host_key_files = ["`+strings.Join(paths, `", "`)+`"]
+host_certificate_files = ["`+certPath+`"]
+`)
+	defer env.Close()
+
+	// the host is trusted by the certificate
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return string(auth.Marshal()) == string(ca.PublicKey().Marshal())
+		},
+	}
+	sshCfg := *env.sshCfg
+	sshCfg.HostKeyCallback = checker.CheckHostKey
+	sshCfg.HostKeyAlgorithms = []string{ssh.CertAlgoED25519v01}
+	netConn, err := net.Dial("tcp", env.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, reqs, err := ssh.NewClientConn(netConn, env.addr, &sshCfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// all the keys are announced, and can be proven
+	req := <-reqs
+	if assert.NotNil(t, req) && assert.Equal(t, hostKeysRequest, req.Type) {
+		ok, sigs, err := conn.SendRequest(hostKeysProveRequest, true, req.Payload)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.NotEmpty(t, sigs)
+	}
+
+	// the other algorithms are served with the plain keys
+	hk, err := ReadHostKeys(paths, nil, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	sshCfg = *env.sshCfg
+	sshCfg.HostKeyCallback = ssh.FixedHostKey(hk.Keys[1].PublicKey())
+	sshCfg.HostKeyAlgorithms = []string{ssh.KeyAlgoECDSA256}
+	client, err := ssh.Dial("tcp", env.addr, &sshCfg)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+}
+
+func TestE2ESSHAlgorithms(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"`)
+	defer env.Close()
+
+	// the config has been read with the modern preset
+	sshCfg := *env.sshCfg
+	sshCfg.Ciphers = []string{ssh.InsecureCipherAES128CBC}
+	_, err := ssh.Dial("tcp", env.addr, &sshCfg)
+	assert.Error(t, err)
+	sshCfg = *env.sshCfg
+	sshCfg.MACs = []string{ssh.HMACSHA1}
+	sshCfg.Ciphers = []string{ssh.CipherAES128CTR}
+	_, err = ssh.Dial("tcp", env.addr, &sshCfg)
+	assert.Error(t, err)
+	sshCfg.MACs = []string{ssh.HMACSHA256ETM}
+	client, err := ssh.Dial("tcp", env.addr, &sshCfg)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+}
+
+func TestE2EBanners(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+quota_bytes = 1048576
+banner = "Hello, {{.User}}"
+login_message = "{{.Bucket}}{{with .Quota}}: {{bytes .RemainingBytes}} left{{end}}"
+
+[buckets.other]
+backend = "local"
+local_root = "`+os.TempDir()+`"
+auth = "other"
+
+[auth.other]
+type = "inplace"
+
+[auth.other.users.someone]
+password = "secret"
+
+[listeners.default]
+bind = "127.0.0.1:0"
+banner = "{{.User}} on {{.Listener}}"
+`)
+	defer env.Close()
+
+	dial := func(sshCfg ssh.ClientConfig) []string {
+		var banners []string
+		sshCfg.BannerCallback = func(message string) error {
+			banners = append(banners, message)
+			return nil
+		}
+		conn, err := ssh.Dial("tcp", env.addr, &sshCfg)
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		return banners
+	}
+
+	// the quota is unknown until scanned
+	assert.Equal(t, []string{"Hello, user\n", "test\n"}, dial(*env.sshCfg))
+	bucket := env.Server.S3Buckets.Get("test")
+	assert.NoError(t, bucket.Quota.Scan(context.Background(), bucket.Backend, bucket.KeyPrefix))
+	assert.Equal(t, []string{"Hello, user\n", "test: 1.0 MiB left\n"}, dial(*env.sshCfg))
+
+	assert.Equal(t, []string{"someone on default\n"}, dial(ssh.ClientConfig{
+		User:            "someone",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}))
+}
+
+func TestE2EReload(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"`)
+	defer env.Close()
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+
+	cfgFile := filepath.Join(env.Dir, "config.toml")
+	b, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(cfgFile, append([]byte("reader_lookback_buffer_size = 2097152\n"), append(b, []byte(`
+[auth.test.users.newcomer]
+password = "secret"
+`)...)...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newcomerCfg := &ssh.ClientConfig{
+		User:            "newcomer",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}
+	_, err = ssh.Dial("tcp", env.addr, newcomerCfg)
+	assert.Error(t, err)
+
+	cfg, buckets, listeners, err := loadConfig(cfgFile, env.Server.Sessions)
+	if !assert.NoError(t, err) {
+		return
+	}
+	env.useFakeS3(buckets)
+	env.Server.Reconfigure(buckets, listeners)
+	env.Server.SetBufferSizes(*cfg.ReaderLookbackBufferSize, *cfg.ReaderMinChunkSize, *cfg.ListerLookbackBufferSize)
+	assert.Equal(t, 2097152, env.Server.ReaderLookbackBufferSize)
+
+	conn, err := ssh.Dial("tcp", env.addr, newcomerCfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	f, err := client.Open("/a.txt")
+	if assert.NoError(t, err) {
+		read, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("a"), read)
+		f.Close()
+	}
+
+	// the existing connection keeps working
+	read, err := env.ReadFile("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), read)
+}
+
+func TestE2EBlockedUser(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"`)
+	defer env.Close()
+
+	// the user never authenticates
+	env.Server.Sessions.Block("user")
+	_, err := env.Dial()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to authenticate")
+	}
+	env.Server.Sessions.Unblock("user")
+	conn, err := env.Dial()
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+func TestE2EQuotaCopy(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+user_quota_objects = 2`)
+	defer env.Close()
+	env.S3.PutObject(e2eBucket, "a.txt", []byte("a"), map[string]string{ownerMetadataKey: "other"})
+	env.S3.PutObject(e2eBucket, "b.txt", []byte("b"), map[string]string{"k": "v"})
+	bucket := env.Server.S3Buckets.Get("test")
+	assert.NoError(t, bucket.Quota.Scan(context.Background(), bucket.Backend, bucket.KeyPrefix))
+
+	// the copies belong to the user whoever owns the sources
+	assert.NoError(t, env.CopyFile("/a.txt", "/c.txt", false))
+	assert.NoError(t, env.CopyFile("/b.txt", "/d.txt", false))
+	obj := env.S3.GetObject(e2eBucket, "d.txt")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, map[string]string{"k": "v", ownerMetadataKey: "user"}, obj.Metadata)
+	}
+	_, userUsage := bucket.Quota.Usage("user")
+	assert.Equal(t, int64(2), userUsage.Objects)
+	_, otherUsage := bucket.Quota.Usage("other")
+	assert.Equal(t, int64(1), otherUsage.Objects)
+	assert.Error(t, env.CopyFile("/a.txt", "/e.txt", false))
+	assert.Nil(t, env.S3.GetObject(e2eBucket, "e.txt"))
+
+	// the usage survives a scan
+	assert.NoError(t, bucket.Quota.Scan(context.Background(), bucket.Backend, bucket.KeyPrefix))
+	_, userUsage = bucket.Quota.Usage("user")
+	assert.Equal(t, int64(2), userUsage.Objects)
+}
+
+func TestE2EQuotaReload(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "bucket"
+user_quota_objects = 1`)
+	defer env.Close()
+	bucket := env.Server.S3Buckets.Get("test")
+	assert.NoError(t, bucket.Quota.Scan(context.Background(), bucket.Backend, bucket.KeyPrefix))
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("a")))
+	assert.Error(t, env.WriteFile("/b.txt", []byte("b")))
+
+	cfgFile := filepath.Join(env.Dir, "config.toml")
+	b, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(cfgFile, []byte(strings.Replace(string(b), "user_quota_objects = 1", "user_quota_objects = 2", 1)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, buckets, listeners, err := loadConfig(cfgFile, env.Server.Sessions)
+	if !assert.NoError(t, err) {
+		return
+	}
+	env.useFakeS3(buckets)
+	env.Server.Reconfigure(buckets, listeners)
+	// the usage is carried over to the new config without another scan
+	assert.Same(t, bucket.Quota, buckets.Get("test").Quota)
+	_, userUsage := bucket.Quota.Usage("user")
+	assert.Equal(t, int64(1), userUsage.Objects)
+
+	conn, err := env.Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	f, err := client.Create("/b.txt")
+	if assert.NoError(t, err) {
+		_, err = f.Write([]byte("b"))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	// neither the new connection nor the one made before the reload may
+	// exceed the new quota
+	f, err = client.Create("/c.txt")
+	if err == nil {
+		_, err = f.Write([]byte("c"))
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	assert.Error(t, err)
+	assert.Error(t, env.WriteFile("/d.txt", []byte("d")))
+	assert.Nil(t, env.S3.GetObject(e2eBucket, "c.txt"))
+	assert.Nil(t, env.S3.GetObject(e2eBucket, "d.txt"))
+}
+
+func TestE2ECopyData(t *testing.T) {
+	const (
+		sshFxfRead  = 0x01
+		sshFxfWrite = 0x02
+		sshFxfCreat = 0x08
+		sshFxfTrunc = 0x10
+	)
+	env := newE2EEnv(t, `bucket = "bucket"
+key_prefix = "prefix"`)
+	defer env.Close()
+	assert.NoError(t, env.WriteFile("/a.txt", []byte("abc")))
+	assert.NoError(t, env.WriteFile("/b.txt", []byte("b")))
+
+	rs, err := env.rawSFTP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rs.Close()
+	src, err := rs.Open("/a.txt", sshFxfRead)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// b.txt is being uploaded by another channel, into which nothing may
+	// be written through the handle opened for reading
+	f, err := env.Client.Create("/b.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("x"))
+	assert.NoError(t, err)
+	readOnly, err := rs.Open("/b.txt", sshFxfRead)
+	if assert.NoError(t, err) {
+		assert.Error(t, rs.CopyData(src, 0, 0, readOnly, 0))
+		assert.NoError(t, rs.CloseHandle(readOnly))
+	}
+	assert.NoError(t, f.Close())
+	obj := env.S3.GetObject(e2eBucket, "prefix/b.txt")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, []byte("x"), obj.Data)
+	}
+
+	var sess *Session
+	for _, _sess := range env.Server.Sessions.List() {
+		sess = _sess
+	}
+	written := sess.BytesWritten()
+	dest, err := rs.Open("/c.txt", sshFxfWrite|sshFxfCreat|sshFxfTrunc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, rs.CopyData(src, 1, 0, dest, 0))
+	assert.NoError(t, rs.CloseHandle(dest))
+	obj = env.S3.GetObject(e2eBucket, "prefix/c.txt")
+	if assert.NotNil(t, obj) {
+		assert.Equal(t, []byte("bc"), obj.Data)
+	}
+	// the data copied is accounted to the session
+	assert.Equal(t, written+2, sess.BytesWritten())
+
+	// the handle is no longer open for writing once closed
+	assert.Error(t, rs.CopyData(src, 0, 0, dest, 0))
+}
+
+func TestE2EScanner(t *testing.T) {
+	fc := newFakeClamd(t)
+	defer fc.Close()
+	for _, action := range []string{"reject", "quarantine"} {
+		env := newE2EEnv(t, `bucket = "bucket"
+key_prefix = "prefix"
+scanner = "clamd"
+infected_action = "`+action+`"
+quarantine_prefix = "quarantine"
+
+[scanners.clamd]
+type = "clamd"
+url = "tcp://`+fc.lsnr.Addr().String()+`"`)
+
+		// the verdict is recorded along with the clean file
+		assert.NoError(t, env.WriteFile("/clean.txt", []byte("clean")))
+		obj := env.S3.GetObject(e2eBucket, "prefix/clean.txt")
+		if assert.NotNil(t, obj, action) {
+			assert.Equal(t, []byte("clean"), obj.Data)
+			assert.Equal(t, "clamd", obj.Metadata["scan-engine"])
+			assert.Equal(t, "clean", obj.Metadata["scan-status"])
+		}
+
+		// the infected file is refused on close, and never stored where
+		// the client put it
+		err := env.WriteFile("/infected.txt", testMalwarePattern)
+		if assert.Error(t, err, action) {
+			assert.Contains(t, err.Error(), testSignature)
+		}
+		assert.Nil(t, env.S3.GetObject(e2eBucket, "prefix/infected.txt"), action)
+		quarantined := env.S3.GetObject(e2eBucket, "quarantine/prefix/infected.txt")
+		if action == "quarantine" {
+			if assert.NotNil(t, quarantined) {
+				assert.Equal(t, testMalwarePattern, quarantined.Data)
+				assert.Equal(t, "infected", quarantined.Metadata["scan-status"])
+				assert.Equal(t, testSignature, quarantined.Metadata["scan-signature"])
+			}
+			assert.Len(t, env.S3.Keys(e2eBucket), 2)
+		} else {
+			assert.Nil(t, quarantined)
+			assert.Len(t, env.S3.Keys(e2eBucket), 1)
+		}
+		env.Close()
+	}
+}
+
+func TestE2EPutObjectFailure(t *testing.T) {
+	env := newE2EEnv(t, `bucket = "missing"`)
+	defer env.Close()
+	// the client is told that the file has not been stored
+	assert.Error(t, env.WriteFile("/a.txt", []byte("a")))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// ExecContext holds what a command run through an "exec" request has access
+// to.  The files are accessed through the same S3BucketIO that serves SFTP,
+// so the same permissions apply.
+type ExecContext struct {
+	Ctx      context.Context
+	BucketIO *S3BucketIO
+	Args     []string
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Stderr   io.Writer
+}
+
+type ExecHandler func(ec *ExecContext) int
+
+var execHandlers = map[string]ExecHandler{
+	"scp":       runSCP,
+	"md5sum":    md5Checksum.run,
+	"sha1sum":   sha1Checksum.run,
+	"sha256sum": sha256Checksum.run,
+}
+
+// request builds the request as the SFTP server would, which also makes the
+// path absolute and resolves "." and ".." in it.
+func (ec *ExecContext) request(method, p string) *sftp.Request {
+	return sftp.NewRequest(method, p).WithContext(ec.Ctx)
+}
+
+func (ec *ExecContext) Stat(p string) (os.FileInfo, error) {
+	lister, err := ec.BucketIO.Filelist(ec.request("Stat", p))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]os.FileInfo, 1)
+	n, err := lister.ListAt(result, 0)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	return result[0], nil
+}
+
+// ReadDir returns the entries in the directory, except for "." and "..".
+func (ec *ExecContext) ReadDir(p string) ([]os.FileInfo, error) {
+	lister, err := ec.BucketIO.Filelist(ec.request("List", p))
+	if err != nil {
+		return nil, err
+	}
+	retval := []os.FileInfo{}
+	buf := make([]os.FileInfo, 100)
+	o := int64(0)
+	for {
+		n, err := lister.ListAt(buf, o)
+		for _, fi := range buf[:n] {
+			if fi.Name() != "." && fi.Name() != ".." {
+				retval = append(retval, fi)
+			}
+		}
+		o += int64(n)
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return retval, nil
+}
+
+func (ec *ExecContext) Open(p string) (io.ReaderAt, error) {
+	return ec.BucketIO.Fileread(ec.request("Get", p))
+}
+
+func (ec *ExecContext) Create(p string) (io.WriterAt, error) {
+	return ec.BucketIO.Filewrite(ec.request("Put", p))
+}
+
+func closeIfCloser(v interface{}) error {
+	if c, ok := v.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// splitCommandLine splits the command line into words the way a POSIX shell
+// would, only understanding quotes and backslashes.
+func splitCommandLine(cmdLine string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range cmdLine {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune("|&;<>()$`", c):
+			return nil, fmt.Errorf("unsupported shell syntax: %c", c)
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quotation")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func lookupExecHandler(cmdLine string) (ExecHandler, []string, error) {
+	args, err := splitCommandLine(cmdLine)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("empty command")
+	}
+	handler, ok := execHandlers[args[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported command: %s", args[0])
+	}
+	return handler, args, nil
+}
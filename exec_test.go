@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	words, err := splitCommandLine("scp -t /abc")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scp", "-t", "/abc"}, words)
+	words, err = splitCommandLine(`  scp  -r -t -- '/a b'/"c d"\ e  `)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scp", "-r", "-t", "--", "/a b/c d e"}, words)
+	words, err = splitCommandLine(`md5sum '' "a\"b"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"md5sum", "", `a"b`}, words)
+	_, err = splitCommandLine("md5sum 'abc")
+	assert.Error(t, err)
+	_, err = splitCommandLine("md5sum abc; rm -rf /")
+	assert.Error(t, err)
+	_, err = splitCommandLine("md5sum $(cat abc)")
+	assert.Error(t, err)
+}
+
+func TestLookupExecHandler(t *testing.T) {
+	_, args, err := lookupExecHandler("scp -f abc")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scp", "-f", "abc"}, args)
+	_, _, err = lookupExecHandler("sh -c 'scp -f abc'")
+	assert.Error(t, err)
+	_, _, err = lookupExecHandler("")
+	assert.Error(t, err)
+}
+
+func TestParseSCPArgs(t *testing.T) {
+	opts, paths, err := parseSCPArgs([]string{"-rt", "--", "-abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, scpOptions{Sink: true, Recursive: true}, opts)
+	assert.Equal(t, []string{"-abc"}, paths)
+	opts, paths, err = parseSCPArgs([]string{"-v", "-p", "-f", "a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, scpOptions{Source: true, PreserveTimes: true}, opts)
+	assert.Equal(t, []string{"a", "b"}, paths)
+	_, _, err = parseSCPArgs([]string{"-t", "a", "b"})
+	assert.Error(t, err)
+	_, _, err = parseSCPArgs([]string{"-t", "-f", "a"})
+	assert.Error(t, err)
+	_, _, err = parseSCPArgs([]string{"-x", "-t", "a"})
+	assert.Error(t, err)
+	_, _, err = parseSCPArgs([]string{"-t"})
+	assert.Error(t, err)
+}
+
+func TestParseSCPHeader(t *testing.T) {
+	size, name, err := parseSCPHeader("C0644 12345 abc.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12345), size)
+	assert.Equal(t, "abc.txt", name)
+	size, name, err = parseSCPHeader("D0755 0 a dir")
+	assert.NoError(t, err)
+	assert.Equal(t, "a dir", name)
+	_, _, err = parseSCPHeader("C0644 1 ../abc")
+	assert.Error(t, err)
+	_, _, err = parseSCPHeader("C0644 1 ..")
+	assert.Error(t, err)
+	_, _, err = parseSCPHeader("C0688 1 abc")
+	assert.Error(t, err)
+	_, _, err = parseSCPHeader("C0644 -1 abc")
+	assert.Error(t, err)
+}
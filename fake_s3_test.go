@@ -0,0 +1,583 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	aws_creds "github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// FakeS3Object is an object stored in FakeS3.
+type FakeS3Object struct {
+	Data         []byte
+	Metadata     map[string]string
+	Headers      http.Header
+	LastModified time.Time
+	ETag         string
+}
+
+type fakeS3MultipartUpload struct {
+	Bucket   string
+	Key      string
+	Metadata map[string]string
+	Headers  http.Header
+	Parts    map[int][]byte
+}
+
+// FakeS3 is an in-process S3 implementing the subset of the REST API the
+// proxy relies on.  The objects are kept in memory, and the requests are
+// recorded so that tests can check the headers sent along with them.
+//
+// Only path-style addressing is supported; point the SDK to it with the
+// aws.Config returned by AWSConfig.  It also serves the STS actions to
+// assume a role at the root, which always give FakeSTSCredentials.
+type FakeS3 struct {
+	Server      *httptest.Server
+	Now         func() time.Time
+	mtx         sync.Mutex
+	buckets     map[string]map[string]*FakeS3Object
+	uploads     map[string]*fakeS3MultipartUpload
+	lastID      int
+	requests    []*http.Request
+	stsRequests []url.Values
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type fakeS3Contents struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+type fakeS3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type fakeS3ListBucketResult struct {
+	XMLName               xml.Name             `xml:"ListBucketResult"`
+	Name                  string               `xml:"Name"`
+	Prefix                string               `xml:"Prefix"`
+	Delimiter             string               `xml:"Delimiter,omitempty"`
+	MaxKeys               int                  `xml:"MaxKeys"`
+	KeyCount              int                  `xml:"KeyCount"`
+	IsTruncated           bool                 `xml:"IsTruncated"`
+	ContinuationToken     string               `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string               `xml:"NextContinuationToken,omitempty"`
+	Contents              []fakeS3Contents     `xml:"Contents"`
+	CommonPrefixes        []fakeS3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type fakeS3Grantee struct {
+	XMLNSXSI string `xml:"xmlns:xsi,attr"`
+	XSIType  string `xml:"xsi:type,attr"`
+	ID       string `xml:"ID"`
+}
+
+type fakeS3Grant struct {
+	Grantee    fakeS3Grantee `xml:"Grantee"`
+	Permission string        `xml:"Permission"`
+}
+
+type fakeS3AccessControlPolicy struct {
+	XMLName           xml.Name      `xml:"AccessControlPolicy"`
+	OwnerID           string        `xml:"Owner>ID"`
+	AccessControlList []fakeS3Grant `xml:"AccessControlList>Grant"`
+}
+
+type fakeS3CopyObjectResult struct {
+	XMLName      xml.Name  `xml:"CopyObjectResult"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+type fakeS3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type fakeS3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type fakeS3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+// FakeSTSCredentials are what the AssumeRole family of the STS actions
+// served by FakeS3 return.
+var FakeSTSCredentials = aws_creds.Value{
+	AccessKeyID:     "ASSUMED",
+	SecretAccessKey: "ASSUMEDSECRET",
+	SessionToken:    "ASSUMEDTOKEN",
+}
+
+// fakeS3PreservedHeaders are the request headers stored along with the object
+// and returned on GET and HEAD.
+var fakeS3PreservedHeaders = []string{
+	"Content-Type",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Customer-Algorithm",
+	"X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+}
+
+func NewFakeS3(buckets ...string) *FakeS3 {
+	fs3 := &FakeS3{
+		Now:     time.Now,
+		buckets: map[string]map[string]*FakeS3Object{},
+		uploads: map[string]*fakeS3MultipartUpload{},
+	}
+	for _, bucket := range buckets {
+		fs3.buckets[bucket] = map[string]*FakeS3Object{}
+	}
+	fs3.Server = httptest.NewTLSServer(fs3)
+	return fs3
+}
+
+func (fs3 *FakeS3) Close() {
+	fs3.Server.Close()
+}
+
+// AWSConfig returns the configuration that makes the SDK talk to the fake.
+func (fs3 *FakeS3) AWSConfig() *aws.Config {
+	return aws.NewConfig().
+		WithCredentials(aws_creds.NewStaticCredentials("AKID", "SECRET", "")).
+		WithRegion("us-east-1").
+		WithEndpoint(fs3.Server.URL).
+		WithS3ForcePathStyle(true).
+		WithHTTPClient(fs3.Server.Client())
+}
+
+func (fs3 *FakeS3) PutObject(bucket, key string, data []byte, metadata map[string]string) {
+	fs3.mtx.Lock()
+	defer fs3.mtx.Unlock()
+	fs3.putObject(bucket, key, data, metadata, http.Header{})
+}
+
+// GetObject returns the object, or nil if there is no such object.
+func (fs3 *FakeS3) GetObject(bucket, key string) *FakeS3Object {
+	fs3.mtx.Lock()
+	defer fs3.mtx.Unlock()
+	obj, _ := fs3.buckets[bucket][key]
+	return obj
+}
+
+// Keys returns the keys in the bucket in lexicographical order.
+func (fs3 *FakeS3) Keys(bucket string) []string {
+	fs3.mtx.Lock()
+	defer fs3.mtx.Unlock()
+	retval := []string{}
+	for key := range fs3.buckets[bucket] {
+		retval = append(retval, key)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// Requests returns the requests received so far.
+func (fs3 *FakeS3) Requests() []*http.Request {
+	fs3.mtx.Lock()
+	defer fs3.mtx.Unlock()
+	return append([]*http.Request{}, fs3.requests...)
+}
+
+// STSRequests returns the parameters of the STS requests received.
+func (fs3 *FakeS3) STSRequests() []url.Values {
+	fs3.mtx.Lock()
+	defer fs3.mtx.Unlock()
+	return append([]url.Values{}, fs3.stsRequests...)
+}
+
+func (fs3 *FakeS3) handleSTS(w http.ResponseWriter, body []byte) {
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		fs3.writeError(w, http.StatusBadRequest, "InvalidParameterValue")
+		return
+	}
+	fs3.stsRequests = append(fs3.stsRequests, params)
+	action := params.Get("Action")
+	if action != "AssumeRole" && action != "AssumeRoleWithWebIdentity" {
+		fs3.writeError(w, http.StatusBadRequest, "InvalidAction")
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(
+		w,
+		`<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%[1]sResult><Credentials><AccessKeyId>%[2]s</AccessKeyId><SecretAccessKey>%[3]s</SecretAccessKey><SessionToken>%[4]s</SessionToken><Expiration>%[5]s</Expiration></Credentials></%[1]sResult></%[1]sResponse>`,
+		action,
+		FakeSTSCredentials.AccessKeyID,
+		FakeSTSCredentials.SecretAccessKey,
+		FakeSTSCredentials.SessionToken,
+		fs3.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	)
+}
+
+func (fs3 *FakeS3) putObject(bucket, key string, data []byte, metadata map[string]string, hdrs http.Header) *FakeS3Object {
+	sum := md5.Sum(data)
+	obj := &FakeS3Object{
+		Data:         data,
+		Metadata:     metadata,
+		Headers:      http.Header{},
+		LastModified: fs3.Now().UTC().Truncate(time.Second),
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+	}
+	for _, name := range fakeS3PreservedHeaders {
+		if v := hdrs.Get(name); v != "" {
+			obj.Headers.Set(name, v)
+		}
+	}
+	fs3.buckets[bucket][key] = obj
+	return obj
+}
+
+func (fs3 *FakeS3) writeXML(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+func (fs3 *FakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	fs3.writeXML(w, status, &fakeS3Error{Code: code, Message: code})
+}
+
+func metadataFromHeader(hdrs http.Header) map[string]string {
+	retval := map[string]string{}
+	for name, values := range hdrs {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			retval[strings.ToLower(name[len("x-amz-meta-"):])] = values[0]
+		}
+	}
+	return retval
+}
+
+func (fs3 *FakeS3) writeObjectHeaders(w http.ResponseWriter, obj *FakeS3Object) {
+	for name, values := range obj.Headers {
+		w.Header()[name] = values
+	}
+	for k, v := range obj.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+	w.Header().Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+	w.Header().Set("ETag", obj.ETag)
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+// parseRange supports the "bytes=start-end" and "bytes=start-" forms.
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(rng, "bytes=") {
+		return 0, 0, false
+	}
+	fields := strings.SplitN(rng[len("bytes="):], "-", 2)
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if fields[1] != "" {
+		end, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (fs3 *FakeS3) listObjects(w http.ResponseWriter, bucketName string, objs map[string]*FakeS3Object, q url.Values) {
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	maxKeys := 1000
+	if v := q.Get("max-keys"); v != "" {
+		maxKeys, _ = strconv.Atoi(v)
+		if maxKeys > 1000 {
+			maxKeys = 1000
+		}
+	}
+	after := q.Get("continuation-token")
+	keys := []string{}
+	for key := range objs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := &fakeS3ListBucketResult{
+		Name:              bucketName,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: after,
+	}
+	seenPrefixes := map[string]bool{}
+	for _, key := range keys {
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if entry <= after || seenPrefixes[entry] {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if entry != key {
+			seenPrefixes[entry] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, fakeS3CommonPrefix{Prefix: entry})
+		} else {
+			obj := objs[key]
+			result.Contents = append(result.Contents, fakeS3Contents{
+				Key:          key,
+				LastModified: obj.LastModified,
+				ETag:         obj.ETag,
+				Size:         int64(len(obj.Data)),
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		result.NextContinuationToken = entry
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	fs3.writeXML(w, http.StatusOK, result)
+}
+
+func (fs3 *FakeS3) copyObject(w http.ResponseWriter, r *http.Request, bucketName, key string) {
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		fs3.writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	src = strings.TrimPrefix(src, "/")
+	i := strings.Index(src, "/")
+	if i < 0 {
+		fs3.writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	srcObj, ok := fs3.buckets[src[:i]][src[i+1:]]
+	if !ok {
+		fs3.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	metadata := srcObj.Metadata
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		metadata = metadataFromHeader(r.Header)
+	}
+	obj := fs3.putObject(bucketName, key, srcObj.Data, metadata, r.Header)
+	fs3.writeXML(w, http.StatusOK, &fakeS3CopyObjectResult{
+		LastModified: obj.LastModified,
+		ETag:         obj.ETag,
+	})
+}
+
+func (fs3 *FakeS3) handleMultipart(w http.ResponseWriter, r *http.Request, bucketName, key string, body []byte) {
+	q := r.URL.Query()
+	if _, ok := q["uploads"]; ok && r.Method == http.MethodPost {
+		fs3.lastID++
+		uploadID := strconv.Itoa(fs3.lastID)
+		fs3.uploads[uploadID] = &fakeS3MultipartUpload{
+			Bucket:   bucketName,
+			Key:      key,
+			Metadata: metadataFromHeader(r.Header),
+			Headers:  r.Header,
+			Parts:    map[int][]byte{},
+		}
+		fs3.writeXML(w, http.StatusOK, &fakeS3InitiateMultipartUploadResult{
+			Bucket:   bucketName,
+			Key:      key,
+			UploadId: uploadID,
+		})
+		return
+	}
+	upload, ok := fs3.uploads[q.Get("uploadId")]
+	if !ok || upload.Bucket != bucketName || upload.Key != key {
+		fs3.writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil {
+			fs3.writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		upload.Parts[partNumber] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		var complete fakeS3CompleteMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			fs3.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for _, part := range complete.Parts {
+			partData, ok := upload.Parts[part.PartNumber]
+			if !ok {
+				fs3.writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, partData...)
+		}
+		delete(fs3.uploads, q.Get("uploadId"))
+		obj := fs3.putObject(bucketName, key, data, upload.Metadata, upload.Headers)
+		obj.ETag = fmt.Sprintf(`"%s-%d"`, obj.ETag[1:len(obj.ETag)-1], len(complete.Parts))
+		fs3.writeXML(w, http.StatusOK, &fakeS3CompleteMultipartUploadResult{
+			Bucket: bucketName,
+			Key:    key,
+			ETag:   obj.ETag,
+		})
+	case http.MethodDelete:
+		delete(fs3.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fs3.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (fs3 *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fs3.writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	fs3.mtx.Lock()
+	defer fs3.mtx.Unlock()
+	fs3.requests = append(fs3.requests, r)
+
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if p == "" && r.Method == http.MethodPost {
+		fs3.handleSTS(w, body)
+		return
+	}
+	bucketName, key := p, ""
+	if i := strings.Index(p, "/"); i >= 0 {
+		bucketName, key = p[:i], p[i+1:]
+	}
+	objs, ok := fs3.buckets[bucketName]
+	if !ok {
+		fs3.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			fs3.listObjects(w, bucketName, objs, q)
+		default:
+			fs3.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return
+	}
+
+	if _, ok := q["uploads"]; ok {
+		fs3.handleMultipart(w, r, bucketName, key, body)
+		return
+	}
+	if _, ok := q["uploadId"]; ok {
+		fs3.handleMultipart(w, r, bucketName, key, body)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objs[key]
+		if !ok {
+			fs3.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if _, ok := q["acl"]; ok {
+			fs3.writeXML(w, http.StatusOK, &fakeS3AccessControlPolicy{
+				OwnerID: "owner",
+				AccessControlList: []fakeS3Grant{
+					{
+						Grantee: fakeS3Grantee{
+							XMLNSXSI: "http://www.w3.org/2001/XMLSchema-instance",
+							XSIType:  "CanonicalUser",
+							ID:       "owner",
+						},
+						Permission: "FULL_CONTROL",
+					},
+				},
+			})
+			return
+		}
+		data := obj.Data
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseRange(rng, int64(len(data)))
+			if !ok {
+				fs3.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+		fs3.writeObjectHeaders(w, obj)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			fs3.copyObject(w, r, bucketName, key)
+			return
+		}
+		obj := fs3.putObject(bucketName, key, body, metadataFromHeader(r.Header), r.Header)
+		w.Header().Set("ETag", obj.ETag)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(objs, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fs3.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
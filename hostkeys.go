@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// The OpenSSH extension by which the clients learn the host keys of the
+// server other than the one used in the handshake, so that the keys can be
+// rotated without the clients noticing.  See PROTOCOL in OpenSSH for
+// detail.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// HostKeys are the host keys of a listener and the certificates of them.
+type HostKeys struct {
+	// Keys are all the keys, of which the first one of each algorithm is
+	// used in the handshake.  The others are only told to the clients so
+	// that they trust them in advance.
+	Keys         []ssh.Signer
+	Certificates []ssh.Signer
+	// announced are the keys allowed by the algorithms given to AddTo,
+	// which sign only with those algorithms.
+	announced []ssh.Signer
+}
+
+func readHostCertificate(p string, keys []ssh.Signer, now time.Time) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to open "%s"`, p)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to parse host certificate "%s"`, p)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf(`"%s" is not a host certificate`, p)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && uint64(now.Unix()) >= cert.ValidBefore {
+		return nil, fmt.Errorf(`host certificate "%s" has expired`, p)
+	}
+	keyMarshaled := cert.Key.Marshal()
+	for _, key := range keys {
+		if bytes.Equal(key.PublicKey().Marshal(), keyMarshaled) {
+			return ssh.NewCertSigner(cert, key)
+		}
+	}
+	return nil, fmt.Errorf(`no host key matches the host certificate "%s"`, p)
+}
+
+// ReadHostKeys reads the private keys and the OpenSSH host certificates,
+// each of which must be of one of the keys.
+func ReadHostKeys(keyFiles, certFiles []string, now time.Time) (*HostKeys, error) {
+	hk := &HostKeys{}
+	for _, p := range keyFiles {
+		pem, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to open "%s"`, p)
+		}
+		key, err := ssh.ParseRawPrivateKey(pem)
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to parse host key "%s"`, p)
+		}
+		sgn, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		hk.Keys = append(hk.Keys, sgn)
+	}
+	for _, p := range certFiles {
+		sgn, err := readHostCertificate(p, hk.Keys, now)
+		if err != nil {
+			return nil, err
+		}
+		hk.Certificates = append(hk.Certificates, sgn)
+	}
+	return hk, nil
+}
+
+// AddTo adds the keys used in the handshake to the server config, which
+// sign only with the algorithms given.  It fails if none of the keys is of
+// the algorithms.  Only the keys of the algorithms are announced.
+func (hk *HostKeys) AddTo(c *ssh.ServerConfig, algorithms []string) error {
+	hk.announced = nil
+	for _, sgn := range hk.Keys {
+		_sgn, err := restrictHostKey(sgn, algorithms)
+		if err != nil {
+			return err
+		}
+		if _sgn != nil {
+			hk.announced = append(hk.announced, _sgn)
+		}
+	}
+	types := map[string]bool{}
+	for _, sgn := range append(append([]ssh.Signer{}, hk.Keys...), hk.Certificates...) {
+		// ServerConfig keeps the last one of each algorithm
+		if types[sgn.PublicKey().Type()] {
+			continue
+		}
+		_sgn, err := restrictHostKey(sgn, algorithms)
+		if err != nil {
+			return err
+		}
+		if _sgn == nil {
+			continue
+		}
+		types[sgn.PublicKey().Type()] = true
+		c.AddHostKey(_sgn)
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("none of the host keys is of public_key_algorithms")
+	}
+	return nil
+}
+
+// Announcement returns the payload of the hostkeys-00@openssh.com request,
+// which lists the keys allowed by the algorithms given to AddTo.
+func (hk *HostKeys) Announcement() []byte {
+	var payload []byte
+	for _, sgn := range hk.announced {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{sgn.PublicKey().Marshal()})...)
+	}
+	return payload
+}
+
+// proveAlgorithm returns the signature algorithm the RSA key proves its
+// possession with, or an empty string if the key is of another type.
+// OpenSSH verifies the signature with the algorithm of the host key used in
+// the handshake if it is also of RSA.
+func proveAlgorithm(key ssh.Signer, hostKeyAlgorithm string) string {
+	if key.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return ""
+	}
+	if algorithm, ok := rsaSignatureAlgorithmOf(hostKeyAlgorithm); ok {
+		return algorithm
+	}
+	// OpenSSH no longer accepts SHA-1
+	if mas, ok := key.(ssh.MultiAlgorithmSigner); ok {
+		return mas.Algorithms()[0]
+	}
+	return ssh.KeyAlgoRSASHA512
+}
+
+// Prove answers the hostkeys-prove-00@openssh.com request, in which the
+// client asks the server to prove the possession of the keys announced by
+// signing them along with the session identifier.  hostKeyAlgorithm is
+// that negotiated in the handshake.
+func (hk *HostKeys) Prove(sessionID []byte, hostKeyAlgorithm string, payload []byte) ([]byte, error) {
+	var reply []byte
+	for len(payload) > 0 {
+		var req struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		err := ssh.Unmarshal(payload, &req)
+		if err != nil {
+			return nil, err
+		}
+		payload = req.Rest
+		var key ssh.Signer
+		for _, sgn := range hk.announced {
+			if bytes.Equal(sgn.PublicKey().Marshal(), req.Key) {
+				key = sgn
+				break
+			}
+		}
+		if key == nil {
+			return nil, fmt.Errorf("unknown host key")
+		}
+		data := ssh.Marshal(struct {
+			Type      string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionID, req.Key})
+		var sig *ssh.Signature
+		algSgn, ok := key.(ssh.AlgorithmSigner)
+		if algorithm := proveAlgorithm(key, hostKeyAlgorithm); ok && algorithm != "" {
+			sig, err = algSgn.SignWithAlgorithm(rand.Reader, data, algorithm)
+		} else {
+			sig, err = key.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+	}
+	return reply, nil
+}
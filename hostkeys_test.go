@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestHostKeys writes an ed25519 key, an ecdsa key and another ed25519
+// key to the directory, and the host certificate of the first one signed by
+// the CA.  It returns the paths to the keys, that to the certificate and
+// the CA.
+func writeTestHostKeys(t *testing.T, dir string) ([]string, string, ssh.Signer) {
+	var paths []string
+	var keys []ssh.Signer
+	for i, alg := range []string{"ed25519", "ecdsa", "ed25519"} {
+		var priv interface{}
+		if alg == "ecdsa" {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv = key
+		} else {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			priv = key
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, fmt.Sprintf("host_%s_key%d", alg, i))
+		err = ioutil.WriteFile(p, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sgn, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+		keys = append(keys, sgn)
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "host_ed25519_key0-cert.pub")
+	writeTestHostCertificate(t, certPath, keys[0].PublicKey(), ssh.HostCert, ssh.CertTimeInfinity, ca)
+	return paths, certPath, ca
+}
+
+func writeTestHostCertificate(t *testing.T, p string, key ssh.PublicKey, certType uint32, validBefore uint64, ca ssh.Signer) {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     validBefore,
+	}
+	err := cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(p, ssh.MarshalAuthorizedKey(cert), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths, certPath, ca := writeTestHostKeys(t, dir)
+
+	hk, err := ReadHostKeys(paths, []string{certPath}, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, hk.Keys, 3)
+	assert.Len(t, hk.Certificates, 1)
+
+	// the certificate of none of the keys
+	_, err = ReadHostKeys(paths[1:], []string{certPath}, time.Now())
+	assert.Error(t, err)
+	userCertPath := filepath.Join(dir, "user-cert.pub")
+	writeTestHostCertificate(t, userCertPath, hk.Keys[0].PublicKey(), ssh.UserCert, ssh.CertTimeInfinity, ca)
+	_, err = ReadHostKeys(paths, []string{userCertPath}, time.Now())
+	assert.Error(t, err)
+	expiredCertPath := filepath.Join(dir, "expired-cert.pub")
+	writeTestHostCertificate(t, expiredCertPath, hk.Keys[0].PublicKey(), ssh.HostCert, uint64(time.Now().Unix()-1), ca)
+	_, err = ReadHostKeys(paths, []string{expiredCertPath}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestHostKeysProve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths, _, _ := writeTestHostKeys(t, dir)
+	hk, err := ReadHostKeys(paths, nil, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, hk.AddTo(&ssh.ServerConfig{}, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256})) {
+		return
+	}
+
+	sessionID := []byte("session")
+	sigs, err := hk.Prove(sessionID, ssh.KeyAlgoED25519, hk.Announcement())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, key := range hk.Keys {
+		var reply struct {
+			Sig  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if !assert.NoError(t, ssh.Unmarshal(sigs, &reply)) {
+			return
+		}
+		sigs = reply.Rest
+		sig := &ssh.Signature{}
+		if !assert.NoError(t, ssh.Unmarshal(reply.Sig, sig)) {
+			return
+		}
+		data := ssh.Marshal(struct {
+			Type      string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionID, key.PublicKey().Marshal()})
+		assert.NoError(t, key.PublicKey().Verify(data, sig))
+	}
+	assert.Empty(t, sigs)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sgn, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hk.Prove(sessionID, ssh.KeyAlgoED25519, ssh.Marshal(struct{ Key []byte }{sgn.PublicKey().Marshal()}))
+	assert.Error(t, err)
+}
+
+func TestHostKeysProveRSA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3-sftp-proxy-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths, _, _ := writeTestHostKeys(t, dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPath := filepath.Join(dir, "host_rsa_key")
+	err = ioutil.WriteFile(rsaPath, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk, err := ReadHostKeys(append(paths, rsaPath), nil, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, hk.AddTo(&ssh.ServerConfig{}, []string{ssh.KeyAlgoRSASHA256})) {
+		return
+	}
+	rsaKey := hk.Keys[len(hk.Keys)-1].PublicKey()
+
+	// only the RSA key is announced
+	var announced struct {
+		Key  []byte
+		Rest []byte `ssh:"rest"`
+	}
+	if !assert.NoError(t, ssh.Unmarshal(hk.Announcement(), &announced)) {
+		return
+	}
+	assert.Equal(t, rsaKey.Marshal(), announced.Key)
+	assert.Empty(t, announced.Rest)
+
+	sessionID := []byte("session")
+	sigs, err := hk.Prove(sessionID, ssh.KeyAlgoRSASHA256, hk.Announcement())
+	if !assert.NoError(t, err) {
+		return
+	}
+	var reply struct {
+		Sig  []byte
+		Rest []byte `ssh:"rest"`
+	}
+	if !assert.NoError(t, ssh.Unmarshal(sigs, &reply)) {
+		return
+	}
+	assert.Empty(t, reply.Rest)
+	sig := &ssh.Signature{}
+	if !assert.NoError(t, ssh.Unmarshal(reply.Sig, sig)) {
+		return
+	}
+	assert.Equal(t, ssh.KeyAlgoRSASHA256, sig.Format)
+	data := ssh.Marshal(struct {
+		Type      string
+		SessionID []byte
+		Key       []byte
+	}{hostKeysProveRequest, sessionID, rsaKey.Marshal()})
+	assert.NoError(t, rsaKey.Verify(data, sig))
+
+	// the keys not announced are not proved
+	_, err = hk.Prove(sessionID, ssh.KeyAlgoRSASHA256, ssh.Marshal(struct{ Key []byte }{hk.Keys[0].PublicKey().Marshal()}))
+	assert.Error(t, err)
+}
@@ -127,3 +127,24 @@ func IsTimeout(e error) bool {
 	}
 	return false
 }
+
+// copyAt copies from r to w starting at off until EOF.
+func copyAt(w io.WriterAt, off int64, r io.Reader) (int64, error) {
+	buf := make([]byte, 32768)
+	n := int64(0)
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			nw, werr := w.WriteAt(buf[:nr], off+n)
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
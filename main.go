@@ -5,10 +5,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -28,31 +28,81 @@ func init() {
 	flag.BoolVar(&debug, "debug", false, "turn on debugging output")
 }
 
-func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.ServerConfig, error) {
-	pem, err := ioutil.ReadFile(cfg.HostKeyFile)
-	if err != nil {
-		return nil, errors.Wrapf(err, `failed to open "%s"`, cfg.HostKeyFile)
+func buildSSHServerConfig(buckets *S3Buckets, sessions *SessionRegistry, cfg *S3SFTPProxyConfig, name string, lCfg *ListenerConfig, hostKeys *HostKeys) (*ssh.ServerConfig, error) {
+	lookupBucket := func(c ssh.ConnMetadata) (*S3Bucket, error) {
+		if sessions.IsBlocked(c.User()) {
+			return nil, fmt.Errorf("user %s is blocked", c.User())
+		}
+		bucket, ok := buckets.UserToBucketMap[c.User()]
+		if !ok {
+			return nil, fmt.Errorf("unknown user: %s", c.User())
+		}
+		if !lCfg.AllowsBucket(bucket.Name) {
+			return nil, fmt.Errorf("user %s may not log in on this listener", c.User())
+		}
+		return bucket, nil
 	}
-	key, err := ssh.ParseRawPrivateKey(pem)
+	banner, err := ParseBannerTemplate(*lCfg.Banner)
 	if err != nil {
-		return nil, errors.Wrapf(err, `failed to parse host key "%s"`, cfg.HostKeyFile)
+		return nil, errors.Wrapf(err, "banner")
+	}
+	var loginMessage *BannerTemplate
+	if cfg.LoginMessage != "" {
+		loginMessage, err = ParseBannerTemplate(cfg.LoginMessage)
+		if err != nil {
+			return nil, errors.Wrapf(err, "login_message")
+		}
+	}
+	// sendLoginMessage tells the login message to the user who has just
+	// authenticated, before the authentication completes.
+	sendLoginMessage := func(c ssh.ConnMetadata, bucket *S3Bucket) error {
+		t := loginMessage
+		if bucket.LoginMessage != nil {
+			t = bucket.LoginMessage
+		}
+		msg := t.Render(newLoginMessageData(c, name, time.Now(), bucket))
+		if msg == "" {
+			return nil
+		}
+		preAuthConn, ok := c.(ssh.ServerPreAuthConn)
+		if !ok {
+			return nil
+		}
+		return preAuthConn.SendAuthBanner(msg)
 	}
 	c := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
-			bucket, ok := buckets.UserToBucketMap[c.User()]
-			if !ok {
-				return nil, fmt.Errorf("unknown user: %s", c.User())
+		MaxAuthTries: *cfg.MaxAuthTries,
+		BannerCallback: func(c ssh.ConnMetadata) string {
+			t := banner
+			// the user name is told along with the first authentication
+			// request, before which the banner is sent
+			bucket, err := lookupBucket(c)
+			if err == nil && bucket.Banner != nil {
+				t = bucket.Banner
+			}
+			return t.Render(newBannerData(c, name, time.Now()))
+		},
+	}
+	algorithms := cfg.SSHAlgorithms()
+	algorithms.Apply(c)
+	if lCfg.AllowsAuthMethod("password") {
+		c.PasswordCallback = func(c ssh.ConnMetadata, passwd []byte) (*ssh.Permissions, error) {
+			bucket, err := lookupBucket(c)
+			if err != nil {
+				return nil, err
 			}
 			u := bucket.Users.Lookup(c.User())
 			if u.Password != "" && u.Password == string(passwd) {
-				return nil, nil
+				return nil, sendLoginMessage(c, bucket)
 			}
 			return nil, fmt.Errorf("passwords do not match")
-		},
-		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			bucket, ok := buckets.UserToBucketMap[c.User()]
-			if !ok {
-				return nil, fmt.Errorf("unknown user: %s", c.User())
+		}
+	}
+	if lCfg.AllowsAuthMethod("publickey") {
+		c.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			bucket, err := lookupBucket(c)
+			if err != nil {
+				return nil, err
 			}
 			u := bucket.Users.Lookup(c.User())
 			if u.PublicKeys != nil {
@@ -68,11 +118,22 @@ func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.Serv
 				}
 			}
 			return nil, fmt.Errorf("public keys do not match")
-		},
-		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-			bucket, ok := buckets.UserToBucketMap[c.User()]
-			if !ok {
-				return nil, fmt.Errorf("unknown user: %s", c.User())
+		}
+		// PublicKeyCallback is also called on the queries of whether the
+		// keys are acceptable, while this is only on the successful logins
+		c.VerifiedPublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey, perms *ssh.Permissions, signatureAlgorithm string) (*ssh.Permissions, error) {
+			bucket, err := lookupBucket(c)
+			if err != nil {
+				return nil, err
+			}
+			return perms, sendLoginMessage(c, bucket)
+		}
+	}
+	if lCfg.AllowsAuthMethod("keyboard-interactive") {
+		c.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			bucket, err := lookupBucket(c)
+			if err != nil {
+				return nil, err
 			}
 			if !bucket.KeyboardInteractiveAuthEnabled {
 				return nil, fmt.Errorf("keyboard interactive authentication not enabled")
@@ -88,20 +149,59 @@ func buildSSHServerConfig(buckets *S3Buckets, cfg *S3SFTPProxyConfig) (*ssh.Serv
 			if answers[0] != u.Password {
 				return nil, fmt.Errorf("passwords do not match")
 			}
-			return nil, nil
-		},
-		BannerCallback: func(c ssh.ConnMetadata) string {
-			return cfg.Banner
-		},
+			return nil, sendLoginMessage(c, bucket)
+		}
 	}
-	sgn, err := ssh.NewSignerFromKey(key)
+	err = hostKeys.AddTo(c, algorithms.PublicKeyAlgorithms)
 	if err != nil {
 		return nil, err
 	}
-	c.AddHostKey(sgn)
 	return c, nil
 }
 
+func buildListeners(buckets *S3Buckets, sessions *SessionRegistry, cfg *S3SFTPProxyConfig) (map[string]*Listener, error) {
+	listeners := make(map[string]*Listener, len(cfg.Listeners))
+	for name, lCfg := range cfg.Listeners {
+		hostKeys, err := ReadHostKeys(lCfg.HostKeyFiles, lCfg.HostCertificateFiles, time.Now())
+		if err != nil {
+			return nil, errors.Wrapf(err, `listener "%s"`, name)
+		}
+		sCfg, err := buildSSHServerConfig(buckets, sessions, cfg, name, lCfg, hostKeys)
+		if err != nil {
+			return nil, errors.Wrapf(err, `listener "%s"`, name)
+		}
+		trusted, err := ParseCIDRs(lCfg.ProxyProtocolTrusted)
+		if err != nil {
+			return nil, errors.Wrapf(err, `listener "%s"`, name)
+		}
+		listeners[name] = &Listener{
+			Name:                 name,
+			ServerConfig:         sCfg,
+			HostKeys:             hostKeys,
+			ProxyProtocolTrusted: trusted,
+		}
+	}
+	return listeners, nil
+}
+
+// listen opens the sockets of the listener, or takes those passed by
+// systemd.
+func listen(lCfg *ListenerConfig, inherited map[string][]*net.TCPListener) ([]*net.TCPListener, error) {
+	if lCfg.SystemdSocket != "" {
+		lsnrs, ok := inherited[lCfg.SystemdSocket]
+		if !ok {
+			return nil, fmt.Errorf("no socket named %s is passed by systemd", lCfg.SystemdSocket)
+		}
+		delete(inherited, lCfg.SystemdSocket)
+		return lsnrs, nil
+	}
+	lsnr, err := net.Listen("tcp", lCfg.Bind)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.TCPListener{lsnr.(*net.TCPListener)}, nil
+}
+
 func bail(msg string, status ...interface{}) {
 	os.Stderr.Write([]byte(msg + "\n"))
 	statusCode := 1
@@ -115,33 +215,62 @@ func bail(msg string, status ...interface{}) {
 	os.Exit(statusCode)
 }
 
-func main() {
-	flag.Parse()
+// loadConfig reads the configuration file and builds everything derived from
+// it.  It is used both on startup and when reloading on SIGHUP.  The users
+// blocked in sessions are refused on authentication.
+func loadConfig(configFile string, sessions *SessionRegistry) (*S3SFTPProxyConfig, *S3Buckets, map[string]*Listener, error) {
 	cfg, err := ReadConfigFromFile(configFile)
 	if err != nil {
-		bail(err.Error())
+		return nil, nil, nil, err
 	}
 
 	uStores, err := NewUserStoresFromConfig(cfg)
 	if err != nil {
-		bail(err.Error())
+		return nil, nil, nil, err
 	}
 
 	buckets, err := NewS3BucketFromConfig(uStores, cfg)
 	if err != nil {
-		bail(err.Error())
+		return nil, nil, nil, err
 	}
 
-	sCfg, err := buildSSHServerConfig(buckets, cfg)
+	listeners, err := buildListeners(buckets, sessions, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return cfg, buckets, listeners, nil
+}
+
+func main() {
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		err := runCheckConfig(os.Stdout, flag.Args()[1:])
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		} else if err != nil {
+			bail(err.Error())
+		}
+		return
+	default:
+		bail(fmt.Sprintf("unknown subcommand: %s", flag.Arg(0)), 2)
+	}
+
+	sessions := NewSessionRegistry()
+	cfg, buckets, listeners, err := loadConfig(configFile, sessions)
 	if err != nil {
 		bail(err.Error())
 	}
 
-	_bind := bind
-	if _bind == "" {
-		_bind = cfg.Bind
-		if _bind == "" {
-			_bind = ":10022"
+	if bind != "" {
+		if len(cfg.Listeners) != 1 {
+			bail("-bind may not be given if more than one listener is configured")
+		}
+		for _, lCfg := range cfg.Listeners {
+			lCfg.Bind = bind
+			lCfg.SystemdSocket = ""
 		}
 	}
 
@@ -150,32 +279,87 @@ func main() {
 		logger.SetLevel(logrus.DebugLevel)
 	}
 
-	lsnr, err := net.Listen("tcp", _bind)
+	inherited, err := SystemdListeners()
 	if err != nil {
 		bail(err.Error())
 	}
-	defer lsnr.Close()
-	logger.Info("Listen on ", _bind)
+	lsnrs := map[string][]*net.TCPListener{}
+	for name, lCfg := range cfg.Listeners {
+		_lsnrs, err := listen(lCfg, inherited)
+		if err != nil {
+			bail(fmt.Sprintf("listener %s: %s", name, err.Error()))
+		}
+		for _, lsnr := range _lsnrs {
+			defer lsnr.Close()
+			F(logger.Info, "listener %s listening on %s", name, lsnr.Addr().String())
+		}
+		lsnrs[name] = _lsnrs
+	}
+	for name, _lsnrs := range inherited {
+		F(logger.Info, "socket %s passed by systemd is not used by any listener", name)
+		for _, lsnr := range _lsnrs {
+			lsnr.Close()
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, os.Interrupt)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	server := &Server{
+		S3Buckets:                buckets,
+		Listeners:                listeners,
+		Log:                      logger,
+		ReaderLookbackBufferSize: *cfg.ReaderLookbackBufferSize,
+		ReaderMinChunkSize:       *cfg.ReaderMinChunkSize,
+		ListerLookbackBufferSize: *cfg.ListerLookbackBufferSize,
+		PhantomObjectMap:         NewPhantomObjectMap(),
+		Uploads:                  NewUploadTracker(),
+		Sessions:                 sessions,
+		Bandwidth:                NewBandwidthLimiters(),
+		Limits:                   NewConnectionLimitsFromConfig(cfg),
+		Now:                      time.Now,
+	}
+	server.Bandwidth.Configure(BandwidthLimit{Download: cfg.DownloadRateLimit, Upload: cfg.UploadRateLimit}, buckets)
+
+	var adminServer *AdminServer
+	if cfg.AdminAPI != nil {
+		adminLsnr, err := net.Listen("tcp", cfg.AdminAPI.Bind)
+		if err != nil {
+			bail(err.Error())
+		}
+		logger.Info("Admin API listening on ", cfg.AdminAPI.Bind)
+		adminServer = &AdminServer{
+			Server: server,
+			Token:  cfg.AdminAPI.Token,
+			Log:    logger,
+		}
+		go func() {
+			err := adminServer.Run(ctx, adminLsnr)
+			if err != nil {
+				F(logger.Error, "admin API: %s", err.Error())
+			}
+		}()
+	}
+
+	scanCtx, scanCancel := context.WithCancel(ctx)
+	buckets.RunQuotaScanners(scanCtx, logger)
+
+	gracePeriod := cfg.ShutdownGracePeriod.Duration
+	shuttingDown := false
 
 	errChan := make(chan error)
-	go func() {
-		errChan <- (&Server{
-			S3Buckets:                buckets,
-			ServerConfig:             sCfg,
-			Log:                      logger,
-			ReaderLookbackBufferSize: *cfg.ReaderLookbackBufferSize,
-			ReaderMinChunkSize:       *cfg.ReaderMinChunkSize,
-			ListerLookbackBufferSize: *cfg.ListerLookbackBufferSize,
-			PhantomObjectMap:         NewPhantomObjectMap(),
-			Now:                      time.Now,
-		}).RunListenerEventLoop(ctx, lsnr.(*net.TCPListener))
-	}()
+	running := 0
+	for name, _lsnrs := range lsnrs {
+		for _, lsnr := range _lsnrs {
+			go func(name string, lsnr *net.TCPListener) {
+				errChan <- server.RunListenerEventLoop(ctx, name, lsnr)
+			}(name, lsnr)
+			running++
+		}
+	}
 
 outer:
 	for {
@@ -184,9 +368,61 @@ outer:
 			if err != nil {
 				bail(err.Error())
 			}
-			break outer
-		case <-sigChan:
-			cancel()
+			running--
+			if running == 0 {
+				break outer
+			}
+		case sig := <-sigChan:
+			if sig != syscall.SIGHUP {
+				if shuttingDown {
+					bail("received the second signal; exiting immediately")
+				}
+				shuttingDown = true
+				F(logger.Info, "shutting down; waiting up to %s for the uploads in flight", gracePeriod)
+				graceCtx, graceCancel := context.WithTimeout(ctx, gracePeriod)
+				go func() {
+					defer graceCancel()
+					for _, info := range server.Shutdown(graceCtx) {
+						F(logger.Error, "upload of %s abandoned", info.GetOne().Key.String())
+					}
+					cancel()
+				}()
+				continue
+			}
+			F(logger.Info, "reloading configuration from %s", configFile)
+			cfg, buckets, listeners, err := loadConfig(configFile, sessions)
+			if err != nil {
+				F(logger.Error, "failed to reload configuration; keeping the current one: %s", err.Error())
+				continue
+			}
+			for name := range listeners {
+				if _, ok := lsnrs[name]; !ok {
+					F(logger.Error, "listener %s is added; it will not be listening until restart", name)
+				}
+			}
+			for name := range lsnrs {
+				if _, ok := listeners[name]; !ok {
+					F(logger.Error, "listener %s is removed; the connections to it will be refused until restart", name)
+				}
+			}
+			if adminServer == nil && cfg.AdminAPI != nil {
+				logger.Error("admin_api is added; it will not be listening until restart")
+			} else if adminServer != nil && cfg.AdminAPI == nil {
+				logger.Error("admin_api is removed; it will keep listening until restart")
+			} else if adminServer != nil {
+				adminServer.SetToken(cfg.AdminAPI.Token)
+			}
+			server.Reconfigure(buckets, listeners)
+			server.Bandwidth.Configure(BandwidthLimit{Download: cfg.DownloadRateLimit, Upload: cfg.UploadRateLimit}, buckets)
+			server.SetLimits(NewConnectionLimitsFromConfig(cfg))
+			server.SetBufferSizes(*cfg.ReaderLookbackBufferSize, *cfg.ReaderMinChunkSize, *cfg.ListerLookbackBufferSize)
+			// the quota trackers carried over are scanned by the new
+			// scanners
+			scanCancel()
+			scanCtx, scanCancel = context.WithCancel(ctx)
+			buckets.RunQuotaScanners(scanCtx, logger)
+			gracePeriod = cfg.ShutdownGracePeriod.Duration
+			logger.Info("configuration reloaded")
 		}
 	}
 }
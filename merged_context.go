@@ -31,7 +31,13 @@ func (ctxs *mergedContext) Done() <-chan struct{} {
 }
 
 func (ctxs *mergedContext) Err() error {
-	return ctxs.err
+	// err is only set before doneChan is closed
+	select {
+	case <-ctxs.doneChan:
+		return ctxs.err
+	default:
+		return nil
+	}
 }
 
 func (ctxs *mergedContext) Value(key interface{}) interface{} {
@@ -51,7 +57,7 @@ func (ctxs *mergedContext) watcher() {
 			case <-ctxs.ctxs[0].Done():
 				ctxs.err = ctxs.ctxs[0].Err()
 			case <-ctxs.ctxs[1].Done():
-				ctxs.err = ctxs.ctxs[0].Err()
+				ctxs.err = ctxs.ctxs[1].Err()
 			}
 			close(ctxs.doneChan)
 		}()
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCombineContext(t *testing.T) {
+	for n := 2; n <= 3; n++ {
+		ctxs := []context.Context{}
+		cancels := []context.CancelFunc{}
+		for i := 0; i < n; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctxs = append(ctxs, ctx)
+			cancels = append(cancels, cancel)
+		}
+		ctx := combineContext(ctxs...)
+		assert.NoError(t, ctx.Err())
+		// a context derived from it is canceled along with the last one
+		child, cancel := context.WithCancel(ctx)
+		defer cancel()
+		cancels[n-1]()
+		select {
+		case <-child.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("not canceled")
+		}
+		assert.Equal(t, context.Canceled, ctx.Err())
+		assert.Equal(t, context.Canceled, child.Err())
+	}
+}
@@ -152,6 +152,17 @@ func (pom *PhantomObjectMap) List(p Path) []*PhantomObjectInfo {
 	return retval
 }
 
+func (pom *PhantomObjectMap) ListAll() []*PhantomObjectInfo {
+	pom.mtx.Lock()
+	defer pom.mtx.Unlock()
+
+	retval := make([]*PhantomObjectInfo, 0, len(pom.ptrToPOIMMapMap))
+	for info := range pom.ptrToPOIMMapMap {
+		retval = append(retval, info)
+	}
+	return retval
+}
+
 func (pom *PhantomObjectMap) Size() int {
 	pom.mtx.Lock()
 	defer pom.mtx.Unlock()
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is how long to wait for the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	maxProxyV1Line = 107
+)
+
+// proxiedConn is the connection relayed by a proxy, which tells the address
+// of the client in the PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (pc *proxiedConn) Read(buf []byte) (int, error) {
+	return pc.r.Read(buf)
+}
+
+func (pc *proxiedConn) RemoteAddr() net.Addr {
+	return pc.remoteAddr
+}
+
+// ParseCIDRs parses the list of the networks in CIDR notation.  A bare
+// address is taken as the network of the address alone.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	retval := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			retval = append(retval, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		retval = append(retval, ipNet)
+	}
+	return retval, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxyHeader reads the PROXY protocol header of version 1 or 2 if
+// the connection comes from one of the trusted proxies, and returns the
+// connection that tells the address of the client.  The header is required
+// from the trusted proxies, while it is never looked for from the others.
+func acceptProxyHeader(conn net.Conn, trusted []*net.IPNet) (net.Conn, error) {
+	if len(trusted) == 0 {
+		return conn, nil
+	}
+	ip := net.ParseIP(remoteIP(conn.RemoteAddr()))
+	if ip == nil || !containsIP(trusted, ip) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+	remoteAddr, err := readProxyHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header from %s: %s", conn.RemoteAddr().String(), err.Error())
+	}
+	if remoteAddr == nil {
+		// the connection made by the proxy itself, such as a health check
+		remoteAddr = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, r: r, remoteAddr: remoteAddr}, nil
+}
+
+// readProxyHeader reads the header and returns the address of the client,
+// which is nil if the proxy tells none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV1Prefix) {
+		return readProxyV1Header(r)
+	}
+	b, err = r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2Header(r)
+	}
+	return nil, fmt.Errorf("no header")
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, maxProxyV1Line)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Line {
+			return nil, fmt.Errorf("line too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed line")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed line")
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port: %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+	proxyV2TCP4     = 0x11
+	proxyV2TCP6     = 0x21
+)
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version: %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0xf {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported command: %d", hdr[12]&0xf)
+	}
+	// the TLVs after the addresses are of no interest
+	switch hdr[13] {
+	case proxyV2TCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("address too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case proxyV2TCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("address too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		// UNIX sockets and the like
+		return nil, nil
+	}
+}
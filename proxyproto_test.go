@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	cases := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n", "192.0.2.1:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n", "[2001:db8::1]:56324", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 22\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", true},
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x16", "192.0.2.1:56324", false},
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\xdc\x04\x00\x16", "[2001:db8::1]:56324", false},
+		// LOCAL, with a TLV that is ignored
+		{"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x03\x04\x00\x00", "", false},
+		{"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00", "", true},
+		{"SSH-2.0-OpenSSH_8.9\r\n", "", true},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.header + "SSH-2.0-x\r\n"))
+		addr, err := readProxyHeader(r)
+		if c.err {
+			assert.Error(t, err, c.header)
+			continue
+		}
+		if !assert.NoError(t, err, c.header) {
+			continue
+		}
+		if c.addr == "" {
+			assert.Nil(t, addr, c.header)
+		} else if assert.NotNil(t, addr, c.header) {
+			assert.Equal(t, c.addr, addr.String())
+		}
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "SSH-2.0-x\r\n", string(rest))
+	}
+}
+
+func TestAcceptProxyHeader(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsnr.Close()
+	trusted, err := ParseCIDRs([]string{"127.0.0.0/8", "::1"})
+	assert.NoError(t, err)
+	untrusted, err := ParseCIDRs([]string{"192.0.2.0/24"})
+	assert.NoError(t, err)
+	for _, c := range []struct {
+		nets    []*net.IPNet
+		trusted bool
+	}{{trusted, true}, {untrusted, false}} {
+		client, err := net.Dial("tcp", lsnr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := lsnr.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-2.0-x\r\n"))
+		client.Close()
+		_conn, err := acceptProxyHeader(conn, c.nets)
+		if assert.NoError(t, err) {
+			rest, _ := ioutil.ReadAll(_conn)
+			if c.trusted {
+				assert.Equal(t, "192.0.2.1:56324", _conn.RemoteAddr().String())
+				assert.Equal(t, "SSH-2.0-x\r\n", string(rest))
+			} else {
+				// the header is not looked for from the others
+				assert.Equal(t, conn.RemoteAddr(), _conn.RemoteAddr())
+				assert.True(t, strings.HasPrefix(string(rest), "PROXY "))
+			}
+		}
+		conn.Close()
+	}
+
+	_, err = ParseCIDRs([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ownerMetadataKey holds the name of the user who uploaded the object, by
+// which the usage of the user is told.
+const ownerMetadataKey = "owner"
+
+// QuotaUsage is the amount of the storage used.
+type QuotaUsage struct {
+	Bytes   int64
+	Objects int64
+}
+
+func (u QuotaUsage) add(v QuotaUsage) QuotaUsage {
+	return QuotaUsage{Bytes: u.Bytes + v.Bytes, Objects: u.Objects + v.Objects}
+}
+
+func (u QuotaUsage) sub(v QuotaUsage) QuotaUsage {
+	return QuotaUsage{Bytes: u.Bytes - v.Bytes, Objects: u.Objects - v.Objects}
+}
+
+// QuotaLimits are the quotas.  A negative value means unlimited.
+type QuotaLimits struct {
+	Bytes   int64
+	Objects int64
+}
+
+// remaining returns what is left of the limits, which is negative if
+// unlimited.
+func (l QuotaLimits) remaining(u QuotaUsage) QuotaUsage {
+	r := QuotaUsage{Bytes: -1, Objects: -1}
+	if l.Bytes >= 0 {
+		r.Bytes = l.Bytes - u.Bytes
+		if r.Bytes < 0 {
+			r.Bytes = 0
+		}
+	}
+	if l.Objects >= 0 {
+		r.Objects = l.Objects - u.Objects
+		if r.Objects < 0 {
+			r.Objects = 0
+		}
+	}
+	return r
+}
+
+func (l QuotaLimits) check(u, delta QuotaUsage, whose string) error {
+	if l.Bytes >= 0 && delta.Bytes > 0 && u.Bytes+delta.Bytes > l.Bytes {
+		return fmt.Errorf("quota exceeded: %s may store up to %d bytes, of which %d are in use", whose, l.Bytes, u.Bytes)
+	}
+	if l.Objects >= 0 && delta.Objects > 0 && u.Objects+delta.Objects > l.Objects {
+		return fmt.Errorf("quota exceeded: %s may store up to %d files, of which %d are in use", whose, l.Objects, u.Objects)
+	}
+	return nil
+}
+
+func minRemaining(a, b int64) int64 {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// QuotaTracker keeps track of the usage of a bucket config and that of each
+// of its users.  The usage is taken by scanning the objects under the key
+// prefix periodically, and updated on every write and delete in between.
+// The space held by the uploads in flight is accounted as reserved so that
+// concurrent uploads do not exceed the quotas together.  The quotas are not
+// enforced until the first scan finishes.  The limits are changed through
+// SetLimits once the tracker is in use.
+type QuotaTracker struct {
+	Bucket QuotaLimits
+	User   QuotaLimits
+	// ScanInterval is the interval between the scans.
+	ScanInterval time.Duration
+	mtx          sync.Mutex
+	scanned      bool
+	usage        QuotaUsage
+	reserved     QuotaUsage
+	users        map[string]QuotaUsage
+	userReserved map[string]QuotaUsage
+}
+
+func NewQuotaTracker(bucket, user QuotaLimits, scanInterval time.Duration) *QuotaTracker {
+	return &QuotaTracker{
+		Bucket:       bucket,
+		User:         user,
+		ScanInterval: scanInterval,
+		users:        map[string]QuotaUsage{},
+		userReserved: map[string]QuotaUsage{},
+	}
+}
+
+// PerUser tells whether the usage is tracked for each user.
+func (qt *QuotaTracker) PerUser() bool {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	return qt.perUser()
+}
+
+func (qt *QuotaTracker) perUser() bool {
+	return qt.User.Bytes >= 0 || qt.User.Objects >= 0
+}
+
+// SetLimits changes the quotas and the scan interval, keeping the usage and
+// the space reserved.  If the usage of each user starts to be tracked, the
+// quotas are not enforced until the next scan takes it.
+func (qt *QuotaTracker) SetLimits(bucket, user QuotaLimits, scanInterval time.Duration) {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	perUser := qt.perUser()
+	qt.Bucket = bucket
+	qt.User = user
+	qt.ScanInterval = scanInterval
+	if !perUser && qt.perUser() {
+		qt.scanned = false
+	}
+}
+
+// Reserve holds the space for an upload in flight of the user, which
+// changes the usage of the bucket by bucketDelta and that of the user by
+// userDelta.  It fails if the quotas would be exceeded.  The objects with
+// no owner only count toward the bucket quotas.
+func (qt *QuotaTracker) Reserve(user string, bucketDelta, userDelta QuotaUsage) error {
+	if qt == nil {
+		return nil
+	}
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	if qt.scanned {
+		err := qt.Bucket.check(qt.usage.add(qt.reserved), bucketDelta, "the bucket")
+		if err != nil {
+			return err
+		}
+		if user != "" {
+			err = qt.User.check(qt.users[user].add(qt.userReserved[user]), userDelta, "user "+user)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	qt.reserved = qt.reserved.add(bucketDelta)
+	if user != "" {
+		qt.userReserved[user] = qt.userReserved[user].add(userDelta)
+	}
+	return nil
+}
+
+// Release gives back the space held by Reserve.
+func (qt *QuotaTracker) Release(user string, bucketDelta, userDelta QuotaUsage) {
+	if qt == nil {
+		return
+	}
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	qt.reserved = qt.reserved.sub(bucketDelta)
+	if user == "" {
+		return
+	}
+	qt.userReserved[user] = qt.userReserved[user].sub(userDelta)
+	if qt.userReserved[user] == (QuotaUsage{}) {
+		delete(qt.userReserved, user)
+	}
+}
+
+// Add records the objects of the owner put to the storage, or removed from
+// it with a negative delta.
+func (qt *QuotaTracker) Add(owner string, delta QuotaUsage) {
+	if qt == nil {
+		return
+	}
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	qt.usage = qt.usage.add(delta)
+	if owner != "" {
+		qt.users[owner] = qt.users[owner].add(delta)
+	}
+}
+
+// Usage returns the usage of the bucket and that of the user, including the
+// space reserved.
+func (qt *QuotaTracker) Usage(user string) (QuotaUsage, QuotaUsage) {
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	return qt.usage.add(qt.reserved), qt.users[user].add(qt.userReserved[user])
+}
+
+// Remaining returns the space left for the user, which is the smaller of
+// what is left of the bucket quotas and that of the user quotas.  A
+// negative value means unlimited.  ok is false until the first scan
+// finishes.
+func (qt *QuotaTracker) Remaining(user string) (remaining QuotaUsage, limits QuotaLimits, ok bool) {
+	if qt == nil {
+		return QuotaUsage{Bytes: -1, Objects: -1}, QuotaLimits{Bytes: -1, Objects: -1}, false
+	}
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	bucketUsage := qt.usage.add(qt.reserved)
+	userUsage := qt.users[user].add(qt.userReserved[user])
+	br := qt.Bucket.remaining(bucketUsage)
+	ur := qt.User.remaining(userUsage)
+	remaining = QuotaUsage{
+		Bytes:   minRemaining(br.Bytes, ur.Bytes),
+		Objects: minRemaining(br.Objects, ur.Objects),
+	}
+	limits = QuotaLimits{
+		Bytes:   minRemaining(qt.Bucket.Bytes, qt.User.Bytes),
+		Objects: minRemaining(qt.Bucket.Objects, qt.User.Objects),
+	}
+	return remaining, limits, qt.scanned
+}
+
+// Scan takes the usage of the objects under the prefix.  The owners of the
+// objects are looked up only if the usage is tracked for each user, which
+// takes a HEAD request for every object.  The writes and deletes made
+// while scanning may be counted twice or not at all until the next scan.
+func (qt *QuotaTracker) Scan(ctx context.Context, backend StorageBackend, prefix Path) error {
+	usage := QuotaUsage{}
+	users := map[string]QuotaUsage{}
+	perUser := qt.PerUser()
+	prefixes := []Path{prefix}
+	for len(prefixes) > 0 {
+		p := prefixes[0]
+		prefixes = prefixes[1:]
+		continuation := ""
+		for {
+			out, err := backend.ListObjects(ctx, p, continuation)
+			if err != nil {
+				return err
+			}
+			prefixes = append(prefixes, out.Prefixes...)
+			for _, obj := range out.Objects {
+				u := QuotaUsage{Bytes: obj.Size, Objects: 1}
+				usage = usage.add(u)
+				if !perUser {
+					continue
+				}
+				metadata := obj.Metadata
+				if metadata == nil {
+					info, err := backend.HeadObject(ctx, obj.Key)
+					if err == nil {
+						metadata = info.Metadata
+					} else if err != os.ErrNotExist {
+						return err
+					}
+				}
+				if owner, ok := lookupMetadata(metadata, ownerMetadataKey); ok {
+					users[owner] = users[owner].add(u)
+				}
+			}
+			if out.Continuation == "" {
+				break
+			}
+			continuation = out.Continuation
+		}
+	}
+	qt.mtx.Lock()
+	defer qt.mtx.Unlock()
+	qt.usage = usage
+	qt.users = users
+	qt.scanned = true
+	return nil
+}
+
+// RunScanner scans the objects under the prefix every ScanInterval until
+// ctx is done.
+func (qt *QuotaTracker) RunScanner(ctx context.Context, backend StorageBackend, prefix Path, log interface {
+	InfoLogger
+	ErrorLogger
+}) {
+	for {
+		err := qt.Scan(ctx, backend, prefix)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			F(log.Error, "failed to scan the usage of %s: %s", prefix.String(), err.Error())
+		} else {
+			usage, _ := qt.Usage("")
+			F(log.Info, "usage of %s: %d bytes in %d files", prefix.String(), usage.Bytes, usage.Objects)
+		}
+		qt.mtx.Lock()
+		interval := qt.ScanInterval
+		qt.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	lb := &LocalBackend{Root: root}
+	ctx := context.Background()
+	lb.PutObject(ctx, Path{"prefix", "a.txt"}, strings.NewReader("aaaa"), map[string]string{ownerMetadataKey: "alice"})
+	lb.PutObject(ctx, Path{"prefix", "sub", "b.txt"}, strings.NewReader("bb"), map[string]string{ownerMetadataKey: "bob"})
+	lb.PutObject(ctx, Path{"prefix", "c.txt"}, strings.NewReader("c"), nil)
+	lb.PutObject(ctx, Path{"other", "d.txt"}, strings.NewReader("dddddddd"), nil)
+
+	qt := NewQuotaTracker(QuotaLimits{Bytes: 10, Objects: -1}, QuotaLimits{Bytes: -1, Objects: 2}, time.Hour)
+
+	// not enforced until scanned
+	_, _, ok := qt.Remaining("alice")
+	assert.False(t, ok)
+	assert.NoError(t, qt.Reserve("alice", QuotaUsage{Bytes: 100, Objects: 1}, QuotaUsage{Bytes: 100, Objects: 1}))
+	qt.Release("alice", QuotaUsage{Bytes: 100, Objects: 1}, QuotaUsage{Bytes: 100, Objects: 1})
+
+	assert.NoError(t, qt.Scan(ctx, lb, Path{"prefix"}))
+	bucketUsage, userUsage := qt.Usage("alice")
+	assert.Equal(t, QuotaUsage{Bytes: 7, Objects: 3}, bucketUsage)
+	assert.Equal(t, QuotaUsage{Bytes: 4, Objects: 1}, userUsage)
+
+	remaining, limits, ok := qt.Remaining("alice")
+	assert.True(t, ok)
+	assert.Equal(t, QuotaUsage{Bytes: 3, Objects: 1}, remaining)
+	assert.Equal(t, QuotaLimits{Bytes: 10, Objects: 2}, limits)
+
+	// the reservations of the uploads in flight add up
+	assert.NoError(t, qt.Reserve("bob", QuotaUsage{Bytes: 2, Objects: 1}, QuotaUsage{Bytes: 2, Objects: 1}))
+	err = qt.Reserve("alice", QuotaUsage{Bytes: 2, Objects: 1}, QuotaUsage{Bytes: 2, Objects: 1})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "quota exceeded: the bucket")
+	}
+	qt.Release("bob", QuotaUsage{Bytes: 2, Objects: 1}, QuotaUsage{Bytes: 2, Objects: 1})
+	qt.Add("bob", QuotaUsage{Bytes: 2, Objects: 1})
+	err = qt.Reserve("bob", QuotaUsage{Objects: 1}, QuotaUsage{Objects: 1})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "quota exceeded: user bob")
+	}
+
+	// replacing an object with a smaller one is always allowed
+	assert.NoError(t, qt.Reserve("bob", QuotaUsage{Bytes: -1}, QuotaUsage{Bytes: -1}))
+}
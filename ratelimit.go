@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that lets through up to rate bytes per
+// second on average, and up to one second worth of bytes at once.  The rate
+// can be changed at any time.
+type RateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	rl := &RateLimiter{now: time.Now}
+	rl.SetRate(rate)
+	return rl
+}
+
+func (rl *RateLimiter) advance(now time.Time) {
+	if rl.rate > 0 {
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.rate {
+			rl.tokens = rl.rate
+		}
+	}
+	rl.last = now
+}
+
+// SetRate changes the rate in bytes per second.  Zero means unlimited.
+func (rl *RateLimiter) SetRate(rate int64) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	now := rl.now()
+	rl.advance(now)
+	if rl.rate <= 0 {
+		rl.tokens = float64(rate)
+	}
+	rl.rate = float64(rate)
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+}
+
+func (rl *RateLimiter) Rate() int64 {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	return int64(rl.rate)
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait until
+// they are available.  The bucket can go into debt, so that a chunk larger
+// than the bucket is let through after it has been paid off.
+func (rl *RateLimiter) reserve(n int) time.Duration {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	if rl.rate <= 0 {
+		return 0
+	}
+	rl.advance(rl.now())
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+func (rl *RateLimiter) cancel(n int) {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	if rl.rate > 0 {
+		rl.tokens += float64(n)
+	}
+}
+
+// waitAll waits until n bytes are let through all the limiters.
+func waitAll(ctx context.Context, limiters []*RateLimiter, n int) error {
+	var wait time.Duration
+	for _, rl := range limiters {
+		if d := rl.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		for _, rl := range limiters {
+			rl.cancel(n)
+		}
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// BandwidthLimit is the rates in bytes per second.  Zero means unlimited.
+type BandwidthLimit struct {
+	Download int64
+	Upload   int64
+}
+
+type rateLimiterPair struct {
+	download *RateLimiter
+	upload   *RateLimiter
+}
+
+func newRateLimiterPair(limit BandwidthLimit) *rateLimiterPair {
+	return &rateLimiterPair{
+		download: NewRateLimiter(limit.Download),
+		upload:   NewRateLimiter(limit.Upload),
+	}
+}
+
+func (p *rateLimiterPair) set(limit BandwidthLimit) {
+	p.download.SetRate(limit.Download)
+	p.upload.SetRate(limit.Upload)
+}
+
+// BandwidthLimiters holds the rate limiters for the whole server, for each
+// bucket config and for each user.  They outlive the configuration so that
+// the limits can be changed on reload without dropping the sessions.
+type BandwidthLimiters struct {
+	mtx     sync.Mutex
+	global  *rateLimiterPair
+	buckets map[string]*rateLimiterPair
+	users   map[string]*rateLimiterPair
+}
+
+func NewBandwidthLimiters() *BandwidthLimiters {
+	return &BandwidthLimiters{
+		global:  newRateLimiterPair(BandwidthLimit{}),
+		buckets: map[string]*rateLimiterPair{},
+		users:   map[string]*rateLimiterPair{},
+	}
+}
+
+// Configure applies the limits to the sessions to come and to those already
+// established.  The limiters of the bucket configs and the users no longer
+// configured are lifted.
+func (bl *BandwidthLimiters) Configure(global BandwidthLimit, s3bs *S3Buckets) {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	bl.global.set(global)
+	for name, p := range bl.buckets {
+		limit := BandwidthLimit{}
+		if bucket := s3bs.Get(name); bucket != nil {
+			limit = bucket.Bandwidth
+		}
+		p.set(limit)
+	}
+	for user, p := range bl.users {
+		limit := BandwidthLimit{}
+		if bucket, ok := s3bs.UserToBucketMap[user]; ok {
+			limit = bucket.UserBandwidth
+		}
+		p.set(limit)
+	}
+}
+
+// Throttle returns the throttle for a session of the user, which is
+// canceled along with ctx.
+func (bl *BandwidthLimiters) Throttle(ctx context.Context, user string, bucket *S3Bucket) *Throttle {
+	if bl == nil {
+		return nil
+	}
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	bp, ok := bl.buckets[bucket.Name]
+	if !ok {
+		bp = newRateLimiterPair(bucket.Bandwidth)
+		bl.buckets[bucket.Name] = bp
+	}
+	up, ok := bl.users[user]
+	if !ok {
+		up = newRateLimiterPair(bucket.UserBandwidth)
+		bl.users[user] = up
+	}
+	return &Throttle{
+		Ctx:      ctx,
+		Download: []*RateLimiter{bl.global.download, bp.download, up.download},
+		Upload:   []*RateLimiter{bl.global.upload, bp.upload, up.upload},
+	}
+}
+
+// Throttle slows down the transfers of a session to the limits.
+type Throttle struct {
+	Ctx      context.Context
+	Download []*RateLimiter
+	Upload   []*RateLimiter
+}
+
+// WaitDownload waits until n bytes may be sent to the client.
+func (th *Throttle) WaitDownload(n int) error {
+	if th == nil {
+		return nil
+	}
+	return waitAll(th.Ctx, th.Download, n)
+}
+
+// WaitUpload waits until n bytes may be received from the client.
+func (th *Throttle) WaitUpload(n int) error {
+	if th == nil {
+		return nil
+	}
+	return waitAll(th.Ctx, th.Upload, n)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1, 0)
+	rl := &RateLimiter{now: func() time.Time { return now }}
+	rl.SetRate(100)
+
+	assert.Equal(t, time.Duration(0), rl.reserve(100))
+	assert.Equal(t, 500*time.Millisecond, rl.reserve(50))
+	now = now.Add(time.Second)
+	// a chunk larger than the bucket is let through after the debt is paid
+	assert.Equal(t, 2*time.Second, rl.reserve(250))
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, time.Duration(0), rl.reserve(100))
+
+	rl.SetRate(0)
+	assert.Equal(t, time.Duration(0), rl.reserve(1000000))
+	rl.SetRate(10)
+	assert.Equal(t, time.Duration(0), rl.reserve(10))
+	assert.Equal(t, time.Second, rl.reserve(10))
+}
+
+func TestBandwidthLimiters(t *testing.T) {
+	bucket := &S3Bucket{
+		Name:          "test",
+		Bandwidth:     BandwidthLimit{Download: 1000},
+		UserBandwidth: BandwidthLimit{Upload: 100},
+	}
+	s3bs := &S3Buckets{
+		Buckets:         map[string]*S3Bucket{"test": bucket},
+		UserToBucketMap: map[string]*S3Bucket{"user01": bucket},
+	}
+	bl := NewBandwidthLimiters()
+	bl.Configure(BandwidthLimit{Upload: 10000}, s3bs)
+	th := bl.Throttle(context.Background(), "user01", bucket)
+	rates := func(limiters []*RateLimiter) []int64 {
+		retval := []int64{}
+		for _, rl := range limiters {
+			retval = append(retval, rl.Rate())
+		}
+		return retval
+	}
+	assert.Equal(t, []int64{0, 1000, 0}, rates(th.Download))
+	assert.Equal(t, []int64{10000, 0, 100}, rates(th.Upload))
+
+	// the sessions established follow the new limits
+	newBucket := *bucket
+	newBucket.Bandwidth = BandwidthLimit{Download: 2000}
+	newBucket.UserBandwidth = BandwidthLimit{}
+	bl.Configure(BandwidthLimit{}, &S3Buckets{
+		Buckets:         map[string]*S3Bucket{"test": &newBucket},
+		UserToBucketMap: map[string]*S3Bucket{"user01": &newBucket},
+	})
+	assert.Equal(t, []int64{0, 2000, 0}, rates(th.Download))
+	assert.Equal(t, []int64{0, 0, 0}, rates(th.Upload))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bl.Configure(BandwidthLimit{Download: 1}, s3bs)
+	th = bl.Throttle(ctx, "user01", bucket)
+	assert.NoError(t, th.WaitDownload(1))
+	assert.Equal(t, context.Canceled, th.WaitDownload(10))
+}
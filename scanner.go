@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var defaultScannerTimeout = 60 * time.Second
+
+const clamdChunkSize = 65536
+
+type ScanResult struct {
+	Engine    string
+	Infected  bool
+	Signature string
+}
+
+// Metadata returns the verdict in the form stored along with the object.
+func (sr *ScanResult) Metadata() map[string]string {
+	status := "clean"
+	if sr.Infected {
+		status = "infected"
+	}
+	retval := map[string]string{
+		"scan-engine": sr.Engine,
+		"scan-status": status,
+	}
+	if sr.Signature != "" {
+		retval["scan-signature"] = sr.Signature
+	}
+	return retval
+}
+
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+type InfectedAction int
+
+const (
+	InfectedActionReject = iota
+	InfectedActionQuarantine
+)
+
+var infectedActionNameToEnumMap = map[string]InfectedAction{
+	"":           InfectedActionReject,
+	"reject":     InfectedActionReject,
+	"quarantine": InfectedActionQuarantine,
+}
+
+func (v *InfectedAction) UnmarshalText(text []byte) error {
+	_v, ok := infectedActionNameToEnumMap[strings.ToLower(string(text))]
+	if !ok {
+		return fmt.Errorf("invalid value for InfectedAction: %s", string(text))
+	}
+	*v = _v
+	return nil
+}
+
+// dialWithContext connects to the scanner and arranges the connection to be
+// torn down as soon as either the context is canceled or the timeout elapses.
+func dialWithContext(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, func(), error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	doneChan := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-doneChan:
+		}
+	}()
+	return conn, func() {
+		close(doneChan)
+		conn.Close()
+	}, nil
+}
+
+// ClamdScanner talks to clamd through the INSTREAM command.
+type ClamdScanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+func (cs *ClamdScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	conn, closer, err := dialWithContext(ctx, cs.Network, cs.Address, cs.Timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to clamd")
+	}
+	defer closer()
+
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to send command to clamd")
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[0:4], uint32(n))
+			_, werr := conn.Write(buf[0 : 4+n])
+			if werr != nil {
+				return nil, errors.Wrapf(werr, "failed to send data to clamd")
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	_, err = conn.Write([]byte{0, 0, 0, 0})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to send data to clamd")
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return nil, errors.Wrapf(err, "failed to read reply from clamd")
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+func parseClamdReply(reply string) (*ScanResult, error) {
+	// the reply looks like "stream: OK" or "stream: Eicar-Signature FOUND"
+	i := strings.Index(reply, ": ")
+	if i < 0 {
+		return nil, fmt.Errorf("unexpected reply from clamd: %s", reply)
+	}
+	verdict := reply[i+2:]
+	switch {
+	case verdict == "OK":
+		return &ScanResult{Engine: "clamd"}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return &ScanResult{
+			Engine:    "clamd",
+			Infected:  true,
+			Signature: strings.TrimSuffix(verdict, " FOUND"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("clamd reported an error: %s", verdict)
+	}
+}
+
+// ICAPScanner submits the content to an ICAP server as a RESPMOD request.
+type ICAPScanner struct {
+	Host    string
+	URL     string
+	Timeout time.Duration
+}
+
+var icapInfectionHeaders = []string{"X-Infection-Found", "X-Virus-Id", "X-Violations-Found"}
+
+func (is *ICAPScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	conn, closer, err := dialWithContext(ctx, "tcp", is.Host, is.Timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to ICAP server")
+	}
+	defer closer()
+
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", is.URL)
+	fmt.Fprintf(w, "Host: %s\r\n", is.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHdr))
+	w.WriteString(resHdr)
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[0:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	err = w.Flush()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to send data to ICAP server")
+	}
+
+	tr := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := tr.ReadLine()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read reply from ICAP server")
+	}
+	hdrs, err := tr.ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(hdrs) > 0) {
+		return nil, errors.Wrapf(err, "failed to read reply from ICAP server")
+	}
+	return parseICAPReply(statusLine, hdrs)
+}
+
+func parseICAPReply(statusLine string, hdrs textproto.MIMEHeader) (*ScanResult, error) {
+	fields := strings.SplitN(statusLine, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return nil, fmt.Errorf("unexpected reply from ICAP server: %s", statusLine)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected reply from ICAP server: %s", statusLine)
+	}
+	switch status {
+	case 204:
+		return &ScanResult{Engine: "icap"}, nil
+	case 200:
+		// some servers return the content unchanged instead of 204 even if
+		// it is clean, so only the infection headers tell it is blocked
+		result := &ScanResult{Engine: "icap"}
+		for _, name := range icapInfectionHeaders {
+			if v := hdrs.Get(name); v != "" {
+				result.Infected = true
+				result.Signature = icapThreatName(v)
+				break
+			}
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("ICAP server reported an error: %s", statusLine)
+	}
+}
+
+// icapThreatName extracts the threat name from an X-Infection-Found header,
+// which is formatted like "Type=0; Resolution=2; Threat=Eicar;".
+func icapThreatName(v string) string {
+	for _, f := range strings.Split(v, ";") {
+		f = strings.TrimSpace(f)
+		if strings.HasPrefix(f, "Threat=") {
+			return f[len("Threat="):]
+		}
+	}
+	return strings.TrimSpace(v)
+}
+
+func buildClamdScanner(sCfg *ScannerConfig, timeout time.Duration) (Scanner, error) {
+	switch sCfg.URL.Scheme {
+	case "tcp":
+		return &ClamdScanner{Network: "tcp", Address: sCfg.URL.Host, Timeout: timeout}, nil
+	case "unix":
+		return &ClamdScanner{Network: "unix", Address: sCfg.URL.Path, Timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf(`clamd URL scheme must be either "tcp" or "unix"`)
+	}
+}
+
+func buildICAPScanner(sCfg *ScannerConfig, timeout time.Duration) (Scanner, error) {
+	if sCfg.URL.Scheme != "icap" {
+		return nil, fmt.Errorf(`ICAP URL scheme must be "icap"`)
+	}
+	host := sCfg.URL.Host
+	if sCfg.URL.Port() == "" {
+		host = net.JoinHostPort(host, "1344")
+	}
+	return &ICAPScanner{Host: host, URL: sCfg.URL.String(), Timeout: timeout}, nil
+}
+
+func buildScanner(sCfg *ScannerConfig) (Scanner, error) {
+	timeout := defaultScannerTimeout
+	if sCfg.Timeout != nil {
+		timeout = sCfg.Timeout.Duration
+	}
+	switch sCfg.Type {
+	case "clamd":
+		return buildClamdScanner(sCfg, timeout)
+	case "icap":
+		return buildICAPScanner(sCfg, timeout)
+	default:
+		return nil, fmt.Errorf("unknown scanner type: %s", sCfg.Type)
+	}
+}
+
+func NewScannersFromConfig(cfg *S3SFTPProxyConfig) (map[string]Scanner, error) {
+	scanners := map[string]Scanner{}
+	for name, sCfg := range cfg.Scanners {
+		scanner, err := buildScanner(sCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "scanner config %s", name)
+		}
+		scanners[name] = scanner
+	}
+	return scanners, nil
+}
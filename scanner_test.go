@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSignature = "Test-Malware-Signature"
+
+var testMalwarePattern = []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR")
+
+// fakeClamd serves INSTREAM requests and flags any stream containing
+// testMalwarePattern.
+type fakeClamd struct {
+	lsnr     net.Listener
+	received [][]byte
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &fakeClamd{lsnr: lsnr}
+	go fc.serve()
+	return fc
+}
+
+func (fc *fakeClamd) serve() {
+	for {
+		conn, err := fc.lsnr.Accept()
+		if err != nil {
+			return
+		}
+		fc.handle(conn)
+	}
+}
+
+func (fc *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	if cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	content := []byte{}
+	for {
+		var l uint32
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return
+		}
+		if l == 0 {
+			break
+		}
+		chunk := make([]byte, l)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		content = append(content, chunk...)
+	}
+	fc.received = append(fc.received, content)
+	if bytes.Contains(content, testMalwarePattern) {
+		conn.Write([]byte("stream: " + testSignature + " FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+func (fc *fakeClamd) Close() {
+	fc.lsnr.Close()
+}
+
+func (fc *fakeClamd) Scanner() *ClamdScanner {
+	return &ClamdScanner{
+		Network: "tcp",
+		Address: fc.lsnr.Addr().String(),
+		Timeout: 5 * time.Second,
+	}
+}
+
+func TestClamdScannerClean(t *testing.T) {
+	fc := newFakeClamd(t)
+	defer fc.Close()
+	content := bytes.Repeat([]byte("clean"), clamdChunkSize)
+	result, err := fc.Scanner().Scan(context.Background(), bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, false, result.Infected)
+	assert.Equal(t, content, fc.received[0])
+	assert.Equal(t, map[string]string{"scan-engine": "clamd", "scan-status": "clean"}, result.Metadata())
+}
+
+func TestClamdScannerInfected(t *testing.T) {
+	fc := newFakeClamd(t)
+	defer fc.Close()
+	result, err := fc.Scanner().Scan(context.Background(), bytes.NewReader(testMalwarePattern))
+	assert.NoError(t, err)
+	assert.Equal(t, true, result.Infected)
+	assert.Equal(t, testSignature, result.Signature)
+	assert.Equal(t, "infected", result.Metadata()["scan-status"])
+}
+
+func TestClamdScannerUnreachable(t *testing.T) {
+	fc := newFakeClamd(t)
+	scanner := fc.Scanner()
+	fc.Close()
+	_, err := scanner.Scan(context.Background(), bytes.NewReader([]byte("abc")))
+	assert.Error(t, err)
+}
+
+func TestParseClamdReply(t *testing.T) {
+	_, err := parseClamdReply("INSTREAM size limit exceeded. ERROR")
+	assert.Error(t, err)
+	_, err = parseClamdReply("stream: Can't allocate memory ERROR")
+	assert.Error(t, err)
+}
+
+func TestParseICAPReply(t *testing.T) {
+	// the content returned unchanged without 204
+	result, err := parseICAPReply("ICAP/1.0 200 OK", textproto.MIMEHeader{"Encapsulated": {"res-hdr=0, res-body=64"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, false, result.Infected)
+	}
+	result, err = parseICAPReply("ICAP/1.0 200 OK", textproto.MIMEHeader{"X-Virus-Id": {testSignature}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, true, result.Infected)
+		assert.Equal(t, testSignature, result.Signature)
+	}
+	_, err = parseICAPReply("ICAP/1.0 500 Server Error", textproto.MIMEHeader{})
+	assert.Error(t, err)
+}
+
+func TestICAPScanner(t *testing.T) {
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsnr.Close()
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+			tr := textproto.NewReader(bufio.NewReader(conn))
+			tr.ReadLine()
+			tr.ReadMIMEHeader()
+			tr.ReadLine()
+			tr.ReadMIMEHeader()
+			body, _ := ioutil.ReadAll(httputil.NewChunkedReader(tr.R))
+			if bytes.Contains(body, testMalwarePattern) {
+				conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=" + testSignature + ";\r\nEncapsulated: null-body=0\r\n\r\n"))
+			} else {
+				conn.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	scanner := &ICAPScanner{
+		Host:    lsnr.Addr().String(),
+		URL:     "icap://" + lsnr.Addr().String() + "/avscan",
+		Timeout: 5 * time.Second,
+	}
+	result, err := scanner.Scan(context.Background(), strings.NewReader("clean"))
+	assert.NoError(t, err)
+	assert.Equal(t, false, result.Infected)
+	result, err = scanner.Scan(context.Background(), bytes.NewReader(testMalwarePattern))
+	assert.NoError(t, err)
+	assert.Equal(t, true, result.Infected)
+	assert.Equal(t, testSignature, result.Signature)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const scpBufferSize = 32768
+
+type scpOptions struct {
+	Sink                    bool
+	Source                  bool
+	Recursive               bool
+	PreserveTimes           bool
+	TargetShouldBeDirectory bool
+}
+
+// scpRemoteError is an error reported by the peer through the protocol.
+type scpRemoteError struct {
+	Fatal   bool
+	Message string
+}
+
+func (e *scpRemoteError) Error() string {
+	return e.Message
+}
+
+type scpSession struct {
+	ec     *ExecContext
+	opts   scpOptions
+	in     *bufio.Reader
+	errors int
+}
+
+func parseSCPArgs(args []string) (scpOptions, []string, error) {
+	opts := scpOptions{}
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 't':
+				opts.Sink = true
+			case 'f':
+				opts.Source = true
+			case 'r':
+				opts.Recursive = true
+			case 'p':
+				opts.PreserveTimes = true
+			case 'd':
+				opts.TargetShouldBeDirectory = true
+			case 'v', 'q', 'E':
+				// ignored
+			default:
+				return opts, nil, fmt.Errorf("unsupported option: -%c", c)
+			}
+		}
+	}
+	paths := args[i:]
+	if opts.Sink == opts.Source {
+		return opts, nil, fmt.Errorf("either -t or -f must be specified")
+	}
+	if len(paths) == 0 {
+		return opts, nil, fmt.Errorf("no path given")
+	}
+	if opts.Sink && len(paths) > 1 {
+		return opts, nil, fmt.Errorf("ambiguous target")
+	}
+	return opts, paths, nil
+}
+
+func (ss *scpSession) ack() error {
+	_, err := ss.ec.Stdout.Write([]byte{0})
+	return err
+}
+
+// reportError sends a non-fatal error to the peer.
+func (ss *scpSession) reportError(err error) error {
+	ss.errors++
+	msg := strings.Replace(err.Error(), "\n", " ", -1)
+	F(ss.ec.BucketIO.Log.Debug, "scp: %s", msg)
+	_, werr := fmt.Fprintf(ss.ec.Stdout, "\x01scp: %s\n", msg)
+	return werr
+}
+
+func (ss *scpSession) readResponse() error {
+	b, err := ss.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		line, err := ss.in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		return &scpRemoteError{Fatal: b == 2, Message: strings.TrimSuffix(line, "\n")}
+	default:
+		return fmt.Errorf("protocol error: unexpected response 0x%02x", b)
+	}
+}
+
+// readResponseOrFail reads a response and returns an error only when the
+// transfer cannot continue.  It returns false without an error when the peer
+// reported a non-fatal error, in which case the current file is skipped.
+func (ss *scpSession) readResponseOrFail() (bool, error) {
+	err := ss.readResponse()
+	if err != nil {
+		if rerr, ok := err.(*scpRemoteError); ok && !rerr.Fatal {
+			ss.errors++
+			fmt.Fprintf(ss.ec.Stderr, "%s\n", rerr.Message)
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (ss *scpSession) sendFile(p string, fi os.FileInfo) error {
+	if ss.opts.PreserveTimes {
+		t := fi.ModTime().Unix()
+		_, err := fmt.Fprintf(ss.ec.Stdout, "T%d 0 %d 0\n", t, t)
+		if err != nil {
+			return err
+		}
+		if ok, err := ss.readResponseOrFail(); !ok {
+			return err
+		}
+	}
+	r, err := ss.ec.Open(p)
+	if err != nil {
+		return ss.reportError(fmt.Errorf("%s: %s", p, err.Error()))
+	}
+	defer closeIfCloser(r)
+	_, err = fmt.Fprintf(ss.ec.Stdout, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), path.Base(p))
+	if err != nil {
+		return err
+	}
+	if ok, err := ss.readResponseOrFail(); !ok {
+		return err
+	}
+	n, err := io.CopyBuffer(ss.ec.Stdout, io.NewSectionReader(r, 0, fi.Size()), make([]byte, scpBufferSize))
+	if err != nil {
+		return err
+	}
+	if n < fi.Size() {
+		// the object got shorter while being transferred; the peer still
+		// expects as many bytes as announced.
+		_, err = ss.ec.Stdout.Write(make([]byte, fi.Size()-n))
+		if err != nil {
+			return err
+		}
+		err = ss.reportError(fmt.Errorf("%s: file changed while being transferred", p))
+	} else {
+		err = ss.ack()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = ss.readResponseOrFail()
+	return err
+}
+
+func (ss *scpSession) sendDirectory(p string, fi os.FileInfo) error {
+	entries, err := ss.ec.ReadDir(p)
+	if err != nil {
+		return ss.reportError(fmt.Errorf("%s: %s", p, err.Error()))
+	}
+	if ss.opts.PreserveTimes {
+		t := fi.ModTime().Unix()
+		_, err := fmt.Fprintf(ss.ec.Stdout, "T%d 0 %d 0\n", t, t)
+		if err != nil {
+			return err
+		}
+		if ok, err := ss.readResponseOrFail(); !ok {
+			return err
+		}
+	}
+	name := path.Base(p)
+	if name == "/" {
+		name = "."
+	}
+	_, err = fmt.Fprintf(ss.ec.Stdout, "D%04o 0 %s\n", fi.Mode().Perm(), name)
+	if err != nil {
+		return err
+	}
+	if ok, err := ss.readResponseOrFail(); !ok {
+		return err
+	}
+	for _, entry := range entries {
+		err = ss.send(path.Join(p, entry.Name()), entry)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = ss.ec.Stdout.Write([]byte("E\n"))
+	if err != nil {
+		return err
+	}
+	_, err = ss.readResponseOrFail()
+	return err
+}
+
+func (ss *scpSession) send(p string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		fi, err = ss.ec.Stat(p)
+		if err != nil {
+			return ss.reportError(fmt.Errorf("%s: %s", p, err.Error()))
+		}
+	}
+	if fi.IsDir() {
+		if !ss.opts.Recursive {
+			return ss.reportError(fmt.Errorf("%s: not a regular file", p))
+		}
+		return ss.sendDirectory(p, fi)
+	}
+	return ss.sendFile(p, fi)
+}
+
+// source serves "scp -f", sending the files to the client.
+func (ss *scpSession) source(paths []string) error {
+	err := ss.readResponse()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fi, err := ss.ec.Stat(p)
+		if err != nil {
+			err = ss.reportError(fmt.Errorf("%s: %s", p, err.Error()))
+		} else {
+			err = ss.send(p, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *scpSession) receiveFile(p string, size int64) error {
+	var werr error
+	w, err := ss.ec.Create(p)
+	if err != nil {
+		return ss.reportError(fmt.Errorf("%s: %s", p, err.Error()))
+	}
+	err = ss.ack()
+	if err != nil {
+		abortWriter(w)
+		return err
+	}
+	buf := make([]byte, scpBufferSize)
+	for o := int64(0); o < size; {
+		n := int64(len(buf))
+		if n > size-o {
+			n = size - o
+		}
+		_, err := io.ReadFull(ss.in, buf[:n])
+		if err != nil {
+			abortWriter(w)
+			return err
+		}
+		if werr == nil {
+			_, werr = w.WriteAt(buf[:n], o)
+		}
+		o += n
+	}
+	err = ss.readResponse()
+	if err != nil {
+		abortWriter(w)
+		if rerr, ok := err.(*scpRemoteError); ok && !rerr.Fatal {
+			ss.errors++
+			return nil
+		}
+		return err
+	}
+	if werr != nil {
+		abortWriter(w)
+		return ss.reportError(fmt.Errorf("%s: %s", p, werr.Error()))
+	}
+	err = closeIfCloser(w)
+	if err != nil {
+		return ss.reportError(fmt.Errorf("%s: %s", p, err.Error()))
+	}
+	return ss.ack()
+}
+
+// parseSCPHeader parses the "C" and "D" lines that look like
+// "C0644 12345 filename".
+func parseSCPHeader(line string) (int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, "", fmt.Errorf("protocol error: malformed header")
+	}
+	if _, err := strconv.ParseUint(fields[0], 8, 32); err != nil {
+		return 0, "", fmt.Errorf("protocol error: bad mode")
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, "", fmt.Errorf("protocol error: bad size")
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, "", fmt.Errorf("protocol error: unexpected filename: %s", name)
+	}
+	return size, name, nil
+}
+
+// sink serves "scp -t", receiving the files from the client.
+func (ss *scpSession) sink(target string, targetIsDir bool) error {
+	err := ss.ack()
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := ss.in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("protocol error: empty line")
+		}
+		switch line[0] {
+		case 1, 2:
+			fmt.Fprintf(ss.ec.Stderr, "%s\n", line[1:])
+			if line[0] == 2 {
+				return &scpRemoteError{Fatal: true, Message: line[1:]}
+			}
+			ss.errors++
+		case 'E':
+			return ss.ack()
+		case 'T':
+			// the object timestamps are maintained by S3
+			err = ss.ack()
+		case 'C', 'D':
+			var size int64
+			var name string
+			size, name, err = parseSCPHeader(line)
+			if err != nil {
+				fmt.Fprintf(ss.ec.Stdout, "\x02scp: %s\n", err.Error())
+				return err
+			}
+			p := target
+			if targetIsDir {
+				p = path.Join(target, name)
+			}
+			if line[0] == 'D' {
+				if !ss.opts.Recursive {
+					err = fmt.Errorf("received directory without -r")
+					fmt.Fprintf(ss.ec.Stdout, "\x02scp: %s\n", err.Error())
+					return err
+				}
+				err = ss.sink(p, true)
+			} else {
+				err = ss.receiveFile(p, size)
+			}
+		default:
+			err = fmt.Errorf("protocol error: unexpected line")
+			fmt.Fprintf(ss.ec.Stdout, "\x02scp: %s\n", err.Error())
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func runSCP(ec *ExecContext) int {
+	opts, paths, err := parseSCPArgs(ec.Args[1:])
+	if err != nil {
+		fmt.Fprintf(ec.Stderr, "scp: %s\n", err.Error())
+		return 1
+	}
+	ss := &scpSession{
+		ec:   ec,
+		opts: opts,
+		in:   bufio.NewReader(ec.Stdin),
+	}
+	if opts.Sink {
+		target := paths[0]
+		targetIsDir := false
+		fi, err := ec.Stat(target)
+		if err == nil && fi.IsDir() {
+			targetIsDir = true
+		} else if opts.TargetShouldBeDirectory {
+			fmt.Fprintf(ec.Stdout, "\x02scp: %s: Not a directory\n", target)
+			return 1
+		}
+		err = ss.sink(target, targetIsDir)
+	} else {
+		err = ss.source(paths)
+	}
+	if err != nil {
+		if _, ok := err.(*scpRemoteError); !ok {
+			F(ec.BucketIO.Log.Debug, "scp: %s", err.Error())
+		}
+		return 1
+	}
+	if ss.errors > 0 {
+		return 1
+	}
+	return 0
+}
@@ -2,20 +2,41 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+// Listener holds the settings of the connections accepted on a listener.
+type Listener struct {
+	Name         string
+	ServerConfig *ssh.ServerConfig
+	// HostKeys are announced to the clients after the authentication.
+	HostKeys *HostKeys
+	// ProxyProtocolTrusted are the networks of the proxies from which the
+	// connections start with the PROXY protocol header.
+	ProxyProtocolTrusted []*net.IPNet
+}
+
 type Server struct {
-	*ssh.ServerConfig
-	*S3Buckets
+	// Listeners are the settings of each listener by name.
+	Listeners map[string]*Listener
+	S3Buckets *S3Buckets
 	*PhantomObjectMap
+	Uploads  *UploadTracker
+	Sessions *SessionRegistry
+	// Bandwidth holds the rate limiters, and is nil if the bandwidth is
+	// not limited.
+	Bandwidth *BandwidthLimiters
+	// The buffer sizes are changed with SetBufferSizes once the server is
+	// running.
 	ReaderLookbackBufferSize int
 	ReaderMinChunkSize       int
 	ListerLookbackBufferSize int
@@ -24,7 +45,83 @@ type Server struct {
 		InfoLogger
 		ErrorLogger
 	}
-	Now func() time.Time
+	// Limits is changed with SetLimits once the server is running.
+	Limits        ConnectionLimits
+	Now           func() time.Time
+	mtx           sync.RWMutex
+	stopAccepting chan struct{}
+	conns         connectionCounter
+}
+
+// Reconfigure swaps the buckets and the settings of the listeners used for
+// the connections accepted afterwards.  Connections already established keep
+// using the ones they were accepted with, while sharing the quota trackers
+// carried over with the new connections.
+func (s *Server) Reconfigure(buckets *S3Buckets, listeners map[string]*Listener) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	buckets.CarryQuotaTrackers(s.S3Buckets)
+	s.S3Buckets = buckets
+	s.Listeners = listeners
+}
+
+// SetLimits changes the limits.  The connections and the sessions already
+// established are not affected even if they exceed the new ones.
+func (s *Server) SetLimits(limits ConnectionLimits) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Limits = limits
+}
+
+// SetBufferSizes changes the buffer sizes used for the channels opened
+// afterwards.
+func (s *Server) SetBufferSizes(readerLookback, readerMinChunk, listerLookback int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ReaderLookbackBufferSize = readerLookback
+	s.ReaderMinChunkSize = readerMinChunk
+	s.ListerLookbackBufferSize = listerLookback
+}
+
+func (s *Server) currentLimits() ConnectionLimits {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.Limits
+}
+
+// currentConfig returns the buckets and the settings of the listener, which
+// are nil if the listener is no longer configured.
+func (s *Server) currentConfig(name string) (*S3Buckets, *Listener) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.S3Buckets, s.Listeners[name]
+}
+
+func (s *Server) stopAcceptingChan() chan struct{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.stopAccepting == nil {
+		s.stopAccepting = make(chan struct{})
+	}
+	return s.stopAccepting
+}
+
+// Shutdown makes the listener stop accepting new connections and waits for
+// the uploads in flight to be flushed until ctx is done.  The sessions are
+// kept alive meanwhile; it is up to the caller to cancel the context given
+// to RunListenerEventLoop afterwards.  It returns the uploads abandoned.
+func (s *Server) Shutdown(ctx context.Context) []*PhantomObjectInfo {
+	s.mtx.Lock()
+	if s.stopAccepting == nil {
+		s.stopAccepting = make(chan struct{})
+	}
+	select {
+	case <-s.stopAccepting:
+	default:
+		close(s.stopAccepting)
+	}
+	s.mtx.Unlock()
+	return s.Uploads.Drain(ctx)
 }
 
 func asHandlers(handlers interface {
@@ -33,32 +130,145 @@ func asHandlers(handlers interface {
 	sftp.FileCmder
 	sftp.FileLister
 }) sftp.Handlers {
-	return sftp.Handlers{handlers, handlers, handlers, handlers}
+	return sftp.Handlers{
+		FileGet:  handlers,
+		FilePut:  handlers,
+		FileCmd:  handlers,
+		FileList: handlers,
+	}
+}
+
+func init() {
+	// hard links cannot be made on S3
+	sftp.SetSFTPExtensions("posix-rename@openssh.com", "statvfs@openssh.com")
+}
+
+// parseSSHString extracts the string at the beginning of the request payload.
+func parseSSHString(payload []byte) (string, bool) {
+	if len(payload) < 4 {
+		return "", false
+	}
+	l := binary.BigEndian.Uint32(payload)
+	if uint64(len(payload)-4) < uint64(l) {
+		return "", false
+	}
+	return string(payload[4 : 4+l]), true
+}
+
+func (s *Server) serveSFTP(ctx context.Context, s3io *S3BucketIO, sshCh ssh.Channel) {
+	defer s.Log.Debug("HandleChannel.serveSFTP ended")
+	sec := NewSFTPExtensionChannel(ctx, s3io, sshCh)
+	handlers := asHandlers(s3io)
+	handlers.FilePut = sec
+	server := sftp.NewRequestServer(sec, handlers)
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(); err != io.EOF {
+		s.Log.Error(err.Error())
+	}
+}
+
+func (s *Server) serveExec(ctx context.Context, s3io *S3BucketIO, handler ExecHandler, args []string, sshCh ssh.Channel) {
+	defer s.Log.Debug("HandleChannel.serveExec ended")
+	defer sshCh.Close()
+	go func() {
+		<-ctx.Done()
+		sshCh.Close()
+	}()
+	status := handler(&ExecContext{
+		Ctx:      ctx,
+		BucketIO: s3io,
+		Args:     args,
+		Stdin:    sshCh,
+		Stdout:   sshCh,
+		Stderr:   sshCh.Stderr(),
+	})
+	F(s.Log.Debug, "%s exited with status %d", args[0], status)
+	sshCh.CloseWrite()
+	sshCh.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+// activityChannel records the traffic on the channel to the session.
+type activityChannel struct {
+	ssh.Channel
+	sess *Session
+	now  func() time.Time
 }
 
-func (s *Server) HandleChannel(ctx context.Context, bucket *S3Bucket, sshCh ssh.Channel, reqs <-chan *ssh.Request) {
+func (ch *activityChannel) Read(buf []byte) (int, error) {
+	n, err := ch.Channel.Read(buf)
+	if n > 0 {
+		ch.sess.Touch(ch.now())
+	}
+	return n, err
+}
+
+func (ch *activityChannel) Write(buf []byte) (int, error) {
+	n, err := ch.Channel.Write(buf)
+	if n > 0 {
+		ch.sess.Touch(ch.now())
+	}
+	return n, err
+}
+
+func (s *Server) HandleChannel(ctx context.Context, sess *Session, bucket *S3Bucket, backend StorageBackend, sshCh ssh.Channel, reqs <-chan *ssh.Request) {
 	defer s.Log.Debug("HandleChannel ended")
-	server := sftp.NewRequestServer(
-		sshCh,
-		asHandlers(
-			&S3BucketIO{
-				Ctx:    ctx,
-				Bucket: bucket,
-				ReaderLookbackBufferSize: s.ReaderLookbackBufferSize,
-				ReaderMinChunkSize:       s.ReaderMinChunkSize,
-				ListerLookbackBufferSize: s.ListerLookbackBufferSize,
-				Log:                  s.Log,
-				PhantomObjectMap:     s.PhantomObjectMap,
-				Perms:                bucket.Perms,
-				ServerSideEncryption: &bucket.ServerSideEncryption,
-				Now:                  s.Now,
-			},
-		),
-	)
+	s.mtx.RLock()
+	readerLookback, readerMinChunk, listerLookback := s.ReaderLookbackBufferSize, s.ReaderMinChunkSize, s.ListerLookbackBufferSize
+	s.mtx.RUnlock()
+	s3io := &S3BucketIO{
+		Ctx:                      ctx,
+		Bucket:                   bucket,
+		Backend:                  backend,
+		ReaderLookbackBufferSize: readerLookback,
+		ReaderMinChunkSize:       readerMinChunk,
+		ListerLookbackBufferSize: listerLookback,
+		Log:                      s.Log,
+		PhantomObjectMap:         s.PhantomObjectMap,
+		Uploads:                  s.Uploads,
+		Session:                  sess,
+		Perms:                    bucket.Perms,
+		Now:                      s.Now,
+	}
 
 	innerCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// wait for the request that tells what to serve on the channel
+	var serve func()
+	for serve == nil {
+		var req *ssh.Request
+		select {
+		case <-innerCtx.Done():
+		case req = <-reqs:
+		}
+		if req == nil {
+			sshCh.Close()
+			return
+		}
+		switch req.Type {
+		case "subsystem":
+			name, _ := parseSSHString(req.Payload)
+			if name == "sftp" {
+				serve = func() { s.serveSFTP(innerCtx, s3io, &activityChannel{sshCh, sess, s.Now}) }
+			} else {
+				F(s.Log.Info, "unsupported subsystem: %s", name)
+			}
+		case "exec":
+			cmdLine, _ := parseSSHString(req.Payload)
+			handler, args, err := lookupExecHandler(cmdLine)
+			if err == nil {
+				F(s.Log.Info, "exec: %s", cmdLine)
+				serve = func() { s.serveExec(innerCtx, s3io, handler, args, &activityChannel{sshCh, sess, s.Now}) }
+			} else {
+				F(s.Log.Info, "exec request refused: %s", err.Error())
+			}
+		}
+		req.Reply(serve != nil, nil)
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -74,93 +284,216 @@ func (s *Server) HandleChannel(ctx context.Context, bucket *S3Bucket, sshCh ssh.
 				if req == nil {
 					break outer
 				}
-				ok := false
-				if req.Type == "subsystem" && string(req.Payload[4:]) == "sftp" {
-					ok = true
-				}
-				req.Reply(ok, nil)
+				req.Reply(false, nil)
 			}
 		}
 	}()
 
 	wg.Add(1)
 	go func() {
-		defer s.Log.Debug("HandleChannel.serve ended")
 		defer wg.Done()
 		defer cancel()
-		go func() {
-			<-innerCtx.Done()
-			server.Close()
-		}()
-		if err := server.Serve(); err != io.EOF {
-			s.Log.Error(err.Error())
-		}
+		serve()
 	}()
 
 	wg.Wait()
 }
 
-func (s *Server) HandleClient(ctx context.Context, conn *net.TCPConn) error {
+// sessionCheckInterval is how often the sessions are checked against the
+// idle timeout and the maximum duration.
+var sessionCheckInterval = time.Second
+
+// expireSession aborts the uploads in flight of the session and tears it
+// down.
+func (s *Server) expireSession(sess *Session, cancel context.CancelFunc, reason string) {
+	F(s.Log.Info, "closing the session of user %s from client %s: %s", sess.User, sess.RemoteAddr.String(), reason)
+	sess.AbortUploads()
+	cancel()
+}
+
+// watchSession closes the session once it has been idle or has lasted for
+// too long.
+func (s *Server) watchSession(ctx context.Context, sess *Session, limits ConnectionLimits, cancel context.CancelFunc) {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := s.Now()
+		if limits.MaxSessionDuration > 0 && now.Sub(sess.StartTime) >= limits.MaxSessionDuration {
+			s.expireSession(sess, cancel, "maximum session duration exceeded")
+			return
+		}
+		if limits.IdleTimeout > 0 && now.Sub(sess.LastActivity()) >= limits.IdleTimeout {
+			s.expireSession(sess, cancel, "idle timeout")
+			return
+		}
+	}
+}
+
+// keepalive probes the client periodically, and closes the session once
+// the client stops answering.
+func (s *Server) keepalive(ctx context.Context, sconn ssh.Conn, sess *Session, limits ConnectionLimits, cancel context.CancelFunc) {
+	ticker := time.NewTicker(limits.KeepaliveInterval)
+	defer ticker.Stop()
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-replies:
+			pending = false
+			if err == nil {
+				missed = 0
+			}
+			continue
+		case <-ticker.C:
+		}
+		if pending {
+			missed++
+			if missed >= limits.KeepaliveCountMax {
+				s.expireSession(sess, cancel, "no response to keepalive")
+				return
+			}
+			continue
+		}
+		pending = true
+		go func() {
+			// any reply, even a failure, tells the client is alive
+			_, _, err := sconn.SendRequest("keepalive@openssh.com", true, nil)
+			replies <- err
+		}()
+	}
+}
+
+func (s *Server) HandleClient(ctx context.Context, buckets *S3Buckets, l *Listener, conn net.Conn) error {
 	defer s.Log.Debug("HandleClient ended")
 	defer func() {
 		F(s.Log.Info, "connection from client %s closed", conn.RemoteAddr().String())
 		conn.Close()
 	}()
-	F(s.Log.Info, "connected from client %s", conn.RemoteAddr().String())
+	F(s.Log.Info, "connected from client %s on listener %s", conn.RemoteAddr().String(), l.Name)
 
 	innerCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	limits := s.currentLimits()
+
+	// the connection holds a slot of the connection limits, which a client
+	// never finishing the authentication must not keep forever
+	if limits.LoginGraceTime > 0 {
+		conn.SetDeadline(time.Now().Add(limits.LoginGraceTime))
+	}
 	go func() {
 		<-innerCtx.Done()
 		conn.SetDeadline(time.Unix(1, 0))
 	}()
 
 	// Before use, a handshake must be performed on the incoming net.Conn.
-	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.ServerConfig)
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, l.ServerConfig)
 	if err != nil {
 		return err
 	}
+	conn.SetDeadline(time.Time{})
+	if innerCtx.Err() != nil {
+		// canceled while the deadline was being cleared
+		conn.SetDeadline(time.Unix(1, 0))
+	}
+
+	if s.Sessions.IsBlocked(sconn.User()) {
+		sconn.Close()
+		return fmt.Errorf("user %s is blocked; connection from client %s refused", sconn.User(), conn.RemoteAddr().String())
+	}
 
 	F(s.Log.Info, "user %s logged in", sconn.User())
-	bucket, ok := s.UserToBucketMap[sconn.User()]
+	bucket, ok := buckets.UserToBucketMap[sconn.User()]
 	if !ok {
 		return fmt.Errorf("unknown error: no bucket designated to user %s found", sconn.User())
 	}
 
+	backend, err := bucket.SessionBackend(sconn.User())
+	if err != nil {
+		sconn.Close()
+		return fmt.Errorf("could not set up the session of user %s: %s", sconn.User(), err.Error())
+	}
+
+	sess := s.Sessions.TryRegister(sconn.User(), conn.RemoteAddr(), bucket.Name, s.Now(), cancel, limits.MaxSessionsPerUser)
+	if sess == nil {
+		sconn.Close()
+		return fmt.Errorf("user %s has too many sessions; connection from client %s refused", sconn.User(), conn.RemoteAddr().String())
+	}
+	defer s.Sessions.Unregister(sess)
+	sess.Throttle = s.Bandwidth.Throttle(innerCtx, sconn.User(), bucket)
+	if limits.IdleTimeout > 0 || limits.MaxSessionDuration > 0 {
+		go s.watchSession(innerCtx, sess, limits, cancel)
+	}
+	if limits.KeepaliveInterval > 0 {
+		go s.keepalive(innerCtx, sconn, sess, limits, cancel)
+	}
+
 	wg := sync.WaitGroup{}
 
 	wg.Add(1)
 	go func(reqs <-chan *ssh.Request) {
 		defer wg.Done()
 		defer s.Log.Debug("HandleClient.requestHandler ended")
-		for _ = range reqs {
+		for req := range reqs {
+			if req.Type == hostKeysProveRequest && l.HostKeys != nil {
+				hostKeyAlgorithm := ""
+				if algConn, ok := sconn.Conn.(ssh.AlgorithmsConnMetadata); ok {
+					hostKeyAlgorithm = algConn.Algorithms().HostKey
+				}
+				sigs, err := l.HostKeys.Prove(sconn.SessionID(), hostKeyAlgorithm, req.Payload)
+				if err != nil {
+					F(s.Log.Info, "could not prove the host keys to client %s: %s", conn.RemoteAddr().String(), err.Error())
+				}
+				req.Reply(err == nil, sigs)
+				continue
+			}
+			req.Reply(false, nil)
 		}
 	}(reqs)
 
+	if l.HostKeys != nil {
+		sconn.SendRequest(hostKeysRequest, false, l.HostKeys.Announcement())
+	}
+
 	wg.Add(1)
 	go func(chans <-chan ssh.NewChannel) {
 		defer wg.Done()
 		defer cancel()
 		defer s.Log.Debug("HandleClient.channelHandler ended")
+		var channels int32
 		for newSSHCh := range chans {
 			if newSSHCh.ChannelType() != "session" {
 				newSSHCh.Reject(ssh.UnknownChannelType, "unknown channel type")
 				F(s.Log.Info, "unknown channel type: %s", newSSHCh.ChannelType())
 				continue
 			}
+			if limits.MaxChannelsPerConnection > 0 && int(atomic.LoadInt32(&channels)) >= limits.MaxChannelsPerConnection {
+				newSSHCh.Reject(ssh.ResourceShortage, "too many channels")
+				F(s.Log.Info, "too many channels opened by user %s from client %s; channel rejected", sconn.User(), conn.RemoteAddr().String())
+				continue
+			}
 			F(s.Log.Info, "channel: %s", newSSHCh.ChannelType())
 
 			sshCh, reqs, err := newSSHCh.Accept()
 			if err != nil {
-				F(s.Log.Error, "could not accept channel", err.Error())
+				F(s.Log.Error, "could not accept channel: %s", err.Error())
 				break
 			}
 
+			atomic.AddInt32(&channels, 1)
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				s.HandleChannel(innerCtx, bucket, sshCh, reqs)
+				defer atomic.AddInt32(&channels, -1)
+				s.HandleChannel(innerCtx, sess, bucket, backend, sshCh, reqs)
 			}()
 		}
 	}(chans)
@@ -169,11 +502,38 @@ func (s *Server) HandleClient(ctx context.Context, conn *net.TCPConn) error {
 	return nil
 }
 
-func (s *Server) RunListenerEventLoop(ctx context.Context, lsnr *net.TCPListener) error {
+// handleConn finds out the address of the client, and serves the client
+// with the settings of the listener unless it exceeds the connection limits.
+func (s *Server) handleConn(ctx context.Context, name string, conn *net.TCPConn) error {
+	buckets, l := s.currentConfig(name)
+	if l == nil {
+		conn.Close()
+		return fmt.Errorf("listener %s is no longer configured; connection from client %s refused", name, conn.RemoteAddr().String())
+	}
+	_conn, err := acceptProxyHeader(conn, l.ProxyProtocolTrusted)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ip := remoteIP(_conn.RemoteAddr())
+	err = s.conns.acquire(ip, s.currentLimits())
+	if err != nil {
+		F(s.Log.Info, "connection from client %s refused: %s", _conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return nil
+	}
+	defer s.conns.release(ip)
+	return s.HandleClient(ctx, buckets, l, _conn)
+}
+
+// RunListenerEventLoop accepts the connections on lsnr, which are served
+// with the settings of the listener of the name.
+func (s *Server) RunListenerEventLoop(ctx context.Context, name string, lsnr *net.TCPListener) error {
 	defer s.Log.Debug("RunListenerEventLoop ended")
 
 	wg := sync.WaitGroup{}
 	connChan := make(chan *net.TCPConn)
+	stopAccepting := s.stopAcceptingChan()
 	var err error
 
 	wg.Add(1)
@@ -192,6 +552,9 @@ func (s *Server) RunListenerEventLoop(ctx context.Context, lsnr *net.TCPListener
 			case <-ctx.Done():
 				conn.Close()
 				break outer
+			case <-stopAccepting:
+				conn.Close()
+				break outer
 			case connChan <- conn:
 			}
 		}
@@ -204,7 +567,7 @@ outer:
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				err := s.HandleClient(ctx, conn)
+				err := s.handleConn(ctx, name, conn)
 				if err != nil {
 					s.Log.Error(err.Error())
 				}
@@ -212,11 +575,16 @@ outer:
 		case <-ctx.Done():
 			lsnr.SetDeadline(time.Unix(1, 0))
 			break outer
+		case <-stopAccepting:
+			s.Log.Info("no longer accepting connections")
+			lsnr.SetDeadline(time.Unix(1, 0))
+			break outer
 		}
 	}
 
 	// drain
-	for _ = range connChan {
+	for conn := range connChan {
+		conn.Close()
 	}
 
 	wg.Wait()
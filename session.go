@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session represents a client connection that has been authenticated.
+type Session struct {
+	ID           string
+	User         string
+	RemoteAddr   net.Addr
+	Bucket       string
+	StartTime    time.Time
+	bytesRead    int64
+	bytesWritten int64
+	openFiles    int32
+	lastActivity int64
+	cancel       context.CancelFunc
+	// Throttle limits the bandwidth of the session, if any.
+	Throttle *Throttle
+	mtx      sync.Mutex
+	writers  map[*sessionWriterAt]struct{}
+}
+
+func (sess *Session) BytesRead() int64 {
+	return atomic.LoadInt64(&sess.bytesRead)
+}
+
+func (sess *Session) BytesWritten() int64 {
+	return atomic.LoadInt64(&sess.bytesWritten)
+}
+
+func (sess *Session) OpenFiles() int {
+	return int(atomic.LoadInt32(&sess.openFiles))
+}
+
+// Touch records that the client has sent or received something at t.
+func (sess *Session) Touch(t time.Time) {
+	if sess == nil {
+		return
+	}
+	atomic.StoreInt64(&sess.lastActivity, t.UnixNano())
+}
+
+// LastActivity returns when the client has sent or received something
+// last.
+func (sess *Session) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sess.lastActivity))
+}
+
+// Disconnect aborts the uploads in flight of the session and tears down the
+// connection it belongs to, so that the files half written are not put to
+// S3 as the connection is closed.
+func (sess *Session) Disconnect() {
+	sess.AbortUploads()
+	sess.cancel()
+}
+
+// AbortUploads discards the files being written in the session, so that
+// they are not put to S3 when they are closed as the connection is torn
+// down.
+func (sess *Session) AbortUploads() {
+	sess.mtx.Lock()
+	writers := make([]*sessionWriterAt, 0, len(sess.writers))
+	for w := range sess.writers {
+		writers = append(writers, w)
+	}
+	sess.mtx.Unlock()
+	for _, w := range writers {
+		w.Abort()
+	}
+}
+
+// WrapReaderAt returns a reader that accounts the bytes read and the file
+// opened to the session, and is throttled to its bandwidth limits.
+func (sess *Session) WrapReaderAt(r io.ReaderAt) io.ReaderAt {
+	if sess == nil {
+		return r
+	}
+	atomic.AddInt32(&sess.openFiles, 1)
+	return &sessionReaderAt{ReaderAt: r, sess: sess}
+}
+
+// WrapWriterAt returns a writer that accounts the bytes written and the file
+// opened to the session, and is throttled to its bandwidth limits.
+func (sess *Session) WrapWriterAt(w io.WriterAt) io.WriterAt {
+	if sess == nil {
+		return w
+	}
+	atomic.AddInt32(&sess.openFiles, 1)
+	sw := &sessionWriterAt{WriterAt: w, sess: sess}
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+	if sess.writers == nil {
+		sess.writers = map[*sessionWriterAt]struct{}{}
+	}
+	sess.writers[sw] = struct{}{}
+	return sw
+}
+
+type sessionReaderAt struct {
+	io.ReaderAt
+	sess   *Session
+	closed int32
+}
+
+func (r *sessionReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(buf, off)
+	atomic.AddInt64(&r.sess.bytesRead, int64(n))
+	if werr := r.sess.Throttle.WaitDownload(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (r *sessionReaderAt) Close() error {
+	if atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		atomic.AddInt32(&r.sess.openFiles, -1)
+	}
+	if c, ok := r.ReaderAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type sessionWriterAt struct {
+	io.WriterAt
+	sess   *Session
+	closed int32
+}
+
+func (w *sessionWriterAt) WriteAt(buf []byte, off int64) (int, error) {
+	err := w.sess.Throttle.WaitUpload(len(buf))
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.WriterAt.WriteAt(buf, off)
+	atomic.AddInt64(&w.sess.bytesWritten, int64(n))
+	return n, err
+}
+
+func (w *sessionWriterAt) Abort() {
+	if a, ok := w.WriterAt.(Abortable); ok {
+		a.Abort()
+	}
+}
+
+func (w *sessionWriterAt) Close() error {
+	if atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		atomic.AddInt32(&w.sess.openFiles, -1)
+		w.sess.mtx.Lock()
+		delete(w.sess.writers, w)
+		w.sess.mtx.Unlock()
+	}
+	if c, ok := w.WriterAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// SessionRegistry keeps track of the live sessions and the users blocked at
+// runtime.
+type SessionRegistry struct {
+	mtx          sync.Mutex
+	lastID       uint64
+	sessions     map[string]*Session
+	blockedUsers map[string]struct{}
+}
+
+func (sr *SessionRegistry) Register(user string, remoteAddr net.Addr, bucket string, startTime time.Time, cancel context.CancelFunc) *Session {
+	return sr.TryRegister(user, remoteAddr, bucket, startTime, cancel, 0)
+}
+
+// TryRegister registers the session unless the user already has maxPerUser
+// sessions, in which case it returns nil.  Zero means unlimited.
+func (sr *SessionRegistry) TryRegister(user string, remoteAddr net.Addr, bucket string, startTime time.Time, cancel context.CancelFunc, maxPerUser int) *Session {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	if maxPerUser > 0 {
+		n := 0
+		for _, sess := range sr.sessions {
+			if sess.User == user {
+				n++
+			}
+		}
+		if n >= maxPerUser {
+			return nil
+		}
+	}
+	sr.lastID++
+	sess := &Session{
+		ID:           strconv.FormatUint(sr.lastID, 10),
+		User:         user,
+		RemoteAddr:   remoteAddr,
+		Bucket:       bucket,
+		StartTime:    startTime,
+		lastActivity: startTime.UnixNano(),
+		cancel:       cancel,
+	}
+	sr.sessions[sess.ID] = sess
+	return sess
+}
+
+func (sr *SessionRegistry) Unregister(sess *Session) {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	delete(sr.sessions, sess.ID)
+}
+
+func (sr *SessionRegistry) Get(id string) *Session {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	sess, _ := sr.sessions[id]
+	return sess
+}
+
+// List returns the live sessions in the order they were started.
+func (sr *SessionRegistry) List() []*Session {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	retval := make([]*Session, 0, len(sr.sessions))
+	for _, sess := range sr.sessions {
+		retval = append(retval, sess)
+	}
+	sort.Slice(retval, func(i, j int) bool {
+		return retval[i].StartTime.Before(retval[j].StartTime)
+	})
+	return retval
+}
+
+// DisconnectUser tears down every session of the user and returns how many
+// there were.
+func (sr *SessionRegistry) DisconnectUser(user string) int {
+	n := 0
+	for _, sess := range sr.List() {
+		if sess.User == user {
+			sess.Disconnect()
+			n++
+		}
+	}
+	return n
+}
+
+// Block prevents the user from starting new sessions.  The sessions already
+// established are not affected.
+func (sr *SessionRegistry) Block(user string) {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	sr.blockedUsers[user] = struct{}{}
+}
+
+func (sr *SessionRegistry) Unblock(user string) bool {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	_, ok := sr.blockedUsers[user]
+	delete(sr.blockedUsers, user)
+	return ok
+}
+
+func (sr *SessionRegistry) IsBlocked(user string) bool {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	_, ok := sr.blockedUsers[user]
+	return ok
+}
+
+func (sr *SessionRegistry) BlockedUsers() []string {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	retval := make([]string, 0, len(sr.blockedUsers))
+	for user := range sr.blockedUsers {
+		retval = append(retval, user)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions:     map[string]*Session{},
+		blockedUsers: map[string]struct{}{},
+	}
+}
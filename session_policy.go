@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+type iamPolicyStatement struct {
+	Effect    string                       `json:"Effect"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+type iamPolicy struct {
+	Version   string               `json:"Version"`
+	Statement []iamPolicyStatement `json:"Statement"`
+}
+
+// invalidRoleSessionNameChars are the characters not allowed in the role
+// session name.
+var invalidRoleSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// sessionRoleSessionName returns the role session name for the user, which
+// is prefixed with the one in the bucket config.
+func sessionRoleSessionName(prefix, user string) string {
+	name := prefix + "@" + invalidRoleSessionNameChars.ReplaceAllString(user, "-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// objectARNPattern returns the ARN that matches the objects under the
+// prefix in the bucket.
+func objectARNPattern(bucket string, prefix Path) string {
+	if len(prefix) == 0 {
+		return "arn:aws:s3:::" + bucket + "/*"
+	}
+	return "arn:aws:s3:::" + bucket + "/" + prefix.String() + "/*"
+}
+
+// s3SessionPolicy returns the session policy that limits the access to the
+// objects under the key prefix, and those under the quarantine prefix the
+// infected files are put to.  The permissions to use KMS are left to the
+// role if the objects are encrypted with it.
+func s3SessionPolicy(bucket string, keyPrefix, quarantinePrefix Path, kms bool) (string, error) {
+	objects := []string{objectARNPattern(bucket, keyPrefix)}
+	if len(quarantinePrefix) > 0 {
+		objects = append(objects, objectARNPattern(bucket, append(append(Path{}, quarantinePrefix...), keyPrefix...)))
+	}
+	listBucket := iamPolicyStatement{
+		Effect:   "Allow",
+		Action:   []string{"s3:ListBucket"},
+		Resource: []string{"arn:aws:s3:::" + bucket},
+	}
+	if len(keyPrefix) > 0 {
+		listBucket.Condition = map[string]map[string]string{
+			"StringLike": {"s3:prefix": keyPrefix.String() + "/*"},
+		}
+	}
+	policy := iamPolicy{
+		Version: "2012-10-17",
+		Statement: []iamPolicyStatement{
+			{
+				Effect: "Allow",
+				// the objects are put and copied with the canned ACL,
+				// which takes s3:PutObjectAcl besides s3:PutObject
+				Action: []string{
+					"s3:GetObject",
+					"s3:GetObjectAcl",
+					"s3:PutObject",
+					"s3:PutObjectAcl",
+					"s3:DeleteObject",
+					"s3:AbortMultipartUpload",
+					"s3:ListMultipartUploadParts",
+				},
+				Resource: objects,
+			},
+			listBucket,
+		},
+	}
+	if kms {
+		policy.Statement = append(policy.Statement, iamPolicyStatement{
+			Effect:   "Allow",
+			Action:   []string{"kms:Decrypt", "kms:GenerateDataKey"},
+			Resource: []string{"*"},
+		})
+	}
+	b, err := json.Marshal(&policy)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
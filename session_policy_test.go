@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3SessionPolicy(t *testing.T) {
+	policy, err := s3SessionPolicy("bucket", Path{"tenants", "a"}, Path{"quarantine"}, false)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Effect": "Allow",
+				"Action": ["s3:GetObject", "s3:GetObjectAcl", "s3:PutObject", "s3:PutObjectAcl", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"],
+				"Resource": ["arn:aws:s3:::bucket/tenants/a/*", "arn:aws:s3:::bucket/quarantine/tenants/a/*"]
+			},
+			{
+				"Effect": "Allow",
+				"Action": ["s3:ListBucket"],
+				"Resource": ["arn:aws:s3:::bucket"],
+				"Condition": {"StringLike": {"s3:prefix": "tenants/a/*"}}
+			}
+		]
+	}`, policy)
+
+	policy, err = s3SessionPolicy("bucket", Path{}, Path{}, true)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Effect": "Allow",
+				"Action": ["s3:GetObject", "s3:GetObjectAcl", "s3:PutObject", "s3:PutObjectAcl", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"],
+				"Resource": ["arn:aws:s3:::bucket/*"]
+			},
+			{
+				"Effect": "Allow",
+				"Action": ["s3:ListBucket"],
+				"Resource": ["arn:aws:s3:::bucket"]
+			},
+			{
+				"Effect": "Allow",
+				"Action": ["kms:Decrypt", "kms:GenerateDataKey"],
+				"Resource": ["*"]
+			}
+		]
+	}`, policy)
+}
+
+func TestSessionRoleSessionName(t *testing.T) {
+	assert.Equal(t, "s3-sftp-proxy@user.name", sessionRoleSessionName("s3-sftp-proxy", "user.name"))
+	assert.Equal(t, "s3-sftp-proxy@a-b-c", sessionRoleSessionName("s3-sftp-proxy", "a b/c"))
+	assert.Equal(t, 64, len(sessionRoleSessionName("s3-sftp-proxy", strings.Repeat("u", 100))))
+}
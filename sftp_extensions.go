@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+)
+
+const (
+	sshFxOk               = 0
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+)
+
+const maxSFTPPacketLength = 1 << 20
+
+// sftpExtensionPairs are advertised in addition to those pkg/sftp handles by
+// itself.
+var sftpExtensionPairs = [][2]string{
+	{"check-file", "md5,sha1,sha256"},
+	{"copy-file", "1"},
+	{"copy-data", "1"},
+}
+
+var checkFileAlgorithms = map[string]*checksumAlgorithm{
+	"md5":    md5Checksum,
+	"sha1":   sha1Checksum,
+	"sha256": sha256Checksum,
+}
+
+type sftpExtensionHandler func(sec *SFTPExtensionChannel, id uint32, d *sftpPacketDecoder) []byte
+
+var sftpExtensionHandlers = map[string]sftpExtensionHandler{
+	"check-file-name":   (*SFTPExtensionChannel).checkFileName,
+	"check-file-handle": (*SFTPExtensionChannel).checkFileHandle,
+	"copy-file":         (*SFTPExtensionChannel).copyFile,
+	"copy-data":         (*SFTPExtensionChannel).copyData,
+}
+
+type sftpPacketDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *sftpPacketDecoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("malformed packet")
+	}
+	d.b = nil
+}
+
+func (d *sftpPacketDecoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *sftpPacketDecoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *sftpPacketDecoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *sftpPacketDecoder) string() string {
+	l := d.uint32()
+	if uint64(len(d.b)) < uint64(l) {
+		d.fail()
+		return ""
+	}
+	v := string(d.b[:l])
+	d.b = d.b[l:]
+	return v
+}
+
+func (d *sftpPacketDecoder) bool() bool {
+	return d.byte() != 0
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendSSHString(b []byte, v string) []byte {
+	return append(appendUint32(b, uint32(len(v))), v...)
+}
+
+func sftpStatusPacket(id uint32, err error) []byte {
+	code := uint32(sshFxOk)
+	msg := ""
+	if err != nil {
+		code = sshFxFailure
+		if err == os.ErrNotExist {
+			code = sshFxNoSuchFile
+		} else if os.IsPermission(err) {
+			code = sshFxPermissionDenied
+		}
+		msg = err.Error()
+	}
+	b := appendUint32([]byte{sshFxpStatus}, id)
+	b = appendUint32(b, code)
+	b = appendSSHString(b, msg)
+	return appendSSHString(b, "")
+}
+
+// SFTPExtensionChannel sits between the SSH channel and the request server
+// of pkg/sftp, and serves the extended requests that pkg/sftp does not know
+// of.  To find out which file a handle refers to, it also keeps track of the
+// handles the request server returns, and of the writers opened for them
+// when it is given to the request server as the FileWriter.
+type SFTPExtensionChannel struct {
+	io.ReadWriteCloser
+	Ctx      context.Context
+	BucketIO *S3BucketIO
+	pending  []byte
+	wmtx     sync.Mutex
+	wbuf     []byte
+	mtx      sync.Mutex
+	opening  map[uint32]string
+	handles  map[string]string
+	// writeOpening holds the IDs of the open requests for writing by the
+	// path in the order they are sent, which is the order pkg/sftp calls
+	// Filewrite in, and openedWriters the writers of those until the
+	// handles are returned.
+	writeOpening  map[string][]uint32
+	openedWriters map[uint32]io.WriterAt
+	writers       map[string]io.WriterAt
+}
+
+func NewSFTPExtensionChannel(ctx context.Context, s3io *S3BucketIO, rwc io.ReadWriteCloser) *SFTPExtensionChannel {
+	return &SFTPExtensionChannel{
+		ReadWriteCloser: rwc,
+		Ctx:             ctx,
+		BucketIO:        s3io,
+		opening:         map[uint32]string{},
+		handles:         map[string]string{},
+		writeOpening:    map[string][]uint32{},
+		openedWriters:   map[uint32]io.WriterAt{},
+		writers:         map[string]io.WriterAt{},
+	}
+}
+
+func (sec *SFTPExtensionChannel) readPacket() ([]byte, error) {
+	var l [4]byte
+	_, err := io.ReadFull(sec.ReadWriteCloser, l[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n < 1 || n > maxSFTPPacketLength {
+		return nil, fmt.Errorf("packet too long: %d bytes", n)
+	}
+	pkt := make([]byte, 4+n)
+	copy(pkt, l[:])
+	_, err = io.ReadFull(sec.ReadWriteCloser, pkt[4:])
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// intercept looks into the packet sent from the client and returns true if
+// it is to be served here instead of the request server.
+func (sec *SFTPExtensionChannel) intercept(pkt []byte) bool {
+	d := &sftpPacketDecoder{b: pkt[5:]}
+	switch pkt[4] {
+	case sshFxpOpen:
+		id := d.uint32()
+		req := sftp.NewRequest("Open", d.string())
+		req.Flags = d.uint32()
+		if d.err == nil {
+			flags := req.Pflags()
+			sec.mtx.Lock()
+			sec.opening[id] = req.Filepath
+			if flags.Write || flags.Append || flags.Creat || flags.Trunc {
+				sec.writeOpening[req.Filepath] = append(sec.writeOpening[req.Filepath], id)
+			}
+			sec.mtx.Unlock()
+		}
+	case sshFxpClose:
+		d.uint32()
+		handle := d.string()
+		sec.mtx.Lock()
+		delete(sec.handles, handle)
+		delete(sec.writers, handle)
+		sec.mtx.Unlock()
+	case sshFxpExtended:
+		id := d.uint32()
+		name := d.string()
+		handler, ok := sftpExtensionHandlers[name]
+		if d.err != nil || !ok {
+			return false
+		}
+		F(sec.BucketIO.Log.Debug, "SFTP extended request: %s", name)
+		go func() {
+			sec.writePacket(handler(sec, id, d))
+		}()
+		return true
+	}
+	return false
+}
+
+func (sec *SFTPExtensionChannel) Read(buf []byte) (int, error) {
+	for len(sec.pending) == 0 {
+		pkt, err := sec.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		if !sec.intercept(pkt) {
+			sec.pending = pkt
+		}
+	}
+	n := copy(buf, sec.pending)
+	sec.pending = sec.pending[n:]
+	return n, nil
+}
+
+// rewrite looks into the packet sent from the request server, and returns
+// the packet to be sent to the client in place of it.
+func (sec *SFTPExtensionChannel) rewrite(pkt []byte) []byte {
+	d := &sftpPacketDecoder{b: pkt[5:]}
+	switch pkt[4] {
+	case sshFxpVersion:
+		for _, pair := range sftpExtensionPairs {
+			pkt = appendSSHString(pkt, pair[0])
+			pkt = appendSSHString(pkt, pair[1])
+		}
+		binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+	case sshFxpHandle:
+		id := d.uint32()
+		handle := d.string()
+		sec.mtx.Lock()
+		if p, ok := sec.opening[id]; ok {
+			delete(sec.opening, id)
+			sec.handles[handle] = p
+		}
+		if w, ok := sec.openedWriters[id]; ok {
+			delete(sec.openedWriters, id)
+			sec.writers[handle] = w
+		}
+		sec.mtx.Unlock()
+	case sshFxpStatus:
+		id := d.uint32()
+		sec.mtx.Lock()
+		delete(sec.opening, id)
+		delete(sec.openedWriters, id)
+		sec.mtx.Unlock()
+	}
+	return pkt
+}
+
+// Write is called by the request server, which may write a packet in
+// several pieces.
+func (sec *SFTPExtensionChannel) Write(buf []byte) (int, error) {
+	sec.wmtx.Lock()
+	defer sec.wmtx.Unlock()
+	sec.wbuf = append(sec.wbuf, buf...)
+	for len(sec.wbuf) >= 5 {
+		n := 4 + int(binary.BigEndian.Uint32(sec.wbuf))
+		if len(sec.wbuf) < n {
+			break
+		}
+		_, err := sec.ReadWriteCloser.Write(sec.rewrite(sec.wbuf[:n:n]))
+		if err != nil {
+			return 0, err
+		}
+		sec.wbuf = sec.wbuf[n:]
+	}
+	if len(sec.wbuf) == 0 {
+		sec.wbuf = nil
+	}
+	return len(buf), nil
+}
+
+func (sec *SFTPExtensionChannel) writePacket(body []byte) {
+	pkt := appendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	pkt = append(pkt, body...)
+	sec.wmtx.Lock()
+	defer sec.wmtx.Unlock()
+	sec.ReadWriteCloser.Write(pkt)
+}
+
+func (sec *SFTPExtensionChannel) execContext() *ExecContext {
+	return &ExecContext{Ctx: sec.Ctx, BucketIO: sec.BucketIO}
+}
+
+// Filewrite opens the file for writing through the bucket IO, and remembers
+// the writer for the handle to be returned so that the data copied into the
+// file goes through the same writer as that written by the client.
+func (sec *SFTPExtensionChannel) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	sec.mtx.Lock()
+	ids := sec.writeOpening[req.Filepath]
+	var id uint32
+	ok := len(ids) > 0
+	if ok {
+		id = ids[0]
+		if len(ids) > 1 {
+			sec.writeOpening[req.Filepath] = ids[1:]
+		} else {
+			delete(sec.writeOpening, req.Filepath)
+		}
+	}
+	sec.mtx.Unlock()
+	w, err := sec.BucketIO.Filewrite(req)
+	if err != nil || !ok {
+		return w, err
+	}
+	sec.mtx.Lock()
+	if _, opening := sec.opening[id]; opening {
+		sec.openedWriters[id] = w
+	}
+	sec.mtx.Unlock()
+	return w, nil
+}
+
+func (sec *SFTPExtensionChannel) lookupHandle(handle string) (string, error) {
+	sec.mtx.Lock()
+	defer sec.mtx.Unlock()
+	p, ok := sec.handles[handle]
+	if !ok {
+		return "", fmt.Errorf("invalid handle")
+	}
+	return p, nil
+}
+
+func (sec *SFTPExtensionChannel) checkFileName(id uint32, d *sftpPacketDecoder) []byte {
+	return sec.checkFile(id, d.string(), d)
+}
+
+func (sec *SFTPExtensionChannel) checkFileHandle(id uint32, d *sftpPacketDecoder) []byte {
+	p, err := sec.lookupHandle(d.string())
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	return sec.checkFile(id, p, d)
+}
+
+// checkFile serves "check-file-name" and "check-file-handle" as per
+// draft-ietf-secsh-filexfer-extensions.
+func (sec *SFTPExtensionChannel) checkFile(id uint32, p string, d *sftpPacketDecoder) []byte {
+	algorithms := strings.Split(d.string(), ",")
+	start := d.uint64()
+	length := d.uint64()
+	blockSize := d.uint32()
+	if d.err != nil {
+		return sftpStatusPacket(id, d.err)
+	}
+	var algorithm string
+	var ca *checksumAlgorithm
+	for _, algorithm = range algorithms {
+		ca = checkFileAlgorithms[algorithm]
+		if ca != nil {
+			break
+		}
+	}
+	if ca == nil {
+		return sftpStatusPacket(id, fmt.Errorf("no supported hash algorithm requested"))
+	}
+	if blockSize != 0 && blockSize < 256 {
+		return sftpStatusPacket(id, fmt.Errorf("block size too small"))
+	}
+
+	ec := sec.execContext()
+	var sums []byte
+	if start == 0 && length == 0 && blockSize == 0 {
+		sum, err := ec.Checksum(ca, p)
+		if err != nil {
+			return sftpStatusPacket(id, err)
+		}
+		sums, _ = hex.DecodeString(sum)
+	} else {
+		fi, err := ec.Stat(p)
+		if err != nil {
+			return sftpStatusPacket(id, err)
+		}
+		if fi.IsDir() {
+			return sftpStatusPacket(id, fmt.Errorf("is a directory"))
+		}
+		r, err := ec.Open(p)
+		if err != nil {
+			return sftpStatusPacket(id, err)
+		}
+		defer closeIfCloser(r)
+		if length == 0 || length > 1<<63-1-start {
+			length = 1<<63 - 1 - start
+		}
+		sr := io.NewSectionReader(r, int64(start), int64(length))
+		for {
+			var br io.Reader = sr
+			if blockSize != 0 {
+				br = io.LimitReader(sr, int64(blockSize))
+			}
+			h := ca.New()
+			n, err := io.CopyBuffer(h, br, make([]byte, scpBufferSize))
+			if err != nil {
+				return sftpStatusPacket(id, err)
+			}
+			if n == 0 && len(sums) > 0 {
+				break
+			}
+			sums = h.Sum(sums)
+			if blockSize == 0 || n < int64(blockSize) {
+				break
+			}
+		}
+	}
+	b := appendUint32([]byte{sshFxpExtendedReply}, id)
+	b = appendSSHString(b, "check-file")
+	b = appendSSHString(b, algorithm)
+	return append(b, sums...)
+}
+
+// copyFile serves "copy-file", which copies the object on S3.
+func (sec *SFTPExtensionChannel) copyFile(id uint32, d *sftpPacketDecoder) []byte {
+	src := sftp.NewRequest("Stat", d.string()).Filepath
+	dest := sftp.NewRequest("Stat", d.string()).Filepath
+	overwrite := d.bool()
+	if d.err != nil {
+		return sftpStatusPacket(id, d.err)
+	}
+	s3io := sec.BucketIO
+	if !s3io.Perms.Readable {
+		return sftpStatusPacket(id, fmt.Errorf("read operation not allowed as per configuration"))
+	}
+	if !s3io.Perms.Writable {
+		return sftpStatusPacket(id, fmt.Errorf("write operation not allowed as per configuration"))
+	}
+	ec := sec.execContext()
+	fi, err := ec.Stat(src)
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	if fi.IsDir() {
+		return sftpStatusPacket(id, fmt.Errorf("is a directory"))
+	}
+	if !overwrite {
+		if _, err := ec.Stat(dest); err == nil {
+			return sftpStatusPacket(id, fmt.Errorf("file already exists"))
+		}
+	}
+	srcKey := buildKey(s3io.Bucket, src)
+	destKey := buildKey(s3io.Bucket, dest)
+	if s3io.PhantomObjectMap.Get(srcKey) == nil {
+		return sftpStatusPacket(id, s3io.copyObjectWithinQuota(sec.Ctx, srcKey, destKey))
+	}
+	// the source is being uploaded; copy what has been written so far
+	r, err := ec.Open(src)
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	defer closeIfCloser(r)
+	w, err := ec.Create(dest)
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	_, err = copyAt(w, 0, io.NewSectionReader(r, 0, fi.Size()))
+	if err != nil {
+		abortWriter(w)
+		return sftpStatusPacket(id, err)
+	}
+	return sftpStatusPacket(id, closeIfCloser(w))
+}
+
+// copyData serves "copy-data".  The data is copied on the server into the
+// object being uploaded through the destination handle, which must have
+// been opened for writing on this channel.
+func (sec *SFTPExtensionChannel) copyData(id uint32, d *sftpPacketDecoder) []byte {
+	readHandle := d.string()
+	readOffset := d.uint64()
+	length := d.uint64()
+	writeHandle := d.string()
+	writeOffset := d.uint64()
+	if d.err != nil {
+		return sftpStatusPacket(id, d.err)
+	}
+	src, err := sec.lookupHandle(readHandle)
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	if _, err := sec.lookupHandle(writeHandle); err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	sec.mtx.Lock()
+	w, ok := sec.writers[writeHandle]
+	sec.mtx.Unlock()
+	if !ok {
+		return sftpStatusPacket(id, fmt.Errorf("destination handle is not open for writing"))
+	}
+	r, err := sec.execContext().Open(src)
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	defer closeIfCloser(r)
+	if length == 0 || length > 1<<63-1-readOffset {
+		length = 1<<63 - 1 - readOffset
+	}
+	if writeOffset > 1<<63-1 {
+		return sftpStatusPacket(id, fmt.Errorf("offset out of range"))
+	}
+	_, err = copyAt(w, int64(writeOffset), io.NewSectionReader(r, int64(readOffset), int64(length)))
+	return sftpStatusPacket(id, err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func sftpPacket(body []byte) []byte {
+	return append(appendUint32(nil, uint32(len(body))), body...)
+}
+
+func TestSFTPExtensionChannelVersion(t *testing.T) {
+	rwc := &bufferCloser{}
+	sec := NewSFTPExtensionChannel(context.Background(), &S3BucketIO{Log: logrus.New()}, rwc)
+	pkt := sftpPacket([]byte{sshFxpVersion, 0, 0, 0, 3})
+	// pkg/sftp writes the header and the payload separately
+	n, err := sec.Write(pkt[:5])
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 0, rwc.Len())
+	sec.Write(pkt[5:])
+	d := &sftpPacketDecoder{b: rwc.Bytes()}
+	assert.Equal(t, uint32(rwc.Len()-4), d.uint32())
+	assert.Equal(t, byte(sshFxpVersion), d.byte())
+	assert.Equal(t, uint32(3), d.uint32())
+	names := []string{}
+	for len(d.b) > 0 {
+		names = append(names, d.string())
+		d.string()
+	}
+	assert.NoError(t, d.err)
+	assert.Equal(t, []string{"check-file", "copy-file", "copy-data"}, names)
+}
+
+func TestSFTPExtensionChannelHandles(t *testing.T) {
+	rwc := &bufferCloser{}
+	sec := NewSFTPExtensionChannel(context.Background(), &S3BucketIO{Log: logrus.New()}, rwc)
+
+	open := appendUint32([]byte{sshFxpOpen}, 5)
+	open = appendSSHString(open, "a/../b")
+	open = appendUint32(open, 1)
+	open = appendUint32(open, 0)
+	assert.False(t, sec.intercept(sftpPacket(open)))
+
+	handle := appendUint32([]byte{sshFxpHandle}, 5)
+	handle = appendSSHString(handle, "1")
+	sec.Write(sftpPacket(handle))
+	p, err := sec.lookupHandle("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/b", p)
+
+	closePkt := appendUint32([]byte{sshFxpClose}, 6)
+	closePkt = appendSSHString(closePkt, "1")
+	assert.False(t, sec.intercept(sftpPacket(closePkt)))
+	_, err = sec.lookupHandle("1")
+	assert.Error(t, err)
+
+	ext := appendUint32([]byte{sshFxpExtended}, 7)
+	ext = appendSSHString(ext, "unknown@example.com")
+	assert.False(t, sec.intercept(sftpPacket(ext)))
+}
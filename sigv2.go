@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// s3V2SubResources are the query parameters that are part of the resource
+// signed with the signature version 2.
+var s3V2SubResources = map[string]bool{
+	"acl":                          true,
+	"cors":                         true,
+	"delete":                       true,
+	"lifecycle":                    true,
+	"location":                     true,
+	"logging":                      true,
+	"notification":                 true,
+	"partNumber":                   true,
+	"policy":                       true,
+	"requestPayment":               true,
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+	"restore":                      true,
+	"tagging":                      true,
+	"torrent":                      true,
+	"uploadId":                     true,
+	"uploads":                      true,
+	"versionId":                    true,
+	"versioning":                   true,
+	"versions":                     true,
+	"website":                      true,
+}
+
+// s3SignV2Handler replaces the signature version 4 signer of the S3 client
+// for the S3-compatible stores that only accept the version 2.
+var s3SignV2Handler = request.NamedHandler{
+	Name: "s3-sftp-proxy.SignV2",
+	Fn:   signS3V2,
+}
+
+func signS3V2(r *request.Request) {
+	if r.Config.Credentials == credentials.AnonymousCredentials {
+		return
+	}
+	creds, err := r.Config.Credentials.Get()
+	if err != nil {
+		r.Error = err
+		return
+	}
+	bucket := ""
+	if v, _ := awsutil.ValuesAtPath(r.Params, "Bucket"); len(v) > 0 {
+		if s, ok := v[0].(*string); ok && s != nil {
+			bucket = *s
+		}
+	}
+	req := r.HTTPRequest
+	req.Header.Del("X-Amz-Date")
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	} else {
+		req.Header.Del("X-Amz-Security-Token")
+	}
+	req.Header.Set("Authorization", "AWS "+creds.AccessKeyID+":"+s3V2Signature(creds.SecretAccessKey, s3V2StringToSign(req, bucket)))
+}
+
+func s3V2StringToSign(req *http.Request, bucket string) string {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte('\n')
+	b.WriteString(req.Header.Get("Content-MD5"))
+	b.WriteByte('\n')
+	b.WriteString(req.Header.Get("Content-Type"))
+	b.WriteByte('\n')
+	b.WriteString(req.Header.Get("Date"))
+	b.WriteByte('\n')
+
+	amzHeaders := []string{}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			amzHeaders = append(amzHeaders, lk)
+		}
+	}
+	sort.Strings(amzHeaders)
+	for _, k := range amzHeaders {
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(req.Header[http.CanonicalHeaderKey(k)], ","))
+		b.WriteByte('\n')
+	}
+
+	// the bucket is part of the host name in the virtual hosted-style
+	// requests, while it is in the path already in the path-style ones.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if bucket != "" && strings.HasPrefix(host, bucket+".") {
+		b.WriteByte('/')
+		b.WriteString(bucket)
+	}
+	uri := req.URL.EscapedPath()
+	if req.URL.Opaque != "" {
+		uri = "/" + strings.Join(strings.Split(req.URL.Opaque, "/")[3:], "/")
+	}
+	if uri == "" {
+		uri = "/"
+	}
+	b.WriteString(uri)
+
+	q := req.URL.Query()
+	subResources := []string{}
+	for k := range q {
+		if s3V2SubResources[k] {
+			subResources = append(subResources, k)
+		}
+	}
+	sort.Strings(subResources)
+	for i, k := range subResources {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		b.WriteString(k)
+		if v := q.Get(k); v != "" {
+			b.WriteByte('=')
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+func s3V2Signature(secret, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
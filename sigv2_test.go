@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3V2StringToSign(t *testing.T) {
+	// the examples in the Amazon S3 developer guide
+	req, _ := http.NewRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", nil)
+	req.Header.Set("Date", "Tue, 27 Mar 2007 19:36:42 +0000")
+	sts := s3V2StringToSign(req, "johnsmith")
+	assert.Equal(t, "GET\n\n\nTue, 27 Mar 2007 19:36:42 +0000\n/johnsmith/photos/puppy.jpg", sts)
+	assert.Equal(t, "bWq2s1WEIj+Ydj0vQ697zp+IXMU=", s3V2Signature("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", sts))
+
+	req, _ = http.NewRequest("GET", "https://s3.amazonaws.com/johnsmith/?acl&prefix=photos", nil)
+	req.Header.Set("Date", "Tue, 27 Mar 2007 19:44:46 +0000")
+	req.Header.Set("X-Amz-Meta-B", "2")
+	req.Header.Add("X-Amz-Meta-A", "1")
+	req.Header.Add("X-Amz-Meta-A", "3")
+	assert.Equal(t, "GET\n\n\nTue, 27 Mar 2007 19:44:46 +0000\nx-amz-meta-a:1,3\nx-amz-meta-b:2\n/johnsmith/?acl", s3V2StringToSign(req, "johnsmith"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// StorageObjectInfo describes an object in a storage backend.
+type StorageObjectInfo struct {
+	Key          Path
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+	// Checksums holds the checksums in hex the backend knows without
+	// reading the content, keyed by the name of the algorithm such as "md5".
+	Checksums map[string]string
+}
+
+// StorageObject is the content of an object being read.
+type StorageObject struct {
+	StorageObjectInfo
+	Body io.ReadCloser
+}
+
+// StorageListing is a page of the objects right under a prefix.
+type StorageListing struct {
+	// Prefixes are the keys that have more objects under them, that is,
+	// the directories.
+	Prefixes []Path
+	Objects  []*StorageObjectInfo
+	// Continuation is passed to ListObjects to get the next page, and is
+	// empty if this is the last one.
+	Continuation string
+}
+
+// StorageBackend is where the objects are stored.  The methods return
+// os.ErrNotExist if the object is not found.
+type StorageBackend interface {
+	// GetObject reads the object from the offset to the end.
+	GetObject(ctx context.Context, key Path, offset int64) (*StorageObject, error)
+	// PutObject replaces the object at once with the content of body.
+	PutObject(ctx context.Context, key Path, body io.Reader, metadata map[string]string) error
+	HeadObject(ctx context.Context, key Path) (*StorageObjectInfo, error)
+	// ObjectMode tells the permission bits of the object.
+	ObjectMode(ctx context.Context, key Path) (os.FileMode, error)
+	// ListObjects lists the objects and the prefixes right under prefix.
+	ListObjects(ctx context.Context, prefix Path, continuation string) (*StorageListing, error)
+	// CopyObject copies the object along with its metadata.  The values in
+	// metadata, if any, replace those of the same keys.
+	CopyObject(ctx context.Context, src, dest Path, metadata map[string]string) error
+	DeleteObject(ctx context.Context, key Path) error
+}
+
+// mergeMetadata returns the metadata with the values in overrides, which
+// replace those of the keys that are the same regardless of the case.
+func mergeMetadata(metadata, overrides map[string]string) map[string]string {
+	retval := make(map[string]string, len(metadata)+len(overrides))
+	for k, v := range metadata {
+		if _, ok := lookupMetadata(overrides, k); !ok {
+			retval[k] = v
+		}
+	}
+	for k, v := range overrides {
+		retval[k] = v
+	}
+	return retval
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The objects are encrypted in chunks of cseChunkSize bytes with AES-256-GCM
+// under a data key unique to the object, so that they can be read from the
+// middle.  The nonce of a chunk is its index, and whether it is the last
+// one is authenticated as well so that a truncated object is detected.
+// The data key is stored in the metadata wrapped with the master key.
+const (
+	cseChunkSize            = 65536
+	cseTagSize              = 16
+	cseMetadataPrefix       = "cse-"
+	cseKeyMetadataKey       = "cse-key"
+	cseKeyIDMetadataKey     = "cse-key-id"
+	cseMasterKeySize        = 32
+	cseWrappedKeyAdditional = "s3-sftp-proxy cse-key"
+)
+
+// ReadClientSideEncryptionKey reads the base64-encoded 256-bit master key
+// from the file.
+func ReadClientSideEncryptionKey(p string) ([]byte, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64-encoded string in %s", p)
+	}
+	if len(key) != cseMasterKeySize {
+		return nil, fmt.Errorf("the key in %s must be %d bytes long", p, cseMasterKeySize)
+	}
+	return key, nil
+}
+
+// csePlaintextSize returns the size of the content of an encrypted object.
+func csePlaintextSize(size int64) int64 {
+	n := (size + cseChunkSize + cseTagSize - 1) / (cseChunkSize + cseTagSize)
+	if size < n*cseTagSize {
+		return 0
+	}
+	return size - n*cseTagSize
+}
+
+func cseNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+func cseAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedBackend encrypts the objects stored in the backend on the
+// client side.  The objects without the data key in the metadata are
+// served as they are, though the sizes in the listings are told on the
+// assumption that every object is encrypted.
+type EncryptedBackend struct {
+	Backend   StorageBackend
+	MasterKey []byte
+}
+
+func (eb *EncryptedBackend) keyID() string {
+	sum := sha256.Sum256(eb.MasterKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (eb *EncryptedBackend) wrapKey(dataKey []byte) (string, error) {
+	aead, err := newGCM(eb.MasterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, dataKey, []byte(cseWrappedKeyAdditional))), nil
+}
+
+// dataKey returns the AEAD with the data key of the object, or nil if the
+// object is not encrypted.
+func (eb *EncryptedBackend) dataKey(metadata map[string]string) (cipher.AEAD, error) {
+	wrapped, ok := lookupMetadata(metadata, cseKeyMetadataKey)
+	if !ok {
+		return nil, nil
+	}
+	if keyID, _ := lookupMetadata(metadata, cseKeyIDMetadataKey); keyID != eb.keyID() {
+		return nil, fmt.Errorf("the object is encrypted with another master key (%s)", keyID)
+	}
+	b, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key")
+	}
+	aead, err := newGCM(eb.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid data key")
+	}
+	dataKey, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(cseWrappedKeyAdditional))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap the data key")
+	}
+	return newGCM(dataKey)
+}
+
+// plainInfo turns the info of an encrypted object into that of the content.
+func plainInfo(info StorageObjectInfo) StorageObjectInfo {
+	info.Size = csePlaintextSize(info.Size)
+	metadata := map[string]string{}
+	for k, v := range info.Metadata {
+		if !strings.HasPrefix(strings.ToLower(k), cseMetadataPrefix) {
+			metadata[k] = v
+		}
+	}
+	info.Metadata = metadata
+	// the checksums are those of the ciphertext
+	info.Checksums = nil
+	return info
+}
+
+func (eb *EncryptedBackend) GetObject(ctx context.Context, key Path, offset int64) (*StorageObject, error) {
+	index := offset / cseChunkSize
+	obj, err := eb.Backend.GetObject(ctx, key, index*(cseChunkSize+cseTagSize))
+	if err != nil {
+		return nil, err
+	}
+	info := obj.StorageObjectInfo
+	if _, ok := lookupMetadata(info.Metadata, cseKeyMetadataKey); !ok && index > 0 {
+		// the backend tells nothing about the object when reading past the
+		// end, which does not mean that it is not encrypted
+		_info, err := eb.Backend.HeadObject(ctx, key)
+		if err != nil {
+			obj.Body.Close()
+			return nil, err
+		}
+		info.Metadata = _info.Metadata
+	}
+	aead, err := eb.dataKey(info.Metadata)
+	if err != nil {
+		obj.Body.Close()
+		return nil, err
+	}
+	if aead == nil {
+		if offset == index*(cseChunkSize+cseTagSize) {
+			return obj, nil
+		}
+		obj.Body.Close()
+		return eb.Backend.GetObject(ctx, key, offset)
+	}
+	return &StorageObject{
+		StorageObjectInfo: plainInfo(info),
+		Body: &cseDecryptingReader{
+			body:  obj.Body,
+			r:     bufio.NewReader(obj.Body),
+			aead:  aead,
+			index: uint64(index),
+			skip:  int(offset - index*cseChunkSize),
+			buf:   make([]byte, cseChunkSize+cseTagSize),
+		},
+	}, nil
+}
+
+func (eb *EncryptedBackend) PutObject(ctx context.Context, key Path, body io.Reader, metadata map[string]string) error {
+	dataKey := make([]byte, cseMasterKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := eb.wrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+	_metadata := make(map[string]string, len(metadata)+2)
+	for k, v := range metadata {
+		_metadata[k] = v
+	}
+	_metadata[cseKeyMetadataKey] = wrapped
+	_metadata[cseKeyIDMetadataKey] = eb.keyID()
+	return eb.Backend.PutObject(ctx, key, &cseEncryptingReader{
+		r:    bufio.NewReader(body),
+		aead: aead,
+		buf:  make([]byte, cseChunkSize),
+	}, _metadata)
+}
+
+func (eb *EncryptedBackend) HeadObject(ctx context.Context, key Path) (*StorageObjectInfo, error) {
+	info, err := eb.Backend.HeadObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := lookupMetadata(info.Metadata, cseKeyMetadataKey); !ok {
+		return info, nil
+	}
+	_info := plainInfo(*info)
+	return &_info, nil
+}
+
+func (eb *EncryptedBackend) ObjectMode(ctx context.Context, key Path) (os.FileMode, error) {
+	return eb.Backend.ObjectMode(ctx, key)
+}
+
+func (eb *EncryptedBackend) ListObjects(ctx context.Context, prefix Path, continuation string) (*StorageListing, error) {
+	out, err := eb.Backend.ListObjects(ctx, prefix, continuation)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]*StorageObjectInfo, len(out.Objects))
+	for i, obj := range out.Objects {
+		_obj := plainInfo(*obj)
+		objs[i] = &_obj
+	}
+	return &StorageListing{
+		Prefixes:     out.Prefixes,
+		Objects:      objs,
+		Continuation: out.Continuation,
+	}, nil
+}
+
+// CopyObject copies the object as it is, since the data key is not bound
+// to the key of the object.
+func (eb *EncryptedBackend) CopyObject(ctx context.Context, src, dest Path, metadata map[string]string) error {
+	return eb.Backend.CopyObject(ctx, src, dest, metadata)
+}
+
+func (eb *EncryptedBackend) DeleteObject(ctx context.Context, key Path) error {
+	return eb.Backend.DeleteObject(ctx, key)
+}
+
+type cseEncryptingReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	index  uint64
+	buf    []byte
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func (er *cseEncryptingReader) sealNext() error {
+	n, err := io.ReadFull(er.r, er.buf)
+	final := false
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	case nil:
+		_, err = er.r.Peek(1)
+		if err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	er.sealed = er.aead.Seal(er.sealed[:0], cseNonce(er.index), er.buf[:n], cseAdditionalData(final))
+	er.out = er.sealed
+	er.index++
+	er.done = final
+	return nil
+}
+
+func (er *cseEncryptingReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		err := er.sealNext()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+type cseDecryptingReader struct {
+	body  io.ReadCloser
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	index uint64
+	skip  int
+	buf   []byte
+	plain []byte
+	read  bool
+	done  bool
+}
+
+func (dr *cseDecryptingReader) openNext() error {
+	n, err := io.ReadFull(dr.r, dr.buf)
+	final := false
+	switch err {
+	case io.EOF:
+		if !dr.read && dr.index > 0 {
+			// reading past the end
+			dr.done = true
+			return nil
+		}
+		return fmt.Errorf("the encrypted object is truncated")
+	case io.ErrUnexpectedEOF:
+		final = true
+	case nil:
+		_, err = dr.r.Peek(1)
+		if err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	plain, err := dr.aead.Open(dr.buf[:0], cseNonce(dr.index), dr.buf[:n], cseAdditionalData(final))
+	if err != nil {
+		return fmt.Errorf("could not decrypt the object")
+	}
+	if dr.skip > 0 {
+		if dr.skip > len(plain) {
+			dr.skip = len(plain)
+		}
+		plain = plain[dr.skip:]
+		dr.skip = 0
+	}
+	dr.plain = plain
+	dr.index++
+	dr.read = true
+	dr.done = final
+	return nil
+}
+
+func (dr *cseDecryptingReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		err := dr.openNext()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *cseDecryptingReader) Close() error {
+	return dr.body.Close()
+}
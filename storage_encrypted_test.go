@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	lb := &LocalBackend{Root: root}
+	eb := &EncryptedBackend{Backend: lb, MasterKey: bytes.Repeat([]byte{1}, 32)}
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, cseChunkSize - 1, cseChunkSize, cseChunkSize + 1, 3*cseChunkSize + 5} {
+		data := make([]byte, size)
+		rand.Read(data)
+		key := Path{"f"}
+		assert.NoError(t, eb.PutObject(ctx, key, bytes.NewReader(data), map[string]string{"k": "v"}))
+
+		raw, err := ioutil.ReadFile(filepath.Join(root, "f"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), csePlaintextSize(int64(len(raw))))
+		if size >= cseTagSize {
+			assert.NotContains(t, string(raw), string(data))
+		}
+
+		info, err := eb.HeadObject(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), info.Size)
+		assert.Equal(t, map[string]string{"k": "v"}, info.Metadata)
+
+		listing, err := eb.ListObjects(ctx, Path{}, "")
+		assert.NoError(t, err)
+		if assert.Len(t, listing.Objects, 1) {
+			assert.Equal(t, int64(size), listing.Objects[0].Size)
+		}
+
+		for _, off := range []int{0, 1, cseChunkSize - 1, cseChunkSize, cseChunkSize + 3, size, size + cseChunkSize} {
+			obj, err := eb.GetObject(ctx, key, int64(off))
+			if !assert.NoError(t, err) {
+				continue
+			}
+			b, err := ioutil.ReadAll(obj.Body)
+			obj.Body.Close()
+			assert.NoError(t, err)
+			if off < size {
+				assert.Equal(t, data[off:], b, "size=%d, off=%d", size, off)
+			} else {
+				assert.Empty(t, b, "size=%d, off=%d", size, off)
+			}
+		}
+	}
+
+	// truncated
+	data := make([]byte, 2*cseChunkSize)
+	assert.NoError(t, eb.PutObject(ctx, Path{"g"}, bytes.NewReader(data), nil))
+	raw, err := lb.GetObject(ctx, Path{"g"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(raw.Body)
+	raw.Body.Close()
+	assert.NoError(t, lb.PutObject(ctx, Path{"g"}, bytes.NewReader(b[:cseChunkSize+cseTagSize]), raw.Metadata))
+	obj, err := eb.GetObject(ctx, Path{"g"}, 0)
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		assert.Error(t, err)
+	}
+
+	// another master key
+	other := &EncryptedBackend{Backend: lb, MasterKey: bytes.Repeat([]byte{2}, 32)}
+	_, err = other.GetObject(ctx, Path{"f"}, 0)
+	assert.Error(t, err)
+
+	// not encrypted
+	assert.NoError(t, lb.PutObject(ctx, Path{"plain"}, strings.NewReader("plain text"), nil))
+	obj, err = eb.GetObject(ctx, Path{"plain"}, 6)
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		assert.Equal(t, "text", string(b))
+	}
+	info, err := eb.HeadObject(ctx, Path{"plain"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), info.Size)
+}
+
+func TestEncryptedBackendS3(t *testing.T) {
+	fs3 := NewFakeS3("bucket")
+	defer fs3.Close()
+	sb := &S3Backend{
+		Bucket:               "bucket",
+		AWSConfig:            fs3.AWSConfig(),
+		ServerSideEncryption: &ServerSideEncryptionConfig{},
+	}
+	eb := &EncryptedBackend{Backend: sb, MasterKey: bytes.Repeat([]byte{1}, 32)}
+	ctx := context.Background()
+
+	// S3 refuses the range past the end of the ciphertext
+	data := make([]byte, cseChunkSize)
+	rand.Read(data)
+	assert.NoError(t, eb.PutObject(ctx, Path{"f"}, bytes.NewReader(data), nil))
+	for _, off := range []int64{0, cseChunkSize - 1, cseChunkSize, cseChunkSize + cseTagSize, 2 * cseChunkSize} {
+		obj, err := eb.GetObject(ctx, Path{"f"}, off)
+		if !assert.NoError(t, err, "off=%d", off) {
+			continue
+		}
+		b, err := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		assert.NoError(t, err, "off=%d", off)
+		if off < cseChunkSize {
+			assert.Equal(t, data[off:], b, "off=%d", off)
+		} else {
+			assert.Empty(t, b, "off=%d", off)
+		}
+	}
+
+	// not encrypted
+	fs3.PutObject("bucket", "plain", make([]byte, cseChunkSize+cseTagSize+1), nil)
+	obj, err := eb.GetObject(ctx, Path{"plain"}, cseChunkSize+cseTagSize)
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		assert.Len(t, b, 1)
+	}
+}
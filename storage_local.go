@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// localReservedName is the directory under the root that holds what the
+// local backend needs besides the files.  It is hidden from the listings.
+const localReservedName = ".s3-sftp-proxy"
+
+// LocalBackend stores the objects as the files under a local directory, or
+// a network file system mounted on it.  The metadata of the objects are
+// kept aside as there is no portable way to attach them to the files.
+type LocalBackend struct {
+	Root string
+}
+
+// localMetadata is what is stored aside for a file.  The size and the
+// modification time tell if the file has been modified by someone else
+// since then, in which case the metadata no longer applies.
+type localMetadata struct {
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"mtime"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// notExist normalizes the errors for the files that are not found, which
+// includes the case where a component of the path is a file.
+func notExist(err error) error {
+	if os.IsNotExist(err) {
+		return os.ErrNotExist
+	}
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOTDIR {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (lb *LocalBackend) path(key Path) (string, error) {
+	for i, c := range key {
+		if c == "" || c == "." || c == ".." || strings.ContainsRune(c, filepath.Separator) {
+			return "", os.ErrNotExist
+		}
+		if i == 0 && c == localReservedName {
+			return "", os.ErrPermission
+		}
+	}
+	return filepath.Join(lb.Root, filepath.FromSlash(key.String())), nil
+}
+
+func (lb *LocalBackend) metadataPath(key Path) string {
+	sum := sha256.Sum256([]byte(key.String()))
+	return filepath.Join(lb.Root, localReservedName, "metadata", hex.EncodeToString(sum[:]))
+}
+
+// stat returns the info of the file at the key, which must be a regular
+// file.
+func (lb *LocalBackend) stat(key Path) (string, os.FileInfo, error) {
+	p, err := lb.path(key)
+	if err != nil {
+		return "", nil, err
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return "", nil, notExist(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil, os.ErrNotExist
+	}
+	return p, fi, nil
+}
+
+func (lb *LocalBackend) readMetadata(key Path, fi os.FileInfo) map[string]string {
+	b, err := ioutil.ReadFile(lb.metadataPath(key))
+	if err != nil {
+		return nil
+	}
+	var md localMetadata
+	err = json.Unmarshal(b, &md)
+	if err != nil || md.Size != fi.Size() || !md.ModTime.Equal(fi.ModTime()) {
+		return nil
+	}
+	return md.Metadata
+}
+
+func (lb *LocalBackend) writeMetadata(key Path, fi os.FileInfo, metadata map[string]string) error {
+	p := lb.metadataPath(key)
+	if len(metadata) == 0 {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(&localMetadata{
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = lb.writeFile(p, bytes.NewReader(b))
+	return err
+}
+
+// writeFile replaces the file at p at once with the content of r.
+func (lb *LocalBackend) writeFile(p string, r io.Reader) (os.FileInfo, error) {
+	tmpDir := filepath.Join(lb.Root, localReservedName, "tmp")
+	err := os.MkdirAll(tmpDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(tmpDir, "")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (lb *LocalBackend) GetObject(ctx context.Context, key Path, offset int64) (*StorageObject, error) {
+	p, fi, err := lb.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &StorageObject{
+		StorageObjectInfo: StorageObjectInfo{
+			Key:          key,
+			Size:         fi.Size(),
+			LastModified: fi.ModTime(),
+			Metadata:     lb.readMetadata(key, fi),
+		},
+		Body: f,
+	}, nil
+}
+
+func (lb *LocalBackend) PutObject(ctx context.Context, key Path, body io.Reader, metadata map[string]string) error {
+	p, err := lb.path(key)
+	if err != nil {
+		return err
+	}
+	fi, err := lb.writeFile(p, body)
+	if err != nil {
+		return err
+	}
+	return lb.writeMetadata(key, fi, metadata)
+}
+
+func (lb *LocalBackend) HeadObject(ctx context.Context, key Path) (*StorageObjectInfo, error) {
+	_, fi, err := lb.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		Metadata:     lb.readMetadata(key, fi),
+	}, nil
+}
+
+func (lb *LocalBackend) ObjectMode(ctx context.Context, key Path) (os.FileMode, error) {
+	_, fi, err := lb.stat(key)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Mode().Perm(), nil
+}
+
+// ListObjects lists the directory at once.  The symbolic links and the
+// special files in it are skipped.
+func (lb *LocalBackend) ListObjects(ctx context.Context, prefix Path, continuation string) (*StorageListing, error) {
+	retval := &StorageListing{
+		Prefixes: []Path{},
+		Objects:  []*StorageObjectInfo{},
+	}
+	p, err := lb.path(prefix)
+	if err != nil {
+		return retval, nil
+	}
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		if notExist(err) == os.ErrNotExist {
+			return retval, nil
+		}
+		return nil, err
+	}
+	for _, fi := range fis {
+		if len(prefix) == 0 && fi.Name() == localReservedName {
+			continue
+		}
+		key := append(Path{}, prefix...).Join(Path{fi.Name()})
+		if fi.IsDir() {
+			retval.Prefixes = append(retval.Prefixes, key)
+		} else if fi.Mode().IsRegular() {
+			retval.Objects = append(retval.Objects, &StorageObjectInfo{
+				Key:          key,
+				Size:         fi.Size(),
+				LastModified: fi.ModTime(),
+			})
+		}
+	}
+	return retval, nil
+}
+
+func (lb *LocalBackend) CopyObject(ctx context.Context, src, dest Path, metadata map[string]string) error {
+	srcPath, srcFi, err := lb.stat(src)
+	if err != nil {
+		return err
+	}
+	destPath, err := lb.path(dest)
+	if err != nil {
+		return err
+	}
+	if metadata != nil {
+		metadata = mergeMetadata(lb.readMetadata(src, srcFi), metadata)
+	} else {
+		metadata = lb.readMetadata(src, srcFi)
+	}
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return notExist(err)
+	}
+	defer f.Close()
+	fi, err := lb.writeFile(destPath, f)
+	if err != nil {
+		return err
+	}
+	return lb.writeMetadata(dest, fi, metadata)
+}
+
+// DeleteObject removes the file along with the directories that become
+// empty, as the prefixes disappear on S3 once no objects are under them.
+func (lb *LocalBackend) DeleteObject(ctx context.Context, key Path) error {
+	p, _, err := lb.stat(key)
+	if err != nil {
+		if err == os.ErrNotExist {
+			return nil
+		}
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil {
+		return notExist(err)
+	}
+	err = os.Remove(lb.metadataPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(p); dir != filepath.Clean(lb.Root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
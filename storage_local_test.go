@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3-sftp-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	lb := &LocalBackend{Root: root}
+	ctx := context.Background()
+
+	err = lb.PutObject(ctx, Path{"a", "b.txt"}, strings.NewReader("hello"), map[string]string{"k": "v"})
+	assert.NoError(t, err)
+	info, err := lb.HeadObject(ctx, Path{"a", "b.txt"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, map[string]string{"k": "v"}, info.Metadata)
+
+	obj, err := lb.GetObject(ctx, Path{"a", "b.txt"}, 2)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(obj.Body)
+	obj.Body.Close()
+	assert.Equal(t, "llo", string(b))
+
+	listing, err := lb.ListObjects(ctx, Path{}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []Path{{"a"}}, listing.Prefixes)
+	assert.Empty(t, listing.Objects)
+
+	assert.NoError(t, lb.CopyObject(ctx, Path{"a", "b.txt"}, Path{"c.txt"}, nil))
+	info, err = lb.HeadObject(ctx, Path{"c.txt"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"k": "v"}, info.Metadata)
+	assert.NoError(t, lb.CopyObject(ctx, Path{"a", "b.txt"}, Path{"d.txt"}, map[string]string{"K": "w", "l": "x"}))
+	info, err = lb.HeadObject(ctx, Path{"d.txt"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"K": "w", "l": "x"}, info.Metadata)
+
+	// the metadata no longer applies once the file is modified by others
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "c.txt"), []byte("modified"), 0644))
+	info, err = lb.HeadObject(ctx, Path{"c.txt"})
+	assert.NoError(t, err)
+	assert.Empty(t, info.Metadata)
+
+	assert.NoError(t, lb.DeleteObject(ctx, Path{"a", "b.txt"}))
+	_, err = lb.HeadObject(ctx, Path{"a", "b.txt"})
+	assert.Equal(t, os.ErrNotExist, err)
+	_, err = os.Stat(filepath.Join(root, "a"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = lb.GetObject(ctx, Path{"c.txt", "d"}, 0)
+	assert.Equal(t, os.ErrNotExist, err)
+	assert.Equal(t, os.ErrPermission, lb.PutObject(ctx, Path{localReservedName, "x"}, strings.NewReader(""), nil))
+}
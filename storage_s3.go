@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	aws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	aws_creds "github.com/aws/aws-sdk-go/aws/credentials"
+	aws_ec2_role_creds "github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	aws_stscreds "github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	aws_ec2_meta "github.com/aws/aws-sdk-go/aws/ec2metadata"
+	aws_session "github.com/aws/aws-sdk-go/aws/session"
+	aws_v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	aws_sts "github.com/aws/aws-sdk-go/service/sts"
+)
+
+var aclPrivate = "private"
+
+var checksumModeEnabled = aws_s3.ChecksumModeEnabled
+
+// sseTypes are the values of x-amz-server-side-encryption header sent when
+// the objects are stored.  SSE-C is told by the customer key headers
+// instead.
+var sseTypes = map[ServerSideEncryptionType]*string{
+	ServerSideEncryptionTypeAES256: aws.String(aws_s3.ServerSideEncryptionAes256),
+	ServerSideEncryptionTypeKMS:    aws.String(aws_s3.ServerSideEncryptionAwsKms),
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	} else {
+		return &s
+	}
+}
+
+// IsNotFound tells if the error is the one S3 returns for missing objects.
+func IsNotFound(e error) bool {
+	if rf, ok := e.(awserr.RequestFailure); ok {
+		return rf.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+func isInvalidRange(e error) bool {
+	if rf, ok := e.(awserr.RequestFailure); ok {
+		return rf.StatusCode() == http.StatusRequestedRangeNotSatisfiable
+	}
+	return false
+}
+
+// translateS3Error turns the error for missing objects into os.ErrNotExist.
+func translateS3Error(e error) error {
+	if IsNotFound(e) {
+		return os.ErrNotExist
+	}
+	return e
+}
+
+func toS3Metadata(m map[string]string) map[string]*string {
+	if len(m) == 0 {
+		return nil
+	}
+	retval := make(map[string]*string, len(m))
+	for k, v := range m {
+		retval[k] = aws.String(v)
+	}
+	return retval
+}
+
+func fromS3Metadata(m map[string]*string) map[string]string {
+	retval := make(map[string]string, len(m))
+	for k, v := range m {
+		if v != nil {
+			retval[k] = *v
+		}
+	}
+	return retval
+}
+
+func aclToMode(owner *aws_s3.Owner, grants []*aws_s3.Grant) os.FileMode {
+	var v os.FileMode
+	for _, g := range grants {
+		if g.Grantee != nil {
+			if g.Grantee.ID != nil && *g.Grantee.ID == *owner.ID {
+				switch *g.Permission {
+				case "READ":
+					v |= 0400
+				case "WRITE":
+					v |= 0200
+				case "FULL_CONTROL":
+					v |= 0600
+				}
+			} else if g.Grantee.URI != nil {
+				switch *g.Grantee.URI {
+				case "http://acs.amazonaws.com/groups/global/AuthenticatedUsers":
+					switch *g.Permission {
+					case "READ":
+						v |= 0440
+					case "WRITE":
+						v |= 0220
+					case "FULL_CONTROL":
+						v |= 0660
+					}
+				case "http://acs.amazonaws.com/groups/global/AllUsers":
+					switch *g.Permission {
+					case "READ":
+						v |= 0444
+					case "WRITE":
+						v |= 0222
+					case "FULL_CONTROL":
+						v |= 0666
+					}
+				}
+			}
+		}
+	}
+	return v
+}
+
+// roleExpiryWindow is how long before the expiration the credentials of
+// an assumed role are refreshed.
+const roleExpiryWindow = time.Minute
+
+// defaultCredentials returns the credentials used unless configured
+// explicitly: the web identity given by the environment variables as on
+// Kubernetes with IAM roles for service accounts, the EC2 instance role, and
+// the environment variables holding the keys.
+func defaultCredentials(sess *aws_session.Session) *aws_creds.Credentials {
+	providers := []aws_creds.Provider{}
+	roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN != "" && tokenFile != "" {
+		providers = append(providers, newWebIdentityProvider(aws_sts.New(sess), roleARN, os.Getenv("AWS_ROLE_SESSION_NAME"), tokenFile))
+	}
+	providers = append(
+		providers,
+		&aws_ec2_role_creds.EC2RoleProvider{
+			Client:       aws_ec2_meta.New(sess),
+			ExpiryWindow: 0,
+		},
+		&aws_creds.EnvProvider{},
+	)
+	return aws_creds.NewChainCredentials(providers)
+}
+
+func newWebIdentityProvider(svc *aws_sts.STS, roleARN, sessionName, tokenFile string) aws_creds.Provider {
+	return aws_stscreds.NewWebIdentityRoleProviderWithOptions(
+		svc,
+		roleARN,
+		sessionName,
+		aws_stscreds.FetchTokenPath(tokenFile),
+		func(p *aws_stscreds.WebIdentityRoleProvider) {
+			p.ExpiryWindow = roleExpiryWindow
+		},
+	)
+}
+
+// AssumeRoleConfig tells the role whose credentials are used to access the
+// bucket.
+type AssumeRoleConfig struct {
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+	// WebIdentityTokenFile is the file holding the OpenID Connect token the
+	// role is assumed with.  The role is assumed with the credentials
+	// otherwise used if empty.
+	WebIdentityTokenFile string
+	STSEndpoint          string
+	// Policy is the session policy that further limits the permissions of
+	// the role.  It may not be used with WebIdentityTokenFile.
+	Policy string
+}
+
+// NewAssumeRoleCredentials returns the credentials of the role, which are
+// refreshed as they expire.  STS is called with the region, the HTTP client
+// and the credentials in awsCfg, but not with its endpoint.
+func NewAssumeRoleCredentials(awsCfg *aws.Config, rCfg *AssumeRoleConfig) (*aws_creds.Credentials, error) {
+	// the config is not given to the session, which would override the
+	// certificate authorities of the HTTP client with AWS_CA_BUNDLE
+	sess, err := aws_session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stsCfg := aws.NewConfig().WithHTTPClient(awsCfg.HTTPClient)
+	stsCfg.Region = awsCfg.Region
+	if rCfg.STSEndpoint != "" {
+		stsCfg = stsCfg.WithEndpoint(rCfg.STSEndpoint)
+	}
+	if rCfg.WebIdentityTokenFile != "" {
+		if rCfg.Policy != "" {
+			return nil, fmt.Errorf("session policy is not supported with web identity")
+		}
+		return aws_creds.NewCredentials(newWebIdentityProvider(aws_sts.New(sess, stsCfg), rCfg.RoleARN, rCfg.RoleSessionName, rCfg.WebIdentityTokenFile)), nil
+	}
+	stsCfg.Credentials = awsCfg.Credentials
+	if stsCfg.Credentials == nil {
+		stsCfg = stsCfg.WithCredentials(defaultCredentials(sess))
+	}
+	return aws_stscreds.NewCredentialsWithClient(aws_sts.New(sess, stsCfg), rCfg.RoleARN, func(p *aws_stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = rCfg.RoleSessionName
+		p.ExternalID = nilIfEmpty(rCfg.ExternalID)
+		p.Policy = nilIfEmpty(rCfg.Policy)
+		p.ExpiryWindow = roleExpiryWindow
+	}), nil
+}
+
+// S3Backend stores the objects in an S3 bucket.
+type S3Backend struct {
+	Bucket               string
+	AWSConfig            *aws.Config
+	ServerSideEncryption *ServerSideEncryptionConfig
+	// SignatureVersion is either "v4", or "v2" for the S3-compatible stores
+	// that do not support the version 4.
+	SignatureVersion string
+}
+
+func (sb *S3Backend) s3() (*aws_s3.S3, error) {
+	sess, err := aws_session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	awsCfg := sb.AWSConfig
+	if awsCfg.Credentials == nil {
+		awsCfg = sb.AWSConfig.WithCredentials(defaultCredentials(sess))
+	}
+	svc := aws_s3.New(sess, awsCfg)
+	if sb.SignatureVersion == "v2" {
+		svc.Handlers.Sign.Swap(aws_v4.SignRequestHandler.Name, s3SignV2Handler)
+	}
+	return svc, nil
+}
+
+// base64ToHex converts the checksums S3 gives in base64.
+func base64ToHex(v *string) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(*v)
+	if err != nil {
+		return "", false
+	}
+	return hex.EncodeToString(b), true
+}
+
+// s3Checksums returns the checksums of the whole object that can be told
+// from the response.
+func s3Checksums(etag, sseCustomerAlgorithm, sse, checksumSHA1, checksumSHA256 *string) map[string]string {
+	retval := map[string]string{}
+	// the ETag of an object uploaded in a single part is the MD5 unless
+	// encrypted with KMS or a customer provided key
+	encrypted := sseCustomerAlgorithm != nil || (sse != nil && *sse == aws_s3.ServerSideEncryptionAwsKms)
+	if etag != nil && !encrypted {
+		// the ETag of a multipart upload looks like "xxx-3"
+		if v := strings.Trim(*etag, `"`); !strings.Contains(v, "-") {
+			retval["md5"] = strings.ToLower(v)
+		}
+	}
+	// so do the composite checksums
+	if checksumSHA1 != nil && !strings.Contains(*checksumSHA1, "-") {
+		if v, ok := base64ToHex(checksumSHA1); ok {
+			retval["sha1"] = v
+		}
+	}
+	if checksumSHA256 != nil && !strings.Contains(*checksumSHA256, "-") {
+		if v, ok := base64ToHex(checksumSHA256); ok {
+			retval["sha256"] = v
+		}
+	}
+	return retval
+}
+
+func (sb *S3Backend) GetObject(ctx context.Context, key Path, offset int64) (*StorageObject, error) {
+	s3, err := sb.s3()
+	if err != nil {
+		return nil, err
+	}
+	keyStr := key.String()
+	sse := sb.ServerSideEncryption
+	input := &aws_s3.GetObjectInput{
+		Bucket:               &sb.Bucket,
+		Key:                  &keyStr,
+		SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+		SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+		SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	out, err := s3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		if offset > 0 && isInvalidRange(err) {
+			// reading past the end
+			return &StorageObject{
+				StorageObjectInfo: StorageObjectInfo{Key: key},
+				Body:              ioutil.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		}
+		return nil, translateS3Error(err)
+	}
+	return &StorageObject{
+		StorageObjectInfo: StorageObjectInfo{
+			Key:          key,
+			Size:         aws.Int64Value(out.ContentLength),
+			LastModified: aws.TimeValue(out.LastModified),
+			Metadata:     fromS3Metadata(out.Metadata),
+		},
+		Body: out.Body,
+	}, nil
+}
+
+// PutObject uploads the content in multiple parts if it is large.
+func (sb *S3Backend) PutObject(ctx context.Context, key Path, body io.Reader, metadata map[string]string) error {
+	s3, err := sb.s3()
+	if err != nil {
+		return err
+	}
+	keyStr := key.String()
+	sse := sb.ServerSideEncryption
+	_, err = s3manager.NewUploaderWithClient(s3).UploadWithContext(
+		ctx,
+		&s3manager.UploadInput{
+			ACL:                  &aclPrivate,
+			Body:                 body,
+			Bucket:               &sb.Bucket,
+			Key:                  &keyStr,
+			Metadata:             toS3Metadata(metadata),
+			ServerSideEncryption: sseTypes[sse.Type],
+			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+			SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyId),
+		},
+	)
+	return err
+}
+
+// HeadBucket tells whether the bucket exists and can be accessed with the
+// credentials.
+func (sb *S3Backend) HeadBucket(ctx context.Context) error {
+	s3, err := sb.s3()
+	if err != nil {
+		return err
+	}
+	_, err = s3.HeadBucketWithContext(ctx, &aws_s3.HeadBucketInput{Bucket: &sb.Bucket})
+	return err
+}
+
+func (sb *S3Backend) HeadObject(ctx context.Context, key Path) (*StorageObjectInfo, error) {
+	s3, err := sb.s3()
+	if err != nil {
+		return nil, err
+	}
+	keyStr := key.String()
+	sse := sb.ServerSideEncryption
+	out, err := s3.HeadObjectWithContext(
+		ctx,
+		&aws_s3.HeadObjectInput{
+			Bucket:               &sb.Bucket,
+			Key:                  &keyStr,
+			ChecksumMode:         &checksumModeEnabled,
+			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+		},
+	)
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return &StorageObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		LastModified: aws.TimeValue(out.LastModified),
+		Metadata:     fromS3Metadata(out.Metadata),
+		Checksums:    s3Checksums(out.ETag, out.SSECustomerAlgorithm, out.ServerSideEncryption, out.ChecksumSHA1, out.ChecksumSHA256),
+	}, nil
+}
+
+// ObjectMode tells the permission bits from the ACL of the object.
+func (sb *S3Backend) ObjectMode(ctx context.Context, key Path) (os.FileMode, error) {
+	s3, err := sb.s3()
+	if err != nil {
+		return 0, err
+	}
+	keyStr := key.String()
+	out, err := s3.GetObjectAclWithContext(
+		ctx,
+		&aws_s3.GetObjectAclInput{
+			Bucket: &sb.Bucket,
+			Key:    &keyStr,
+		},
+	)
+	if err != nil {
+		return 0, translateS3Error(err)
+	}
+	return aclToMode(out.Owner, out.Grants), nil
+}
+
+func (sb *S3Backend) ListObjects(ctx context.Context, prefix Path, continuation string) (*StorageListing, error) {
+	s3, err := sb.s3()
+	if err != nil {
+		return nil, err
+	}
+	prefixStr := prefix.String()
+	if prefixStr != "" {
+		prefixStr += "/"
+	}
+	out, err := s3.ListObjectsV2WithContext(
+		ctx,
+		&aws_s3.ListObjectsV2Input{
+			Bucket:            &sb.Bucket,
+			Prefix:            &prefixStr,
+			MaxKeys:           aws.Int64(10000),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: nilIfEmpty(continuation),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	retval := &StorageListing{
+		Prefixes:     make([]Path, 0, len(out.CommonPrefixes)),
+		Objects:      make([]*StorageObjectInfo, 0, len(out.Contents)),
+		Continuation: aws.StringValue(out.NextContinuationToken),
+	}
+	for _, cPfx := range out.CommonPrefixes {
+		retval.Prefixes = append(retval.Prefixes, append(Path{}, prefix...).Join(Path{path.Base(*cPfx.Prefix)}))
+	}
+	for _, obj := range out.Contents {
+		retval.Objects = append(retval.Objects, &StorageObjectInfo{
+			Key:          append(Path{}, prefix...).Join(Path{path.Base(*obj.Key)}),
+			Size:         aws.Int64Value(obj.Size),
+			LastModified: aws.TimeValue(obj.LastModified),
+		})
+	}
+	return retval, nil
+}
+
+// CopyObject copies the object on S3 with the encryption settings of the
+// bucket applied to the copy.  The source is decrypted with the same
+// customer key if SSE-C is used.  If the metadata is to be changed, it is
+// replaced as a whole with that of the source looked up in advance, since S3
+// cannot change some of the values.
+func (sb *S3Backend) CopyObject(ctx context.Context, src, dest Path, metadata map[string]string) error {
+	var directive *string
+	if metadata != nil {
+		info, err := sb.HeadObject(ctx, src)
+		if err != nil {
+			return err
+		}
+		metadata = mergeMetadata(info.Metadata, metadata)
+		directive = aws.String(aws_s3.MetadataDirectiveReplace)
+	}
+	s3, err := sb.s3()
+	if err != nil {
+		return err
+	}
+	destStr := dest.String()
+	copySource := sb.Bucket + "/" + src.String()
+	sse := sb.ServerSideEncryption
+	_, err = s3.CopyObjectWithContext(
+		ctx,
+		&aws_s3.CopyObjectInput{
+			ACL:                  &aclPrivate,
+			Bucket:               &sb.Bucket,
+			CopySource:           &copySource,
+			Key:                  &destStr,
+			Metadata:             toS3Metadata(metadata),
+			MetadataDirective:    directive,
+			ServerSideEncryption: sseTypes[sse.Type],
+			SSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			SSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			SSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+			SSEKMSKeyId:          nilIfEmpty(sse.KMSKeyId),
+
+			CopySourceSSECustomerAlgorithm: nilIfEmpty(sse.CustomerAlgorithm()),
+			CopySourceSSECustomerKey:       nilIfEmpty(sse.CustomerKey),
+			CopySourceSSECustomerKeyMD5:    nilIfEmpty(sse.CustomerKeyMD5),
+		},
+	)
+	return translateS3Error(err)
+}
+
+func (sb *S3Backend) DeleteObject(ctx context.Context, key Path) error {
+	s3, err := sb.s3()
+	if err != nil {
+		return err
+	}
+	keyStr := key.String()
+	_, err = s3.DeleteObjectWithContext(
+		ctx,
+		&aws_s3.DeleteObjectInput{
+			Bucket: &sb.Bucket,
+			Key:    &keyStr,
+		},
+	)
+	return err
+}
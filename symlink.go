@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+// A symbolic link is represented as an empty object with the target path
+// held in its metadata.
+const symlinkMetadataKey = "symlink-target"
+
+const maxSymlinkHops = 8
+
+var errTooManySymlinks = fmt.Errorf("too many levels of symbolic links")
+
+func symlinkTarget(metadata map[string]string) (string, bool) {
+	target, ok := lookupMetadata(metadata, symlinkMetadataKey)
+	if !ok || target == "" {
+		return "", false
+	}
+	return target, true
+}
+
+// resolveSymlinkPath returns the path the link at linkPath points to.  The
+// target is interpreted in the user's view of the file system, so that ".."
+// never goes up beyond the root.
+func resolveSymlinkPath(linkPath, target string) string {
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(linkPath), target)
+	}
+	return path.Clean("/" + target)
+}
+
+// resolveSymlinkKey returns the key of the object the link at linkKey points
+// to.  The result is always under keyPrefix.
+func resolveSymlinkKey(keyPrefix, linkKey Path, target string) Path {
+	linkPath := "/" + Path(linkKey[len(keyPrefix):]).String()
+	resolved := SplitIntoPath(resolveSymlinkPath(linkPath, target))
+	return append(Path{}, keyPrefix...).Join(resolved)
+}
+
+// headObject retrieves the metadata of the object.
+func (s3io *S3BucketIO) headObject(ctx context.Context, key Path) (*StorageObjectInfo, error) {
+	F(s3io.Log.Debug, "HeadObject(Key=%s)", key)
+	info, err := s3io.Backend.HeadObject(ctx, key)
+	if err != nil {
+		s3io.Log.Debug("=> ", err)
+		return nil, err
+	}
+	return info, nil
+}
+
+// Readlink returns the target of the symbolic link as it was given when the
+// link was made.
+func (s3io *S3BucketIO) Readlink(p string) (string, error) {
+	if !s3io.Perms.Readable && !s3io.Perms.Listable {
+		return "", fmt.Errorf("stat operation not allowed as per configuration")
+	}
+	key := buildKey(s3io.Bucket, p)
+	if s3io.PhantomObjectMap.Get(key) != nil {
+		return "", fmt.Errorf("not a symbolic link")
+	}
+	info, err := s3io.headObject(s3io.Ctx, key)
+	if err != nil {
+		return "", err
+	}
+	target, ok := symlinkTarget(info.Metadata)
+	if !ok {
+		return "", fmt.Errorf("not a symbolic link")
+	}
+	return target, nil
+}
+
+// Lstat is the same as Stat except that symbolic links are not followed.
+func (s3io *S3BucketIO) Lstat(req *sftp.Request) (sftp.ListerAt, error) {
+	return s3io.stat(req, false)
+}
+
+// symlink serves "Symlink", for which pkg/sftp gives the target in Filepath
+// and the path of the link in Target.
+func (s3io *S3BucketIO) symlink(req *sftp.Request) error {
+	if !s3io.Perms.Writable {
+		return fmt.Errorf("write operation not allowed as per configuration")
+	}
+	if req.Filepath == "" {
+		return fmt.Errorf("empty link target")
+	}
+	ctx := combineContext(s3io.Ctx, req.Context())
+	key := buildKey(s3io.Bucket, req.Target)
+	if s3io.PhantomObjectMap.Get(key) != nil {
+		return os.ErrExist
+	}
+	_, err := s3io.headObject(ctx, key)
+	if err == nil {
+		return os.ErrExist
+	} else if err != os.ErrNotExist {
+		return err
+	}
+	metadata := map[string]string{symlinkMetadataKey: req.Filepath}
+	quota := s3io.Bucket.Quota
+	if quota != nil {
+		metadata[ownerMetadataKey] = s3io.user()
+		err = quota.Reserve(s3io.user(), QuotaUsage{Objects: 1}, QuotaUsage{Objects: 1})
+		if err != nil {
+			return err
+		}
+		defer quota.Release(s3io.user(), QuotaUsage{Objects: 1}, QuotaUsage{Objects: 1})
+	}
+	F(s3io.Log.Debug, "PutObject(Key=%s, Target=%s)", key, req.Filepath)
+	err = s3io.Backend.PutObject(ctx, key, bytes.NewReader([]byte{}), metadata)
+	if err != nil {
+		s3io.Log.Debug("=> ", err)
+		return err
+	}
+	quota.Add(s3io.user(), QuotaUsage{Objects: 1})
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSymlinkPath(t *testing.T) {
+	assert.Equal(t, "/a/c", resolveSymlinkPath("/a/b", "c"))
+	assert.Equal(t, "/c", resolveSymlinkPath("/a/b", "/c"))
+	assert.Equal(t, "/c", resolveSymlinkPath("/a/b", "../c"))
+	assert.Equal(t, "/etc/passwd", resolveSymlinkPath("/a/b", "../../../../etc/passwd"))
+	assert.Equal(t, "/", resolveSymlinkPath("/a", ".."))
+}
+
+func TestResolveSymlinkKey(t *testing.T) {
+	prefix := Path{"prefix", "user"}
+	linkKey := Path{"prefix", "user", "a", "b"}
+	assert.Equal(t, Path{"prefix", "user", "a", "c"}, resolveSymlinkKey(prefix, linkKey, "c"))
+	assert.Equal(t, Path{"prefix", "user", "etc", "passwd"}, resolveSymlinkKey(prefix, linkKey, "../../../etc/passwd"))
+	assert.Equal(t, Path{"prefix", "user"}, resolveSymlinkKey(prefix, linkKey, "/"))
+	// the prefix is not modified
+	assert.Equal(t, Path{"prefix", "user"}, prefix)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// parseListenFDs interprets the environment variables of the systemd socket
+// activation, and returns the names of the file descriptors passed.  It
+// returns nil if the sockets are meant for another process or none are
+// passed.
+func parseListenFDs(pid int, listenPID, listenFDs, listenFDNames string) ([]string, error) {
+	if listenPID == "" || listenFDs == "" {
+		return nil, nil
+	}
+	_pid, err := strconv.Atoi(listenPID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID: %s", listenPID)
+	}
+	if _pid != pid {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", listenFDs)
+	}
+	var names []string
+	if listenFDNames != "" {
+		names = strings.Split(listenFDNames, ":")
+	}
+	retval := make([]string, n)
+	for i := range retval {
+		// systemd names the sockets "unknown" if it does not tell
+		retval[i] = "unknown"
+		if i < len(names) && names[i] != "" {
+			retval[i] = names[i]
+		}
+	}
+	return retval, nil
+}
+
+// SystemdListeners returns the TCP sockets passed by the systemd socket
+// activation, keyed by the names given with FileDescriptorName=, which
+// default to the name of the socket unit.  A socket unit with several
+// ListenStream= passes as many sockets under the same name.
+func SystemdListeners() (map[string][]*net.TCPListener, error) {
+	names, err := parseListenFDs(os.Getpid(), os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	if err != nil {
+		return nil, err
+	}
+	// not to be inherited by the child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	retval := map[string][]*net.TCPListener{}
+	for i, name := range names {
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		lsnr, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s passed by systemd: %s", name, err.Error())
+		}
+		tcpLsnr, ok := lsnr.(*net.TCPListener)
+		if !ok {
+			lsnr.Close()
+			return nil, fmt.Errorf("socket %s passed by systemd is not a TCP socket", name)
+		}
+		retval[name] = append(retval[name], tcpLsnr)
+	}
+	return retval, nil
+}
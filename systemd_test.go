@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenFDs(t *testing.T) {
+	cases := []struct {
+		listenPID     string
+		listenFDs     string
+		listenFDNames string
+		expected      []string
+		err           bool
+	}{
+		{"", "", "", nil, false},
+		{"100", "2", "public:internal", []string{"public", "internal"}, false},
+		{"100", "2", "", []string{"unknown", "unknown"}, false},
+		{"100", "3", "public:", []string{"public", "unknown", "unknown"}, false},
+		{"101", "2", "public:internal", nil, false},
+		{"100", "x", "", nil, true},
+		{"x", "2", "", nil, true},
+	}
+	for i, c := range cases {
+		names, err := parseListenFDs(100, c.listenPID, c.listenFDs, c.listenFDNames)
+		if c.err {
+			assert.Error(t, err, "case %d", i)
+		} else if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.expected, names, "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// UploadTracker keeps track of the uploads that have not been flushed to S3
+// yet, so the server can wait for them to complete before shutting down.
+type UploadTracker struct {
+	mtx         sync.Mutex
+	uploads     map[*PhantomObjectInfo]struct{}
+	draining    bool
+	abandoned   bool
+	drainedChan chan struct{}
+}
+
+// Begin registers a new upload.  It returns false once draining has started,
+// in which case no more uploads should be accepted.
+func (ut *UploadTracker) Begin(info *PhantomObjectInfo) bool {
+	ut.mtx.Lock()
+	defer ut.mtx.Unlock()
+	if ut.draining {
+		return false
+	}
+	ut.uploads[info] = struct{}{}
+	return true
+}
+
+// Finish unregisters the upload after it has been flushed or discarded.
+func (ut *UploadTracker) Finish(info *PhantomObjectInfo) {
+	ut.mtx.Lock()
+	defer ut.mtx.Unlock()
+	delete(ut.uploads, info)
+	if ut.drainedChan != nil && len(ut.uploads) == 0 {
+		close(ut.drainedChan)
+		ut.drainedChan = nil
+	}
+}
+
+// Abandoned returns true after the grace period given to Drain has elapsed.
+// Uploads still open by then must not be flushed as they may be incomplete.
+func (ut *UploadTracker) Abandoned() bool {
+	ut.mtx.Lock()
+	defer ut.mtx.Unlock()
+	return ut.abandoned
+}
+
+// Drain stops accepting new uploads and waits until every upload in flight
+// is finished or ctx is done.  It returns the uploads that did not make it.
+func (ut *UploadTracker) Drain(ctx context.Context) []*PhantomObjectInfo {
+	ut.mtx.Lock()
+	ut.draining = true
+	var drainedChan chan struct{}
+	if len(ut.uploads) > 0 {
+		if ut.drainedChan == nil {
+			ut.drainedChan = make(chan struct{})
+		}
+		drainedChan = ut.drainedChan
+	}
+	ut.mtx.Unlock()
+
+	if drainedChan != nil {
+		select {
+		case <-ctx.Done():
+		case <-drainedChan:
+		}
+	}
+
+	ut.mtx.Lock()
+	defer ut.mtx.Unlock()
+	ut.abandoned = true
+	retval := make([]*PhantomObjectInfo, 0, len(ut.uploads))
+	for info := range ut.uploads {
+		retval = append(retval, info)
+	}
+	return retval
+}
+
+func NewUploadTracker() *UploadTracker {
+	return &UploadTracker{
+		uploads: map[*PhantomObjectInfo]struct{}{},
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadTrackerDrain(t *testing.T) {
+	ut := NewUploadTracker()
+	o1 := &PhantomObjectInfo{Key: Path{"", "a"}}
+	o2 := &PhantomObjectInfo{Key: Path{"", "b"}}
+	assert.Equal(t, true, ut.Begin(o1))
+	assert.Equal(t, true, ut.Begin(o2))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ut.Finish(o1)
+		ut.Finish(o2)
+	}()
+	assert.Empty(t, ut.Drain(context.Background()))
+	assert.Equal(t, false, ut.Begin(&PhantomObjectInfo{Key: Path{"", "c"}}))
+	assert.Equal(t, true, ut.Abandoned())
+}
+
+func TestUploadTrackerDrainTimeout(t *testing.T) {
+	ut := NewUploadTracker()
+	o1 := &PhantomObjectInfo{Key: Path{"", "a"}}
+	o2 := &PhantomObjectInfo{Key: Path{"", "b"}}
+	assert.Equal(t, true, ut.Begin(o1))
+	assert.Equal(t, true, ut.Begin(o2))
+	ut.Finish(o1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, []*PhantomObjectInfo{o2}, ut.Drain(ctx))
+	assert.Equal(t, true, ut.Abandoned())
+}
+
+func TestUploadTrackerNotDraining(t *testing.T) {
+	ut := NewUploadTracker()
+	o1 := &PhantomObjectInfo{Key: Path{"", "a"}}
+	assert.Equal(t, true, ut.Begin(o1))
+	ut.Finish(o1)
+	assert.Equal(t, false, ut.Abandoned())
+}
@@ -7,3 +7,12 @@ type PrintlnLike func(...interface{})
 func F(p PrintlnLike, f string, args ...interface{}) {
 	p(fmt.Sprintf(f, args...))
 }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}